@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	gl "cloud.google.com/go/ai/generativelanguage/apiv1beta"
@@ -41,6 +42,7 @@ func (c *Client) GenerativeModelFromCachedContent(cc *CachedContent) *Generative
 	return &GenerativeModel{
 		c:                 c,
 		fullName:          cc.Model,
+		info:              &infoCache{},
 		CachedContentName: cc.Name,
 	}
 }
@@ -58,27 +60,43 @@ func (c *Client) GenerativeModelFromCachedContent(cc *CachedContent) *Generative
 // You can use the return value to create a model with [Client.GenerativeModelFromCachedContent].
 // Or you can set [GenerativeModel.CachedContentName] to the name of the CachedContent, in which
 // case you must ensure that the model provided in this call matches the name in the [GenerativeModel].
+//
+// To avoid creating the CachedContent twice when a call is repeated, pass a
+// context created with [WithIdempotencyKey].
 func (c *Client) CreateCachedContent(ctx context.Context, cc *CachedContent) (*CachedContent, error) {
 	if cc.Name != "" {
 		return nil, errors.New("genai.CreateCachedContent: do not provide a name; one will be generated")
 	}
 	pcc := cc.toProto()
 	pcc.Model = Ptr(fullModelName(cc.Model))
+	if err := c.fillFileDataMIMETypes(ctx, pcc.Contents); err != nil {
+		return nil, err
+	}
 	req := &pb.CreateCachedContentRequest{
 		CachedContent: pcc,
 	}
 	debugPrint(req)
-	return c.cachedContentFromProto(c.cc.CreateCachedContent(ctx, req))
+	pcc, err := idempotent(ctx, &c.ic, "CreateCachedContent", func() (*pb.CachedContent, error) {
+		pcc, err := c.cc.CreateCachedContent(c.callContext(ctx), req)
+		if err != nil {
+			return nil, c.addRequestBody(wrapError(err), req)
+		}
+		return pcc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return (CachedContent{}).fromProto(pcc), nil
 }
 
 // GetCachedContent retrieves the CachedContent with the given name.
 func (c *Client) GetCachedContent(ctx context.Context, name string) (*CachedContent, error) {
-	return c.cachedContentFromProto(c.cc.GetCachedContent(ctx, &pb.GetCachedContentRequest{Name: name}))
+	return c.cachedContentFromProto(c.cc.GetCachedContent(c.callContext(ctx), &pb.GetCachedContentRequest{Name: name}))
 }
 
 // DeleteCachedContent deletes the CachedContent with the given name.
 func (c *Client) DeleteCachedContent(ctx context.Context, name string) error {
-	return c.cc.DeleteCachedContent(ctx, &pb.DeleteCachedContentRequest{Name: name})
+	return wrapError(c.cc.DeleteCachedContent(c.callContext(ctx), &pb.DeleteCachedContentRequest{Name: name}))
 }
 
 // CachedContentToUpdate specifies which fields of a CachedContent to modify in a call to
@@ -115,14 +133,45 @@ func (c *Client) UpdateCachedContent(ctx context.Context, cc *CachedContent, ccu
 		UpdateMask:    &fieldmaskpb.FieldMask{Paths: []string{mask}},
 	}
 	debugPrint(req)
-	return c.cachedContentFromProto(c.cc.UpdateCachedContent(ctx, req))
+	return c.cachedContentFromProto(c.cc.UpdateCachedContent(c.callContext(ctx), req))
 }
 
 // ListCachedContents lists all the CachedContents associated with the project and location.
 func (c *Client) ListCachedContents(ctx context.Context) *CachedContentIterator {
 	return &CachedContentIterator{
-		it: c.cc.ListCachedContents(ctx, &pb.ListCachedContentsRequest{}),
+		it: c.cc.ListCachedContents(c.callContext(ctx), &pb.ListCachedContentsRequest{}),
+	}
+}
+
+// ListCachedContentsByExpiration returns all the CachedContents associated with the
+// project and location, sorted so that the ones that will expire soonest come first.
+func (c *Client) ListCachedContentsByExpiration(ctx context.Context) ([]*CachedContent, error) {
+	var ccs []*CachedContent
+	it := c.ListCachedContents(ctx)
+	for {
+		cc, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ccs = append(ccs, cc)
 	}
+	sortCachedContentsByExpiration(ccs)
+	return ccs, nil
+}
+
+// sortCachedContentsByExpiration sorts ccs by increasing expiration time.
+// CachedContents without an expiration time sort last.
+func sortCachedContentsByExpiration(ccs []*CachedContent) {
+	sort.SliceStable(ccs, func(i, j int) bool {
+		ti, tj := ccs[i].Expiration.ExpireTime, ccs[j].Expiration.ExpireTime
+		if ti.IsZero() || tj.IsZero() {
+			return !ti.IsZero() && tj.IsZero()
+		}
+		return ti.Before(tj)
+	})
 }
 
 // A CachedContentIterator iterates over CachedContents.
@@ -135,7 +184,7 @@ type CachedContentIterator struct {
 func (it *CachedContentIterator) Next() (*CachedContent, error) {
 	m, err := it.it.Next()
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 	return (CachedContent{}).fromProto(m), nil
 }
@@ -147,7 +196,7 @@ func (it *CachedContentIterator) PageInfo() *iterator.PageInfo {
 
 func (c *Client) cachedContentFromProto(pcc *pb.CachedContent, err error) (*CachedContent, error) {
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 	cc := (CachedContent{}).fromProto(pcc)
 	return cc, nil
@@ -187,6 +236,12 @@ func populateCachedContentFrom(v *CachedContent, p *pb.CachedContent) {
 		v.Expiration.ExpireTime = pvTimeFromProto(e.ExpireTime)
 	case *pb.CachedContent_Ttl:
 		v.Expiration.TTL = e.Ttl.AsDuration()
+		// The TTL is measured from the last update, so we can compute
+		// the expiration time as well. That lets callers compare expiration
+		// times regardless of how the service reported them.
+		if !v.UpdateTime.IsZero() {
+			v.Expiration.ExpireTime = v.UpdateTime.Add(v.Expiration.TTL)
+		}
 	default:
 		panic(fmt.Sprintf("unknown type of CachedContent.Expiration: %T", p.Expiration))
 	}
@@ -63,6 +63,79 @@ func TestPopulateCachedContent(t *testing.T) {
 	}
 }
 
+func TestCachedContentMixedParts(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G'}
+	cc := &CachedContent{
+		Model: "models/m",
+		Contents: []*Content{{
+			Role: "user",
+			Parts: []Part{
+				Text("Compare the image and the video."),
+				ImageData("png", png),
+				FileData{MIMEType: "video/mp4", URI: "https://generativelanguage.googleapis.com/v1beta/files/v"},
+			},
+		}},
+		Expiration: ExpireTimeOrTTL{TTL: time.Hour},
+	}
+	got := cc.toProto()
+	want := []*pb.Content{{
+		Role: "user",
+		Parts: []*pb.Part{
+			{Data: &pb.Part_Text{Text: "Compare the image and the video."}},
+			{Data: &pb.Part_InlineData{InlineData: &pb.Blob{MimeType: "image/png", Data: png}}},
+			{Data: &pb.Part_FileData{FileData: &pb.FileData{
+				MimeType: "video/mp4",
+				FileUri:  "https://generativelanguage.googleapis.com/v1beta/files/v",
+			}}},
+		},
+	}}
+	if diff := cmp.Diff(want, got.Contents, cmpopts.IgnoreUnexported(pb.Content{}, pb.Part{}, pb.Blob{}, pb.FileData{})); diff != "" {
+		t.Errorf("toProto mismatch (-want, +got):\n%s", diff)
+	}
+
+	// The parts survive a round trip, in order.
+	back := (CachedContent{}).fromProto(got)
+	if diff := cmp.Diff(cc.Contents, back.Contents); diff != "" {
+		t.Errorf("round trip mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestPopulateCachedContentTTLWithUpdateTime(t *testing.T) {
+	ut := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := &pb.CachedContent{
+		UpdateTime: timestamppb.New(ut),
+		Expiration: &pb.CachedContent_Ttl{Ttl: durationpb.New(time.Hour)},
+	}
+	got := (CachedContent{}).fromProto(p)
+	want := ExpireTimeOrTTL{ExpireTime: ut.Add(time.Hour), TTL: time.Hour}
+	if !cmp.Equal(got.Expiration, want) {
+		t.Errorf("got %v, want %v", got.Expiration, want)
+	}
+}
+
+func TestSortCachedContentsByExpiration(t *testing.T) {
+	tm := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	cc := func(name string, exp time.Time) *CachedContent {
+		return &CachedContent{Name: name, Expiration: ExpireTimeOrTTL{ExpireTime: exp}}
+	}
+	ccs := []*CachedContent{
+		cc("none1", time.Time{}),
+		cc("c", tm.Add(2*time.Hour)),
+		cc("a", tm),
+		cc("none2", time.Time{}),
+		cc("b", tm.Add(time.Hour)),
+	}
+	sortCachedContentsByExpiration(ccs)
+	var got []string
+	for _, cc := range ccs {
+		got = append(got, cc.Name)
+	}
+	want := []string{"a", "b", "c", "none1", "none2"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
 func testCaching(t *testing.T, client *Client) {
 	ctx := context.Background()
 	const model = "gemini-1.5-flash-001"
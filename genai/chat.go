@@ -15,22 +15,133 @@
 package genai
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
 )
 
 // A ChatSession provides interactive chat.
 type ChatSession struct {
 	m       *GenerativeModel
 	History []*Content
+
+	// If non-nil, the oldest turns of History are summarized before a message
+	// is sent when the history gets close to the model's input token limit.
+	Summarization *SummarizationConfig
+
+	// If true, [ChatSession.CallMethod] remembers the response to each call,
+	// and returns it for later calls of the same function with the same
+	// arguments instead of calling the method again.
+	MemoizeToolResults bool
+
+	// Limits on the automatic function calling of
+	// [ChatSession.SendMessageWithMethods]. Calling stops once a message has
+	// taken MaxToolRounds requests to the model; if it is zero, the limit is 10.
+	// If MaxToolTokens is positive, calling also stops once the requests have
+	// used that many tokens in total, as reported by the service. If
+	// MaxToolDuration is positive, calling also stops once that much time has
+	// passed since the message was sent.
+	MaxToolRounds   int
+	MaxToolTokens   int32
+	MaxToolDuration time.Duration
+
+	toolResults map[string]*FunctionResponse // by toolResultKey
 }
 
+// SummarizationConfig controls how a [ChatSession] summarizes its History.
+//
+// Before each message is sent, the session computes the number of tokens
+// remaining before the history reaches the model's input token limit. If that
+// is less than MinRemainingTokens, the model is asked to summarize all but the
+// most recent turns of the history, and those turns are replaced by the summary.
+// The summary is added to the start of the first remaining user turn.
+type SummarizationConfig struct {
+	// Summarize when fewer than this many tokens remain.
+	MinRemainingTokens int32
+
+	// The number of most recent contents to keep as they are.
+	// If zero, the last two (normally a user turn and the model's response) are kept.
+	// The kept contents always start with a user turn, so more may be kept.
+	KeepRecent int
+
+	// The prompt that asks the model for the summary. It follows the turns being
+	// summarized. If empty, a default prompt is used.
+	Prompt string
+
+	// If non-zero, the maximum time to spend summarizing.
+	Timeout time.Duration
+}
+
+const defaultSummarizationPrompt = "Summarize the conversation so far, " +
+	"keeping all the facts, names, decisions and open questions needed to continue it."
+
 // StartChat starts a chat session.
 func (m *GenerativeModel) StartChat() *ChatSession {
 	return &ChatSession{m: m}
 }
 
+// A Message is a turn of a conversation in the form used by many other
+// SDKs: a role, like "system", "user" or "assistant", and the text of the
+// turn. Use [ContentsFromMessages] to import a conversation in this form.
+type Message struct {
+	Role string
+	Text string
+}
+
+// ContentsFromMessages converts a conversation imported from another SDK to
+// the contents of a [ChatSession] History. The role "assistant" becomes
+// "model"; the roles "user" and "model" are kept. Roles are not case-sensitive.
+//
+// The Gemini API has no "system" role for the turns of a conversation.
+// Instead, the text of the leading messages with that role is returned as
+// systemInstruction, one part per message, to be used as the model's
+// SystemInstruction:
+//
+//	si, history, err := genai.ContentsFromMessages(msgs)
+//	...
+//	model.SystemInstruction = si
+//	cs := model.StartChat()
+//	cs.History = history
+//
+// systemInstruction is nil if there are no leading system messages. It is an
+// error for a system message to follow a message with another role, or for
+// a message to have any other role.
+func ContentsFromMessages(msgs []Message) (systemInstruction *Content, history []*Content, err error) {
+	i := 0
+	for ; i < len(msgs) && strings.EqualFold(msgs[i].Role, "system"); i++ {
+		if systemInstruction == nil {
+			systemInstruction = &Content{}
+		}
+		systemInstruction.Parts = append(systemInstruction.Parts, Text(msgs[i].Text))
+	}
+	for ; i < len(msgs); i++ {
+		var role string
+		switch strings.ToLower(msgs[i].Role) {
+		case roleUser:
+			role = roleUser
+		case roleModel, "assistant":
+			role = roleModel
+		case "system":
+			return nil, nil, fmt.Errorf("genai.ContentsFromMessages: message %d: a system message must precede all others", i)
+		default:
+			return nil, nil, fmt.Errorf("genai.ContentsFromMessages: message %d: unknown role %q", i, msgs[i].Role)
+		}
+		history = append(history, &Content{Role: role, Parts: []Part{Text(msgs[i].Text)}})
+	}
+	return systemInstruction, history, nil
+}
+
 // SendMessage sends a request to the model as part of a chat session.
 func (cs *ChatSession) SendMessage(ctx context.Context, parts ...Part) (*GenerateContentResponse, error) {
+	if err := cs.maybeSummarize(ctx); err != nil {
+		return nil, err
+	}
 	// Call the underlying client with the entire history plus the argument Content.
 	cs.History = append(cs.History, NewUserContent(parts...))
 	req, err := cs.m.newGenerateContentRequest(cs.History...)
@@ -46,31 +157,243 @@ func (cs *ChatSession) SendMessage(ctx context.Context, parts ...Part) (*Generat
 	return resp, nil
 }
 
+// SendMessageWithConfig is like SendMessage, but the fields of cfg that are
+// set override those of the model's GenerationConfig for this message only;
+// cfg may be nil. Use it to vary the configuration of a single turn without
+// changing the model, which may be shared. For example, to ask for JSON:
+//
+//	resp, err := cs.SendMessageWithConfig(ctx, &genai.GenerationConfig{
+//		ResponseMIMEType: "application/json",
+//		ResponseSchema:   schema,
+//	}, genai.Text("List the colors we discussed."))
+//
+// The CandidateCount of cfg is ignored, since only one candidate can be
+// added to the History. Like SendMessage, SendMessageWithConfig streams the
+// response internally, so the model's BlankTextRetries and the client's
+// response cache do not apply.
+func (cs *ChatSession) SendMessageWithConfig(ctx context.Context, cfg *GenerationConfig, parts ...Part) (*GenerateContentResponse, error) {
+	if err := cs.maybeSummarize(ctx); err != nil {
+		return nil, err
+	}
+	m := *cs.m
+	if cfg != nil {
+		m.GenerationConfig = mergeGenerationConfig(m.GenerationConfig, *cfg)
+	}
+	cs.History = append(cs.History, NewUserContent(parts...))
+	req, err := m.newGenerateContentRequest(cs.History...)
+	if err != nil {
+		return nil, err
+	}
+	req.GenerationConfig.CandidateCount = Ptr[int32](1)
+	resp, err := m.generateContent(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	cs.addToHistory(resp.Candidates)
+	return resp, nil
+}
+
+// SendMessageSelect is like SendMessage, but for a model whose CandidateCount
+// is greater than one. It calls choose with the candidates of the response,
+// and adds the content of the candidate at the index that choose returns to
+// the History as the model's turn. It returns an error if the model's
+// CandidateCount is not greater than one, or if the index is out of range.
+// If it returns an error, the History is unchanged.
+func (cs *ChatSession) SendMessageSelect(ctx context.Context, choose func([]*Candidate) int, parts ...Part) (*GenerateContentResponse, error) {
+	if n := cs.m.CandidateCount; n == nil || *n <= 1 {
+		return nil, errors.New("genai.ChatSession.SendMessageSelect: the model's CandidateCount must be greater than one")
+	}
+	if err := cs.maybeSummarize(ctx); err != nil {
+		return nil, err
+	}
+	n := len(cs.History)
+	resp, err := cs.sendMessageSelect(ctx, choose, parts)
+	if err != nil {
+		cs.History = cs.History[:n]
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (cs *ChatSession) sendMessageSelect(ctx context.Context, choose func([]*Candidate) int, parts []Part) (*GenerateContentResponse, error) {
+	cs.History = append(cs.History, NewUserContent(parts...))
+	req, err := cs.m.newGenerateContentRequest(cs.History...)
+	if err != nil {
+		return nil, err
+	}
+	// Use a unary call, which returns all the candidates together.
+	resp, err := cs.m.generateContentUnary(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	i := choose(resp.Candidates)
+	if i < 0 || i >= len(resp.Candidates) {
+		return nil, fmt.Errorf("genai.ChatSession.SendMessageSelect: chosen index %d out of range for %d candidates", i, len(resp.Candidates))
+	}
+	cs.addToHistory(resp.Candidates[i : i+1])
+	return resp, nil
+}
+
 // SendMessageStream is like SendMessage, but with a streaming request.
 func (cs *ChatSession) SendMessageStream(ctx context.Context, parts ...Part) *GenerateContentResponseIterator {
+	if err := cs.maybeSummarize(ctx); err != nil {
+		return &GenerateContentResponseIterator{err: err}
+	}
 	cs.History = append(cs.History, NewUserContent(parts...))
 	req, err := cs.m.newGenerateContentRequest(cs.History...)
 	if err != nil {
 		return &GenerateContentResponseIterator{err: err}
 	}
 	req.GenerationConfig.CandidateCount = Ptr[int32](1)
-	streamClient, err := cs.m.c.gc.StreamGenerateContent(ctx, req)
-	return &GenerateContentResponseIterator{
-		sc:  streamClient,
-		err: err,
-		cs:  cs,
+	iter := cs.m.streamGenerateContent(ctx, req)
+	iter.cs = cs
+	return iter
+}
+
+// Regenerate asks the model for a new response to the last user turn of the
+// History, replacing the model's most recent response. The fields of cfg that
+// are set override those of the model's GenerationConfig for this request
+// only; cfg may be nil. For example, to get a more varied response:
+//
+//	resp, err := cs.Regenerate(ctx, &genai.GenerationConfig{Temperature: genai.Ptr[float32](1.5)})
+//
+// The user turn is not sent again as a new message. It is an error if the
+// History has no user turn. If the request fails, the History is unchanged.
+func (cs *ChatSession) Regenerate(ctx context.Context, cfg *GenerationConfig) (*GenerateContentResponse, error) {
+	// Remove the model turns that follow the last user turn.
+	n := len(cs.History)
+	for n > 0 && cs.History[n-1].Role != roleUser {
+		n--
+	}
+	if n == 0 {
+		return nil, errors.New("genai.ChatSession.Regenerate: no user turn in History")
+	}
+	m := *cs.m
+	if cfg != nil {
+		m.GenerationConfig = mergeGenerationConfig(m.GenerationConfig, *cfg)
+	}
+	req, err := m.newGenerateContentRequest(cs.History[:n]...)
+	if err != nil {
+		return nil, err
+	}
+	req.GenerationConfig.CandidateCount = Ptr[int32](1)
+	resp, err := m.generateContentUnary(ctx, req)
+	if err != nil {
+		return nil, err
 	}
+	cs.History = cs.History[:n]
+	cs.addToHistory(resp.Candidates)
+	return resp, nil
+}
+
+// mergeGenerationConfig returns a copy of base with the fields that are set
+// (non-zero) in override replaced.
+func mergeGenerationConfig(base, override GenerationConfig) GenerationConfig {
+	vb, vo := reflect.ValueOf(&base).Elem(), reflect.ValueOf(override)
+	for i := 0; i < vo.NumField(); i++ {
+		if vo.Type().Field(i).IsExported() && !vo.Field(i).IsZero() {
+			vb.Field(i).Set(vo.Field(i))
+		}
+	}
+	return base
+}
+
+// RemainingTokens returns the number of tokens that can be added to the session
+// before its History reaches the model's input token limit.
+// The count of tokens in the history includes the model's SystemInstruction and Tools.
+// The result is negative if the history already exceeds the limit.
+func (cs *ChatSession) RemainingTokens(ctx context.Context) (int32, error) {
+	info, err := cs.m.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(cs.History) == 0 {
+		return info.InputTokenLimit, nil
+	}
+	res, err := cs.m.CountTokensForContents(ctx, cs.History...)
+	if err != nil {
+		return 0, err
+	}
+	return info.InputTokenLimit - res.TotalTokens, nil
+}
+
+// maybeSummarize summarizes the oldest turns of the history, if
+// summarization is configured and the history is too large.
+func (cs *ChatSession) maybeSummarize(ctx context.Context) error {
+	sc := cs.Summarization
+	if sc == nil || len(cs.History) == 0 {
+		return nil
+	}
+	if sc.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sc.Timeout)
+		defer cancel()
+	}
+	remaining, err := cs.RemainingTokens(ctx)
+	if err != nil {
+		return fmt.Errorf("genai: summarizing chat history: %w", err)
+	}
+	if remaining >= sc.MinRemainingTokens {
+		return nil
+	}
+	keep := sc.KeepRecent
+	if keep <= 0 {
+		keep = 2
+	}
+	// Find the start of the kept contents, which must be a user turn.
+	i := len(cs.History) - keep
+	for i > 0 && i < len(cs.History) && cs.History[i].Role == roleModel {
+		i++
+	}
+	if i <= 0 || i >= len(cs.History) {
+		// Nothing to summarize, or nothing to attach the summary to.
+		return nil
+	}
+	prompt := sc.Prompt
+	if prompt == "" {
+		prompt = defaultSummarizationPrompt
+	}
+	contents := append(cs.History[:i:i], NewUserContent(Text(prompt)))
+	req, err := cs.m.newGenerateContentRequest(contents...)
+	if err != nil {
+		return err
+	}
+	req.GenerationConfig.CandidateCount = Ptr[int32](1)
+	resp, err := cs.m.generateContentUnary(ctx, req)
+	if err != nil {
+		return fmt.Errorf("genai: summarizing chat history: %w", err)
+	}
+	var summary strings.Builder
+	if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil {
+		for _, p := range resp.Candidates[0].Content.Parts {
+			if t, ok := p.(Text); ok {
+				summary.WriteString(string(t))
+			}
+		}
+	}
+	first := cs.History[i]
+	note := Text("Summary of the earlier conversation:\n" + summary.String())
+	newFirst := &Content{Role: first.Role, Parts: append([]Part{note}, first.Parts...)}
+	cs.History = append([]*Content{newFirst}, cs.History[i+1:]...)
+	return nil
 }
 
 // By default, use the first candidate for history. The user can modify that if they want.
 func (cs *ChatSession) addToHistory(cands []*Candidate) bool {
 	if len(cands) > 0 {
-		c := cands[0].Content
-		if c == nil {
+		// The service rejects contents without parts, so don't add one.
+		if !cands[0].HasContent() {
 			return false
 		}
+		c := cands[0].Content
 		c.Role = roleModel
-		cs.History = append(cs.History, copySanitizedModelContent(c))
+		// Sanitizing can remove all the parts, as when the model responds
+		// only with empty text.
+		sc := copySanitizedModelContent(c)
+		if len(sc.Parts) == 0 {
+			return false
+		}
+		cs.History = append(cs.History, sc)
 		return true
 	}
 	return false
@@ -87,3 +410,84 @@ func copySanitizedModelContent(c *Content) *Content {
 	}
 	return newc
 }
+
+// ExportMarkdown writes the session's History to w as a Markdown document.
+// Each turn starts with a heading naming its role. Text is written as is,
+// code and its results are written as code blocks, and files are written as
+// links (images as embedded images). Inline data is summarized, not included.
+func (cs *ChatSession) ExportMarkdown(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for i, c := range cs.History {
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintf(bw, "### %s\n", roleHeading(c.Role))
+		for _, p := range c.Parts {
+			fmt.Fprintln(bw)
+			writePartMarkdown(bw, p)
+		}
+	}
+	return bw.Flush()
+}
+
+func roleHeading(role string) string {
+	switch role {
+	case "", roleUser:
+		return "User"
+	case roleModel:
+		return "Model"
+	default:
+		return strings.ToUpper(role[:1]) + role[1:]
+	}
+}
+
+func writePartMarkdown(w io.Writer, p Part) {
+	codeBlock := func(lang, s string) {
+		fmt.Fprintf(w, "```%s\n%s", lang, s)
+		if !strings.HasSuffix(s, "\n") {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, "```")
+	}
+	jsonBlock := func(v any) {
+		bytes, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			bytes = []byte(fmt.Sprint(v))
+		}
+		codeBlock("json", string(bytes))
+	}
+
+	switch p := p.(type) {
+	case Text:
+		fmt.Fprintln(w, string(p))
+	case Blob:
+		fmt.Fprintf(w, "*[%s data, %d bytes]*\n", p.MIMEType, len(p.Data))
+	case FileData:
+		if strings.HasPrefix(p.MIMEType, "image/") {
+			fmt.Fprintf(w, "![image](%s)\n", p.URI)
+		} else {
+			fmt.Fprintf(w, "[file](%s)\n", p.URI)
+		}
+	case FunctionCall:
+		fmt.Fprintf(w, "Function call `%s`:\n", p.Name)
+		jsonBlock(p.Args)
+	case FunctionResponse:
+		fmt.Fprintf(w, "Function response `%s`:\n", p.Name)
+		jsonBlock(p.Response)
+	case ExecutableCode:
+		writePartMarkdown(w, &p)
+	case *ExecutableCode:
+		lang := ""
+		if p.Language == ExecutableCodePython {
+			lang = "python"
+		}
+		codeBlock(lang, p.Code)
+	case CodeExecutionResult:
+		writePartMarkdown(w, &p)
+	case *CodeExecutionResult:
+		fmt.Fprintf(w, "Output (%s):\n", p.Outcome)
+		codeBlock("", p.Output)
+	default:
+		fmt.Fprintf(w, "*[%T]*\n", p)
+	}
+}
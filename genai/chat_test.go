@@ -0,0 +1,556 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/iterator"
+)
+
+func TestExportMarkdown(t *testing.T) {
+	cs := &ChatSession{
+		History: []*Content{
+			NewUserContent(
+				Text("What is in this picture?"),
+				FileData{MIMEType: "image/jpeg", URI: "https://example.com/cat.jpg"},
+				ImageData("png", []byte("1234"))),
+			{Role: roleModel, Parts: []Part{Text("A cat.")}},
+			NewUserContent(Text("Compute 2+2.")),
+			{Role: roleModel, Parts: []Part{
+				&ExecutableCode{Language: ExecutableCodePython, Code: "print(2+2)"},
+				&CodeExecutionResult{Outcome: CodeExecutionResultOutcomeOK, Output: "4\n"},
+				FunctionCall{Name: "record", Args: map[string]any{"n": 4}},
+			}},
+			{Role: "function", Parts: []Part{FunctionResponse{Name: "record", Response: map[string]any{"ok": true}}}},
+		},
+	}
+	var sb strings.Builder
+	if err := cs.ExportMarkdown(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := "### User\n" +
+		"\n" +
+		"What is in this picture?\n" +
+		"\n" +
+		"![image](https://example.com/cat.jpg)\n" +
+		"\n" +
+		"*[image/png data, 4 bytes]*\n" +
+		"\n" +
+		"### Model\n" +
+		"\n" +
+		"A cat.\n" +
+		"\n" +
+		"### User\n" +
+		"\n" +
+		"Compute 2+2.\n" +
+		"\n" +
+		"### Model\n" +
+		"\n" +
+		"```python\n" +
+		"print(2+2)\n" +
+		"```\n" +
+		"\n" +
+		"Output (CodeExecutionResultOutcomeOK):\n" +
+		"```\n" +
+		"4\n" +
+		"```\n" +
+		"\n" +
+		"Function call `record`:\n" +
+		"```json\n" +
+		"{\n" +
+		"  \"n\": 4\n" +
+		"}\n" +
+		"```\n" +
+		"\n" +
+		"### Function\n" +
+		"\n" +
+		"Function response `record`:\n" +
+		"```json\n" +
+		"{\n" +
+		"  \"ok\": true\n" +
+		"}\n" +
+		"```\n"
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestRemainingTokens(t *testing.T) {
+	var counted int
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v1beta/models/m":
+			fmt.Fprint(w, `{"name": "models/m", "inputTokenLimit": 1000}`)
+		case r.URL.Path == "/v1beta/models/m:countTokens":
+			counted++
+			fmt.Fprint(w, `{"totalTokens": 42}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ctx := context.Background()
+	cs := client.GenerativeModel("m").StartChat()
+
+	got, err := cs.RemainingTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1000 || counted != 0 {
+		t.Errorf("empty history: got %d with %d counts, want 1000 with 0", got, counted)
+	}
+
+	cs.History = []*Content{
+		NewUserContent(Text("hello")),
+		{Role: roleModel, Parts: []Part{Text("hi")}},
+	}
+	got, err = cs.RemainingTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int32(1000 - 42); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestSummarization(t *testing.T) {
+	var summaryRequests []string
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1beta/models/m":
+			fmt.Fprint(w, `{"name": "models/m", "inputTokenLimit": 100}`)
+		case "/v1beta/models/m:countTokens":
+			fmt.Fprint(w, `{"totalTokens": 95}`)
+		case "/v1beta/models/m:generateContent":
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			summaryRequests = append(summaryRequests, string(body))
+			writeJSONResponse(w, "SUMMARY")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ctx := context.Background()
+	cs := client.GenerativeModel("m").StartChat()
+	history := []*Content{
+		NewUserContent(Text("u1")),
+		{Role: roleModel, Parts: []Part{Text("m1")}},
+		NewUserContent(Text("u2")),
+		{Role: roleModel, Parts: []Part{Text("m2")}},
+	}
+	cs.History = history
+	cs.Summarization = &SummarizationConfig{
+		MinRemainingTokens: 5,
+		Prompt:             "PLEASE SUMMARIZE",
+	}
+
+	// Enough tokens remain.
+	if err := cs.maybeSummarize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaryRequests) != 0 || len(cs.History) != len(history) {
+		t.Fatal("summarized too soon")
+	}
+
+	cs.Summarization.MinRemainingTokens = 10
+	if err := cs.maybeSummarize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaryRequests) != 1 {
+		t.Fatalf("got %d summary requests, want 1", len(summaryRequests))
+	}
+	// The summary request holds the old turns and the prompt, but not the kept ones.
+	if b := summaryRequests[0]; !strings.Contains(b, "m1") || !strings.Contains(b, "PLEASE SUMMARIZE") || strings.Contains(b, "u2") {
+		t.Errorf("bad summary request: %s", b)
+	}
+	want := []*Content{
+		NewUserContent(Text("Summary of the earlier conversation:\nSUMMARY"), Text("u2")),
+		{Role: roleModel, Parts: []Part{Text("m2")}},
+	}
+	if diff := cmp.Diff(want, cs.History); diff != "" {
+		t.Errorf("history mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	type request struct {
+		Contents []struct {
+			Role  string
+			Parts []struct{ Text string }
+		}
+		GenerationConfig struct {
+			Temperature    *float32
+			TopK           *int32
+			CandidateCount *int32
+		}
+	}
+	var got request
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = request{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path != "/v1beta/models/m:generateContent" {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, "m1 again")
+	}))
+	model := client.GenerativeModel("m")
+	model.SetTemperature(0.1)
+	model.SetTopK(5)
+	cs := model.StartChat()
+	cs.History = []*Content{
+		NewUserContent(Text("u1")),
+		{Role: roleModel, Parts: []Part{Text("m1")}},
+	}
+	ctx := context.Background()
+	resp, err := cs.Regenerate(ctx, &GenerationConfig{Temperature: Ptr[float32](1.5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := responseString(resp), "m1 again"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Only the user turn was sent, with the overridden temperature.
+	if len(got.Contents) != 1 || got.Contents[0].Role != roleUser || got.Contents[0].Parts[0].Text != "u1" {
+		t.Errorf("got contents %+v, want the user turn", got.Contents)
+	}
+	gc := got.GenerationConfig
+	if gc.Temperature == nil || *gc.Temperature != 1.5 || gc.TopK == nil || *gc.TopK != 5 || gc.CandidateCount == nil || *gc.CandidateCount != 1 {
+		t.Errorf("got generation config %+v", gc)
+	}
+	if *model.Temperature != 0.1 {
+		t.Errorf("model's temperature changed to %g", *model.Temperature)
+	}
+	want := []*Content{
+		NewUserContent(Text("u1")),
+		{Role: roleModel, Parts: []Part{Text("m1 again")}},
+	}
+	if diff := cmp.Diff(want, cs.History); diff != "" {
+		t.Errorf("history mismatch (-want, +got):\n%s", diff)
+	}
+
+	// On failure, the history is unchanged.
+	cs.m = client.GenerativeModel("other")
+	if _, err := cs.Regenerate(ctx, nil); err == nil {
+		t.Fatal("got nil, want error")
+	}
+	if diff := cmp.Diff(want, cs.History); diff != "" {
+		t.Errorf("after failure: history mismatch (-want, +got):\n%s", diff)
+	}
+
+	cs.History = nil
+	if _, err := cs.Regenerate(ctx, nil); err == nil {
+		t.Error("empty history: got nil, want error")
+	}
+}
+
+func TestSendMessageSelect(t *testing.T) {
+	var gotCount int32
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			GenerationConfig struct{ CandidateCount int32 }
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gotCount = req.GenerationConfig.CandidateCount
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"candidates": [`+
+			`{"index": 0, "content": {"role": "model", "parts": [{"text": "short"}]}},`+
+			`{"index": 1, "content": {"role": "model", "parts": [{"text": "the longest"}]}},`+
+			`{"index": 2, "content": {"role": "model", "parts": [{"text": "longer"}]}}]}`)
+	}))
+	model := client.GenerativeModel("m")
+	model.SetCandidateCount(3)
+	cs := model.StartChat()
+	longest := func(cands []*Candidate) int {
+		best := 0
+		for i, c := range cands {
+			if len(c.Content.Parts[0].(Text)) > len(cands[best].Content.Parts[0].(Text)) {
+				best = i
+			}
+		}
+		return best
+	}
+	ctx := context.Background()
+	resp, err := cs.SendMessageSelect(ctx, longest, Text("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Candidates) != 3 {
+		t.Errorf("got %d candidates, want 3", len(resp.Candidates))
+	}
+	if gotCount != 3 {
+		t.Errorf("sent candidate count %d, want 3", gotCount)
+	}
+	want := []*Content{
+		NewUserContent(Text("hi")),
+		{Role: roleModel, Parts: []Part{Text("the longest")}},
+	}
+	if diff := cmp.Diff(want, cs.History); diff != "" {
+		t.Errorf("history mismatch (-want, +got):\n%s", diff)
+	}
+
+	// On failure, the History is unchanged.
+	if _, err := cs.SendMessageSelect(ctx, func([]*Candidate) int { return 3 }, Text("again")); err == nil {
+		t.Error("out of range: got nil, want error")
+	}
+	if diff := cmp.Diff(want, cs.History); diff != "" {
+		t.Errorf("history after failure mismatch (-want, +got):\n%s", diff)
+	}
+
+	// A model that asks for one candidate offers no choice.
+	model.SetCandidateCount(1)
+	if _, err := cs.SendMessageSelect(ctx, longest, Text("again")); err == nil {
+		t.Error("one candidate: got nil, want error")
+	}
+	if diff := cmp.Diff(want, cs.History); diff != "" {
+		t.Errorf("history after one candidate mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestChatFunctionCallHistory(t *testing.T) {
+	type turn struct {
+		Role  string
+		Parts []map[string]any
+	}
+	var gotContents []turn
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Contents []turn }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gotContents = req.Contents
+		writeJSONResponse(w, "It is sunny.")
+	}))
+	ctx := context.Background()
+	// SendMessageSelect, used below, makes a unary call that the fake server
+	// can answer, but requires a CandidateCount greater than one.
+	model := client.GenerativeModel("m")
+	model.SetCandidateCount(2)
+	cs := model.StartChat()
+	cs.History = append(cs.History, NewUserContent(Text("What's the weather in Paris?")))
+
+	// The model streams an empty text, then a function call. The fake stream
+	// stands in for the response to SendMessage, which streams internally.
+	fc := FunctionCall{Name: "weather", Args: map[string]any{"city": "Paris"}}
+	iter := &GenerateContentResponseIterator{
+		sc: &fakeStreamClient{
+			responses: []*pb.GenerateContentResponse{
+				{Candidates: []*pb.Candidate{{Content: &pb.Content{Role: "model", Parts: []*pb.Part{Text("").toPart()}}}}},
+				{Candidates: []*pb.Candidate{{Content: &pb.Content{Role: "model", Parts: []*pb.Part{fc.toPart()}}}}},
+			},
+			err: io.EOF,
+		},
+		cs: cs,
+	}
+	for {
+		_, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The model's turn with the function call is in the history before the
+	// function response is sent, without the empty text.
+	want := []*Content{
+		{Role: "user", Parts: []Part{Text("What's the weather in Paris?")}},
+		{Role: "model", Parts: []Part{fc}},
+	}
+	if diff := cmp.Diff(want, cs.History); diff != "" {
+		t.Fatalf("history mismatch (-want, +got):\n%s", diff)
+	}
+
+	first := func([]*Candidate) int { return 0 }
+	fr := FunctionResponse{Name: "weather", Response: map[string]any{"sky": "sunny"}}
+	if _, err := cs.SendMessageSelect(ctx, first, fr); err != nil {
+		t.Fatal(err)
+	}
+	// The request holds the whole exchange, in order.
+	var roles, kinds []string
+	for _, tn := range gotContents {
+		roles = append(roles, tn.Role)
+		for k := range tn.Parts[0] {
+			kinds = append(kinds, k)
+		}
+	}
+	if diff := cmp.Diff([]string{"user", "model", "user"}, roles); diff != "" {
+		t.Errorf("roles mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"text", "functionCall", "functionResponse"}, kinds); diff != "" {
+		t.Errorf("part kinds mismatch (-want, +got):\n%s", diff)
+	}
+	if len(cs.History) != 4 {
+		t.Errorf("got %d turns in history, want 4", len(cs.History))
+	}
+}
+
+func TestAddToHistoryOnlyEmptyText(t *testing.T) {
+	cs := &ChatSession{}
+	added := cs.addToHistory([]*Candidate{{Content: &Content{Parts: []Part{Text(""), Text("")}}}})
+	if added || len(cs.History) != 0 {
+		t.Errorf("added %v, history %v; want nothing added", added, cs.History)
+	}
+}
+
+// configServer records the generation config of each streamed request.
+type configServer struct {
+	pb.UnimplementedGenerativeServiceServer
+	configs []*pb.GenerationConfig
+}
+
+func (s *configServer) StreamGenerateContent(req *pb.GenerateContentRequest, stream pb.GenerativeService_StreamGenerateContentServer) error {
+	s.configs = append(s.configs, req.GenerationConfig)
+	return stream.Send(&pb.GenerateContentResponse{
+		Candidates: []*pb.Candidate{{Content: &pb.Content{
+			Role:  roleModel,
+			Parts: []*pb.Part{Text(fmt.Sprintf("reply %d", len(req.Contents))).toPart()},
+		}}},
+	})
+}
+
+func TestSendMessageWithConfig(t *testing.T) {
+	srv := &configServer{}
+	client := newFakeClient(t, http.NotFoundHandler())
+	useGRPCServer(t, client, srv)
+	ctx := context.Background()
+	model := client.GenerativeModel("m")
+	model.SetTemperature(0.5)
+	model.SetMaxOutputTokens(100)
+	cs := model.StartChat()
+
+	cfg := &GenerationConfig{
+		ResponseMIMEType: "application/json",
+		ResponseSchema:   Array(String()).Build(),
+		MaxOutputTokens:  Ptr[int32](10),
+		CandidateCount:   Ptr[int32](3),
+	}
+	if _, err := cs.SendMessageWithConfig(ctx, cfg, Text("colors as JSON")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.SendMessageWithConfig(ctx, nil, Text("thanks")); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.configs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(srv.configs))
+	}
+	// The first request has the overrides, merged with the model's config.
+	first := srv.configs[0]
+	if first.GetTemperature() != 0.5 || first.GetMaxOutputTokens() != 10 || first.ResponseMimeType != "application/json" ||
+		first.ResponseSchema.GetType() != pb.Type_ARRAY || first.GetCandidateCount() != 1 {
+		t.Errorf("first request: got %v", first)
+	}
+	// The second request, and the model, are unaffected.
+	second := srv.configs[1]
+	if second.GetMaxOutputTokens() != 100 || second.ResponseMimeType != "" || second.ResponseSchema != nil {
+		t.Errorf("second request: got %v", second)
+	}
+	if *model.MaxOutputTokens != 100 || model.ResponseMIMEType != "" {
+		t.Errorf("model was modified: %+v", model.GenerationConfig)
+	}
+	if len(cs.History) != 4 {
+		t.Errorf("got %d turns in history, want 4", len(cs.History))
+	}
+}
+
+func TestMergeGenerationConfigAllFields(t *testing.T) {
+	// Set every field of the override, so that a field added to
+	// GenerationConfig later is also checked.
+	var override GenerationConfig
+	v := reflect.ValueOf(&override).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Pointer:
+			f.Set(reflect.New(f.Type().Elem()))
+		case reflect.Slice:
+			f.Set(reflect.MakeSlice(f.Type(), 1, 1))
+		case reflect.Map:
+			f.Set(reflect.MakeMap(f.Type()))
+		case reflect.String:
+			f.SetString("x")
+		default:
+			t.Fatalf("field %s: unhandled kind %s", v.Type().Field(i).Name, f.Kind())
+		}
+	}
+	base := GenerationConfig{Temperature: Ptr[float32](1)}
+	got := mergeGenerationConfig(base, override)
+	if !cmp.Equal(got, override) {
+		t.Errorf("got %+v, want %+v", got, override)
+	}
+}
+
+func TestContentsFromMessages(t *testing.T) {
+	si, history, err := ContentsFromMessages([]Message{
+		{Role: "system", Text: "You are terse."},
+		{Role: "System", Text: "Answer in French."},
+		{Role: "user", Text: "Hello"},
+		{Role: "assistant", Text: "Bonjour"},
+		{Role: "USER", Text: "Thanks"},
+		{Role: "model", Text: "De rien"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSI := &Content{Parts: []Part{Text("You are terse."), Text("Answer in French.")}}
+	if !cmp.Equal(si, wantSI) {
+		t.Errorf("got system instruction %v, want %v", si, wantSI)
+	}
+	wantHistory := []*Content{
+		{Role: "user", Parts: []Part{Text("Hello")}},
+		{Role: "model", Parts: []Part{Text("Bonjour")}},
+		{Role: "user", Parts: []Part{Text("Thanks")}},
+		{Role: "model", Parts: []Part{Text("De rien")}},
+	}
+	if !cmp.Equal(history, wantHistory) {
+		t.Errorf("got history %v, want %v", history, wantHistory)
+	}
+
+	si, history, err = ContentsFromMessages([]Message{{Role: "user", Text: "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si != nil || len(history) != 1 {
+		t.Errorf("got %v, %v; want no system instruction and one content", si, history)
+	}
+
+	for _, msgs := range [][]Message{
+		{{Role: "user", Text: "hi"}, {Role: "system", Text: "late"}},
+		{{Role: "tool", Text: "{}"}},
+	} {
+		if _, _, err := ContentsFromMessages(msgs); err == nil {
+			t.Errorf("%v: got nil, want error", msgs)
+		}
+	}
+}
@@ -22,20 +22,31 @@
 package genai
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	gl "cloud.google.com/go/ai/generativelanguage/apiv1beta"
 	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
 	"github.com/google/generative-ai-go/genai/internal"
 	gld "github.com/google/generative-ai-go/genai/internal/generativelanguage/v1beta" // discovery client
 
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
 )
 
 // A Client is a Google generative AI client.
@@ -45,6 +56,24 @@ type Client struct {
 	fc *gl.FileClient
 	cc *gl.CacheClient
 	ds *gld.Service
+	hc *http.Client // used by ds, for resuming uploads
+	rl *rateLimiter
+	ic idempotencyCache
+
+	quotaProject string // from WithQuotaProject
+
+	requestBodyInErrors       bool   // from WithRequestBodyInErrors
+	inlineDataInRequestBodies bool   // from WithInlineDataInRequestBodies
+	apiKey                    string // for redacting request bodies
+
+	fileMIMETypes mimeTypeCache
+
+	transformContents func([]*Content) []*Content // from WithContentTransformer
+
+	responses *responseCache // from WithResponseCache; nil if there is none
+
+	metrics Recorder     // from WithMetrics; nil if there is none
+	tracer  trace.Tracer // from WithTracerProvider; nil if there is none
 }
 
 // NewClient creates a new Google generative AI client.
@@ -63,6 +92,20 @@ then pass it as an option:
 (If you're doing that already, then maybe the environment variable is empty or unset.)
 Import the option package as "google.golang.org/api/option".`)
 	}
+	if t, ok := optionOfType[*tlsConfig](opts); ok {
+		var err error
+		opts, err = applyTLSConfig(opts, t.cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if w, ok := optionOfType[*warningHandler](opts); ok {
+		var err error
+		opts, err = applyWarningHandler(ctx, opts, w.f)
+		if err != nil {
+			return nil, err
+		}
+	}
 	gc, err := gl.NewGenerativeRESTClient(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("creating generative client: %w", err)
@@ -78,12 +121,15 @@ Import the option package as "google.golang.org/api/option".`)
 
 	// Workaround for https://github.com/google/generative-ai-go/issues/151
 	optsForCache := removeHTTPClientOption(opts)
+	if t, ok := optionOfType[*tlsConfig](opts); ok {
+		optsForCache = append(optsForCache, grpcTLSOption(t.cfg))
+	}
 	cc, err := gl.NewCacheClient(ctx, optsForCache...)
 	if err != nil {
 		return nil, fmt.Errorf("creating cache client: %w", err)
 	}
 
-	ds, err := gld.NewService(ctx, opts...)
+	ds, hc, err := newDiscoveryService(ctx, opts)
 	if err != nil {
 		return nil, fmt.Errorf("creating discovery client: %w", err)
 	}
@@ -96,7 +142,35 @@ Import the option package as "google.golang.org/api/option".`)
 	mc.SetGoogleClientInfo(kvs...)
 	fc.SetGoogleClientInfo(kvs...)
 
-	return &Client{gc, mc, fc, cc, ds}, nil
+	var rl *rateLimiter
+	if r, ok := optionOfType[*rateLimit](opts); ok {
+		rl = newRateLimiter(r.rpm, r.tpm)
+	}
+
+	c := &Client{gc: gc, mc: mc, fc: fc, cc: cc, ds: ds, hc: hc, rl: rl}
+	if q, ok := optionOfType[*quotaProject](opts); ok {
+		c.quotaProject = q.id
+	}
+	if _, ok := optionOfType[*requestBodyInErrors](opts); ok {
+		c.requestBodyInErrors = true
+		c.apiKey = apiKeyFromOptions(opts)
+	}
+	if _, ok := optionOfType[*inlineDataInRequestBodies](opts); ok {
+		c.inlineDataInRequestBodies = true
+	}
+	if t, ok := optionOfType[*contentTransformer](opts); ok {
+		c.transformContents = t.f
+	}
+	if r, ok := optionOfType[*responseCacheOption](opts); ok {
+		c.responses = newResponseCache(r.size, r.ttl)
+	}
+	if r, ok := optionOfType[*metricsOption](opts); ok {
+		c.metrics = r.r
+	}
+	if r, ok := optionOfType[*tracerProviderOption](opts); ok {
+		c.tracer = r.tp.Tracer(tracerName)
+	}
+	return c, nil
 }
 
 // hasAuthOption reports whether an authentication-related option was provided.
@@ -122,6 +196,18 @@ func hasAuthOption(opts []option.ClientOption) bool {
 	return false
 }
 
+// apiKeyFromOptions returns the API key passed with option.WithAPIKey, or
+// the empty string if there is none.
+func apiKeyFromOptions(opts []option.ClientOption) string {
+	for _, opt := range opts {
+		v := reflect.ValueOf(opt)
+		if v.Type().String() == "option.withAPIKey" {
+			return v.String()
+		}
+	}
+	return ""
+}
+
 // removeHTTPClientOption removes option.withHTTPClient from the given list
 // of options, if it exists; it returns the new (filtered) list.
 func removeHTTPClientOption(opts []option.ClientOption) []option.ClientOption {
@@ -146,17 +232,34 @@ func (c *Client) Close() error {
 type GenerativeModel struct {
 	c        *Client
 	fullName string
+	info     *infoCache // shared by copies of the model, which have the same name
 
 	GenerationConfig
 	SafetySettings []*SafetySetting
 	Tools          []*Tool
-	ToolConfig     *ToolConfig // configuration for tools
+	// ToolConfig configures the use of Tools. It is sent with every request,
+	// streaming or not, including those of a ChatSession.
+	ToolConfig *ToolConfig
 	// SystemInstruction (also known as "system prompt") is a more forceful prompt to the model.
 	// The model will adhere the instructions more strongly than if they appeared in a normal prompt.
 	SystemInstruction *Content
+	// ToolInstructions holds guidance for the model about individual functions,
+	// keyed by the name of a FunctionDeclaration in Tools. When a request is
+	// sent, the guidance for each function in Tools is added to the end of the
+	// SystemInstruction as a separate Text part, in the order in which the
+	// functions appear in Tools. Guidance for functions that are not in Tools
+	// is not sent.
+	ToolInstructions map[string]string
 	// The name of the CachedContent to use.
 	// Must have already been created with [Client.CreateCachedContent].
 	CachedContentName string
+	// BlankTextRetries is the number of times a non-streaming request is
+	// re-sent when every candidate of its response is blank: the candidate
+	// finished normally, but its only parts are Text parts that consist
+	// entirely of whitespace. If the response is still blank after the last
+	// retry, it is returned as is. The default of zero disables retrying.
+	// Streaming calls are never retried.
+	BlankTextRetries int
 }
 
 // GenerativeModel creates a new instance of the named generative model.
@@ -167,9 +270,121 @@ func (c *Client) GenerativeModel(name string) *GenerativeModel {
 	return &GenerativeModel{
 		c:        c,
 		fullName: fullModelName(name),
+		info:     &infoCache{},
 	}
 }
 
+// Name returns the full resource name of the model, as sent in requests:
+// "gemini-1.5-pro" becomes "models/gemini-1.5-pro", while names that already
+// have a collection, like "models/gemini-1.5-pro" or "tunedModels/NAME", are
+// unchanged. Aliases like "gemini-1.5-pro-latest" are resolved by the service,
+// not by Name.
+//
+// Name is in the form that [CachedContent.Model] expects, so use it to create
+// a CachedContent for the model:
+//
+//	cc := &genai.CachedContent{Model: model.Name(), Contents: contents}
+func (m *GenerativeModel) Name() string {
+	return m.fullName
+}
+
+// AppendSystemInstruction adds parts to the end of the model's SystemInstruction,
+// creating it if necessary.
+// The existing SystemInstruction is replaced by a new Content rather than modified,
+// so a Content shared with other models is not affected.
+func (m *GenerativeModel) AppendSystemInstruction(parts ...Part) {
+	si := &Content{}
+	if m.SystemInstruction != nil {
+		si.Role = m.SystemInstruction.Role
+		si.Parts = append(si.Parts, m.SystemInstruction.Parts...)
+	}
+	si.Parts = append(si.Parts, parts...)
+	m.SystemInstruction = si
+}
+
+// harmCategories are the harm categories that apply to Gemini models.
+// The other categories are for older models, and are rejected by Gemini.
+var harmCategories = []HarmCategory{
+	HarmCategoryHarassment,
+	HarmCategoryHateSpeech,
+	HarmCategorySexuallyExplicit,
+	HarmCategoryDangerousContent,
+}
+
+// AllHarmCategories returns every HarmCategory except HarmCategoryUnspecified,
+// in numeric order. It includes the categories for older models, which
+// Gemini models reject; those that apply to Gemini are HarmCategoryHarassment,
+// HarmCategoryHateSpeech, HarmCategorySexuallyExplicit and
+// HarmCategoryDangerousContent.
+func AllHarmCategories() []HarmCategory {
+	return specifiedEnumValues(namesForHarmCategory)
+}
+
+// AllHarmBlockThresholds returns every HarmBlockThreshold except
+// HarmBlockUnspecified, in numeric order.
+func AllHarmBlockThresholds() []HarmBlockThreshold {
+	return specifiedEnumValues(namesForHarmBlockThreshold)
+}
+
+// specifiedEnumValues returns the keys of names, except the zero value,
+// in increasing order.
+func specifiedEnumValues[E ~int32](names map[E]string) []E {
+	var vs []E
+	for v := range names {
+		if v != 0 {
+			vs = append(vs, v)
+		}
+	}
+	slices.Sort(vs)
+	return vs
+}
+
+// DisableSafetyFilters replaces the model's SafetySettings with settings that
+// set the threshold of the harm categories that apply to Gemini models
+// (HarmCategoryHarassment, HarmCategoryHateSpeech,
+// HarmCategorySexuallyExplicit and HarmCategoryDangerousContent) to
+// HarmBlockNone. The categories for older models are not included, since
+// Gemini models reject them.
+//
+// WARNING: with these settings, the model will return content regardless of
+// how likely it is to be harmful. Use them only when your application
+// handles harmful content itself, as in evaluation or red-teaming tools.
+func (m *GenerativeModel) DisableSafetyFilters() {
+	m.SafetySettings = make([]*SafetySetting, len(harmCategories))
+	for i, hc := range harmCategories {
+		m.SafetySettings[i] = &SafetySetting{Category: hc, Threshold: HarmBlockNone}
+	}
+}
+
+// systemInstruction returns the SystemInstruction to send, with the
+// ToolInstructions for the functions in Tools added.
+func (m *GenerativeModel) systemInstruction() *Content {
+	var parts []Part
+	for _, t := range m.Tools {
+		if t == nil {
+			continue
+		}
+		for _, fd := range t.FunctionDeclarations {
+			if fd == nil {
+				continue
+			}
+			if ins, ok := m.ToolInstructions[fd.Name]; ok {
+				parts = append(parts, Text(fmt.Sprintf("Instructions for the function %s: %s", fd.Name, ins)))
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return m.SystemInstruction
+	}
+	si := &Content{}
+	if m.SystemInstruction != nil {
+		si.Role = m.SystemInstruction.Role
+		si.Parts = append(si.Parts, m.SystemInstruction.Parts...)
+	}
+	si.Parts = append(si.Parts, parts...)
+	return si
+}
+
 func fullModelName(name string) string {
 	if strings.ContainsRune(name, '/') {
 		return name
@@ -178,37 +393,203 @@ func fullModelName(name string) string {
 }
 
 // GenerateContent produces a single request and response.
+// A candidate of the response may have no content, or content with no parts;
+// check [Candidate.HasContent] before indexing its parts.
+// When the model's CandidateCount is more than one, the candidates of the
+// response are sorted by [Candidate.Index].
+// The parts are sent in the order given; see [NewUserContent].
 func (m *GenerativeModel) GenerateContent(ctx context.Context, parts ...Part) (*GenerateContentResponse, error) {
 	content := NewUserContent(parts...)
 	req, err := m.newGenerateContentRequest(content)
 	if err != nil {
 		return nil, err
 	}
-	res, err := m.c.gc.GenerateContent(ctx, req)
+	return m.generateContentUnary(ctx, req)
+}
+
+// GenerateContentWithSafety is like GenerateContent, but sends settings
+// instead of the model's SafetySettings for this call only. The model is not
+// changed, so it is safe to use a model shared with other goroutines. The
+// settings replace the model's entirely; categories that do not appear in
+// them get the service's default thresholds.
+func (m *GenerativeModel) GenerateContentWithSafety(ctx context.Context, settings []*SafetySetting, parts ...Part) (*GenerateContentResponse, error) {
+	m2 := *m
+	m2.SafetySettings = settings
+	return m2.GenerateContent(ctx, parts...)
+}
+
+// generateContentUnary makes a non-streaming call.
+// If the response is blank, the call is repeated up to m.BlankTextRetries times.
+// If the client has a response cache, the response may come from it.
+func (m *GenerativeModel) generateContentUnary(ctx context.Context, req *pb.GenerateContentRequest) (*GenerateContentResponse, error) {
+	var key string
+	if m.c.responses != nil && cacheable(req) {
+		// A request that cannot be encoded will fail below.
+		key, _ = requestKey(req)
+		if resp := m.c.responses.get(key); resp != nil {
+			return resp, nil
+		}
+	}
+	for retries := 0; ; retries++ {
+		resp, err := m.generateContentOnce(ctx, req)
+		if err != nil || retries >= m.BlankTextRetries || !isBlankTextResponse(resp) {
+			if err == nil && key != "" {
+				m.c.responses.put(key, resp)
+			}
+			return resp, err
+		}
+	}
+}
+
+// isBlankTextResponse reports whether resp has candidates and all of them
+// finished normally with only whitespace text.
+func isBlankTextResponse(resp *GenerateContentResponse) bool {
+	if len(resp.Candidates) == 0 {
+		return false
+	}
+	for _, c := range resp.Candidates {
+		if c.FinishReason != FinishReasonStop && c.FinishReason != FinishReasonUnspecified {
+			return false
+		}
+		text, calls, other := c.Split()
+		if strings.TrimSpace(text) != "" || len(calls) > 0 || len(other) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *GenerativeModel) generateContentOnce(ctx context.Context, req *pb.GenerateContentRequest) (*GenerateContentResponse, error) {
+	if err := m.c.fillFileDataMIMETypes(ctx, req.Contents); err != nil {
+		return nil, err
+	}
+	if err := m.c.rl.wait(ctx, 1); err != nil {
+		return nil, err
+	}
+	ctx, span := m.c.startSpan(ctx, "GenerateContent", attrModel.String(req.Model))
+	start := time.Now()
+	res, err := m.c.gc.GenerateContent(m.c.callContext(ctx), req)
+	m.c.recordCall(ctx, "GenerateContent", req.Model, start, usageMetadataFromProto(res), err)
+	endSpan(span, usageMetadataFromProto(res), finishReasonFromProto(res), err)
+	if err != nil {
+		return nil, addRequestID(ctx, m.c.addRequestBody(wrapSchemaError(wrapError(err), req), req))
+	}
+	m.c.rl.record(usageMetadataFromProto(res))
+	resp, err := protoToResponse(res)
 	if err != nil {
 		return nil, err
 	}
-	return protoToResponse(res)
+	// The service does not promise to return candidates in order.
+	slices.SortStableFunc(resp.Candidates, func(a, b *Candidate) int {
+		return cmp.Compare(a.Index, b.Index)
+	})
+	return resp, nil
+}
+
+// GenerateContentRaw sends req, a request built directly from the protocol
+// buffer types of the underlying API, and returns the response in the form
+// returned by [GenerativeModel.GenerateContent]. Use it to set fields of the
+// request that this package does not yet support.
+//
+// None of the fields of m are used, except to set the Model field of req if
+// it is empty; in particular, blank responses are not retried as they are for
+// BlankTextRetries. Nor is the client's response cache used. Other options of
+// the client, like rate limiting, metrics and tracing, apply as usual.
+// req is not modified.
+//
+// GenerateContentRaw is for advanced use. The protocol buffer types come from
+// the [cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb]
+// package, which is generated from the API definition and can change in
+// incompatible ways when the API does. Fields that appear there before this
+// package supports them may also be experimental in the service itself.
+func (m *GenerativeModel) GenerateContentRaw(ctx context.Context, req *pb.GenerateContentRequest) (*GenerateContentResponse, error) {
+	if req == nil {
+		return nil, errors.New("genai.GenerateContentRaw: nil request")
+	}
+	if req.Model == "" {
+		req = proto.Clone(req).(*pb.GenerateContentRequest)
+		req.Model = m.fullName
+	}
+	return m.generateContentOnce(ctx, req)
 }
 
 // GenerateContentStream returns an iterator that enumerates responses.
 func (m *GenerativeModel) GenerateContentStream(ctx context.Context, parts ...Part) *GenerateContentResponseIterator {
-	iter := &GenerateContentResponseIterator{}
 	req, err := m.newGenerateContentRequest(NewUserContent(parts...))
 	if err != nil {
-		iter.err = err
-	} else {
-		iter.sc, iter.err = m.c.gc.StreamGenerateContent(ctx, req)
+		return &GenerateContentResponseIterator{err: err}
+	}
+	return m.streamGenerateContent(ctx, req)
+}
+
+// GenerateContentStreamTo makes a streaming request and writes the text of
+// the first candidate of each response to w as it arrives. It returns when
+// the stream ends, with the first error from the service or from w.
+//
+// If the model stopped for a reason other than [FinishReasonStop], such as
+// reaching the MaxOutputTokens limit, the text written so far is incomplete
+// and GenerateContentStreamTo returns an error that names the reason. A
+// blocked response results in a [*BlockedError]. Use
+// [GenerativeModel.GenerateContentStream] for more control.
+func (m *GenerativeModel) GenerateContentStreamTo(ctx context.Context, w io.Writer, parts ...Part) error {
+	return writeStreamText(w, m.GenerateContentStream(ctx, parts...))
+}
+
+// writeStreamText writes the text of the first candidate of each response
+// from iter to w.
+func writeStreamText(w io.Writer, iter *GenerateContentResponseIterator) error {
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(resp.Candidates) == 0 || resp.Candidates[0] == nil {
+			continue
+		}
+		text, _, _ := resp.Candidates[0].Split()
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+	}
+	if fr := iter.FinishReason(); fr != FinishReasonStop && fr != FinishReasonUnspecified {
+		return fmt.Errorf("genai: generation stopped early: %s", fr)
+	}
+	return nil
+}
+
+// streamGenerateContent starts a streaming call, after waiting for the rate limiter,
+// and returns an iterator over its responses.
+func (m *GenerativeModel) streamGenerateContent(ctx context.Context, req *pb.GenerateContentRequest) *GenerateContentResponseIterator {
+	if err := m.c.fillFileDataMIMETypes(ctx, req.Contents); err != nil {
+		return &GenerateContentResponseIterator{err: err}
+	}
+	if err := m.c.rl.wait(ctx, 1); err != nil {
+		return &GenerateContentResponseIterator{err: err}
+	}
+	iter := &GenerateContentResponseIterator{rl: m.c.rl, now: time.Now, requestID: requestIDFromContext(ctx)}
+	ctx, span := m.c.startSpan(ctx, "StreamGenerateContent", attrModel.String(req.Model))
+	iter.timing.Start = iter.now()
+	sc, err := m.c.gc.StreamGenerateContent(m.c.callContext(ctx), req)
+	iter.sc, iter.err = sc, addRequestID(ctx, m.c.addRequestBody(wrapSchemaError(wrapError(err), req), req))
+	if m.c.metrics != nil || span != nil {
+		start := iter.timing.Start
+		iter.recordEnd = func(usage *UsageMetadata, err error) {
+			m.c.recordCall(ctx, "StreamGenerateContent", req.Model, start, usage, err)
+			endSpan(span, usage, iter.FinishReason(), err)
+		}
+		if iter.err != nil {
+			iter.recordEnd(nil, err)
+			iter.recordEnd = nil
+		}
 	}
 	return iter
 }
 
 func (m *GenerativeModel) generateContent(ctx context.Context, req *pb.GenerateContentRequest) (*GenerateContentResponse, error) {
-	streamClient, err := m.c.gc.StreamGenerateContent(ctx, req)
-	iter := &GenerateContentResponseIterator{
-		sc:  streamClient,
-		err: err,
-	}
+	iter := m.streamGenerateContent(ctx, req)
 	for {
 		_, err := iter.Next()
 		if err == iterator.Done {
@@ -221,7 +602,10 @@ func (m *GenerativeModel) generateContent(ctx context.Context, req *pb.GenerateC
 }
 
 func (m *GenerativeModel) newGenerateContentRequest(contents ...*Content) (*pb.GenerateContentRequest, error) {
-	return pvCatchPanic(func() *pb.GenerateContentRequest {
+	if m.c != nil && m.c.transformContents != nil {
+		contents = m.c.transformContents(slices.Clone(contents))
+	}
+	req, err := pvCatchPanic(func() *pb.GenerateContentRequest {
 		var cc *string
 		if m.CachedContentName != "" {
 			cc = &m.CachedContentName
@@ -233,20 +617,97 @@ func (m *GenerativeModel) newGenerateContentRequest(contents ...*Content) (*pb.G
 			Tools:             transformSlice(m.Tools, (*Tool).toProto),
 			ToolConfig:        m.ToolConfig.toProto(),
 			GenerationConfig:  m.GenerationConfig.toProto(),
-			SystemInstruction: m.SystemInstruction.toProto(),
+			SystemInstruction: m.systemInstruction().toProto(),
 			CachedContent:     cc,
 		}
-		debugPrint(req)
 		return req
 	})
+	if err != nil {
+		return nil, err
+	}
+	var mimeTypes *mimeTypeCache
+	if m.c != nil {
+		mimeTypes = &m.c.fileMIMETypes
+	}
+	mimeTypes.fillFileDataMIMETypes(req.Contents)
+	debugPrint(req)
+	return req, nil
 }
 
 // GenerateContentResponseIterator is an iterator over GnerateContentResponse.
+//
+// Text is streamed in pieces, but the service does not stream the arguments of
+// a function call: each [FunctionCall] part in a response returned by Next is
+// complete, and can be executed as soon as it is seen.
+//
+// The service checks the safety of a response as it is generated, so a
+// candidate can be blocked after some of its text has been streamed. Next
+// then returns a [*BlockedError] whose StreamedContent holds the text that was
+// already returned, which an application that displayed it may want to
+// retract. The stream ends there, and a ChatSession's History does not
+// include the response.
 type GenerateContentResponseIterator struct {
 	sc     pb.GenerativeService_StreamGenerateContentClient
 	err    error
 	merged *GenerateContentResponse
 	cs     *ChatSession
+	rl     *rateLimiter
+	usage  *UsageMetadata // from the most recent response
+	raw    bool           // from RawChunks
+	done   bool           // the stream ended successfully
+	timing StreamTiming
+	now    func() time.Time // nil if timing is not recorded
+
+	estimatedOutput int // estimated output tokens so far, for OutputTokens
+
+	requestID string // from WithRequestID
+
+	// If non-nil, called once when the stream ends or fails, for WithMetrics
+	// and WithTracerProvider.
+	recordEnd func(usage *UsageMetadata, err error)
+}
+
+// reportEnd reports the end of the stream, with the error that ended it,
+// if the client has a Recorder or a tracer.
+func (iter *GenerateContentResponseIterator) reportEnd(err error) {
+	if iter.recordEnd == nil {
+		return
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	iter.recordEnd(iter.usage, err)
+	iter.recordEnd = nil
+}
+
+// streamedContent returns a copy of the content of the candidate with the
+// given index that earlier responses returned, or nil if there is none.
+func (iter *GenerateContentResponseIterator) streamedContent(index int32) *Content {
+	if iter.merged == nil {
+		return nil
+	}
+	for _, c := range iter.merged.Candidates {
+		if c.Index == index && c.HasContent() {
+			return &Content{Role: c.Content.Role, Parts: slices.Clone(c.Content.Parts)}
+		}
+	}
+	return nil
+}
+
+// RawChunks makes Next return each streamed response exactly as the server
+// sent it. By default, the first response returned by Next is also used to
+// accumulate the merged response, so its text grows as later responses arrive.
+// With RawChunks, responses are never modified after they are returned, so
+// chunk boundaries are preserved; [GenerateContentResponseIterator.MergedResponse]
+// and chat history are unaffected.
+//
+// Call RawChunks before the first call to Next. It returns iter, so it can be
+// chained:
+//
+//	iter := model.GenerateContentStream(ctx, genai.Text("...")).RawChunks()
+func (iter *GenerateContentResponseIterator) RawChunks() *GenerateContentResponseIterator {
+	iter.raw = true
+	return iter
 }
 
 // Next returns the next response.
@@ -255,27 +716,107 @@ func (iter *GenerateContentResponseIterator) Next() (*GenerateContentResponse, e
 		return nil, iter.err
 	}
 	resp, err := iter.sc.Recv()
+	if err != io.EOF {
+		err = wrapError(err)
+		if err != nil && iter.requestID != "" {
+			err = &requestIDError{err: err, id: iter.requestID}
+		}
+	}
 	iter.err = err
+	if err != nil {
+		iter.reportEnd(err)
+	}
 	if err == io.EOF {
 		if iter.cs != nil && iter.merged != nil {
 			iter.cs.addToHistory(iter.merged.Candidates)
 		}
+		// Each streamed response reports the usage so far, so the last one has the total.
+		iter.rl.record(iter.usage)
+		iter.done = true
+		if iter.now != nil {
+			iter.timing.End = iter.now()
+		}
 		return nil, iterator.Done
 	}
 	if err != nil {
 		return nil, err
 	}
+	if iter.now != nil && iter.timing.FirstResponse.IsZero() {
+		iter.timing.FirstResponse = iter.now()
+	}
+	if um := usageMetadataFromProto(resp); um != nil {
+		iter.usage = um
+	}
 	gcp, err := protoToResponse(resp)
 	if err != nil {
+		var berr *BlockedError
+		if errors.As(err, &berr) && berr.Candidate != nil {
+			berr.StreamedContent = iter.streamedContent(berr.Candidate.Index)
+		}
 		iter.err = err
+		iter.reportEnd(err)
 		return nil, err
 	}
+	iter.estimatedOutput += estimateResponseTokens(gcp)
 	// Merge this response in with the ones we've already seen.
-	iter.merged = joinResponses(iter.merged, gcp)
+	if iter.raw {
+		iter.merged = joinResponses(iter.merged, copyResponse(gcp))
+	} else {
+		iter.merged = joinResponses(iter.merged, gcp)
+	}
 	// If this is part of a ChatSession, remember the response for the history.
 	return gcp, nil
 }
 
+// Done reports whether the stream has ended successfully, that is, whether
+// Next has returned iterator.Done. It does not call the service, so it returns
+// false after the last response until Next is called again. It returns false
+// if Next has returned any other error.
+// Do not call Done concurrently with Next.
+func (iter *GenerateContentResponseIterator) Done() bool {
+	return iter.done
+}
+
+// StreamTiming records the progress of a streaming call over time,
+// for measuring latency.
+type StreamTiming struct {
+	// When the request was sent, after any wait for the rate limiter
+	// configured by [WithRateLimit].
+	Start time.Time
+	// When the first response was received, or the zero time if none has been.
+	FirstResponse time.Time
+	// When the stream ended successfully, or the zero time if it has not.
+	End time.Time
+}
+
+// TimeToFirstResponse returns the time between sending the request and
+// receiving the first response, the "time to first token", or zero if no
+// response has been received.
+func (t StreamTiming) TimeToFirstResponse() time.Duration {
+	if t.FirstResponse.IsZero() {
+		return 0
+	}
+	return t.FirstResponse.Sub(t.Start)
+}
+
+// Duration returns the time between sending the request and the end of the
+// stream, or zero if the stream has not ended successfully.
+func (t StreamTiming) Duration() time.Duration {
+	if t.End.IsZero() {
+		return 0
+	}
+	return t.End.Sub(t.Start)
+}
+
+// Timing returns the timing of the streaming call so far. The times are
+// recorded by Next, so FirstResponse is set by the first call to Next that
+// returns a response and End by the call that returns iterator.Done.
+// If the call could not be started, all the times are zero.
+// Do not call Timing concurrently with Next.
+func (iter *GenerateContentResponseIterator) Timing() StreamTiming {
+	return iter.timing
+}
+
 func protoToResponse(resp *pb.GenerateContentResponse) (*GenerateContentResponse, error) {
 	gcp, err := fromProto[GenerateContentResponse](resp)
 	if err != nil {
@@ -300,26 +841,139 @@ func protoToResponse(resp *pb.GenerateContentResponse) (*GenerateContentResponse
 	return gcp, nil
 }
 
+// usageMetadataFromProto returns the usage metadata of resp, or nil if there is none.
+func usageMetadataFromProto(resp *pb.GenerateContentResponse) *UsageMetadata {
+	if resp == nil || resp.UsageMetadata == nil {
+		return nil
+	}
+	return (UsageMetadata{}).fromProto(resp.UsageMetadata)
+}
+
+// finishReasonFromProto returns the finish reason of the first candidate of resp,
+// or FinishReasonUnspecified if there is none.
+func finishReasonFromProto(resp *pb.GenerateContentResponse) FinishReason {
+	if resp == nil || len(resp.Candidates) == 0 {
+		return FinishReasonUnspecified
+	}
+	return FinishReason(resp.Candidates[0].FinishReason)
+}
+
 // MergedResponse returns the result of combining all the streamed responses seen so far.
 // After iteration completes, the merged response should match the response obtained without streaming
 // (that is, if [GenerativeModel.GenerateContent] were called).
+//
+// Candidates are merged by [Candidate.Index]. Only the candidates that appear in the
+// first streamed response are included; to follow other candidates, examine the
+// Index of each candidate of the responses returned by Next.
 func (iter *GenerateContentResponseIterator) MergedResponse() *GenerateContentResponse {
 	return iter.merged
 }
 
+// FinishReason returns the reason that the model stopped generating the first
+// candidate, such as FinishReasonMaxTokens when the response was truncated.
+// The service reports it in the last streamed response, so it is final once
+// Next has returned iterator.Done. It returns FinishReasonUnspecified if no
+// response has reported a reason. A response blocked for safety is reported
+// as a [*BlockedError] by Next instead, and is not reflected here.
+func (iter *GenerateContentResponseIterator) FinishReason() FinishReason {
+	if iter.merged == nil || len(iter.merged.Candidates) == 0 {
+		return FinishReasonUnspecified
+	}
+	return iter.merged.Candidates[0].FinishReason
+}
+
+// OutputTokens returns the number of tokens that the model has generated so
+// far in the stream, for all candidates. Until the stream ends, the count is
+// an estimate computed locally with [EstimateTokens] from the text of the
+// responses returned by Next, so it can be shown while the response is being
+// generated. Once Next has returned iterator.Done, the count is reconciled
+// with the final [UsageMetadata]: OutputTokens returns its
+// CandidatesTokenCount, if the service reported one.
+// Do not call OutputTokens concurrently with Next.
+func (iter *GenerateContentResponseIterator) OutputTokens() int {
+	if iter.done && iter.usage != nil && iter.usage.CandidatesTokenCount > 0 {
+		return int(iter.usage.CandidatesTokenCount)
+	}
+	return iter.estimatedOutput
+}
+
+// estimateResponseTokens returns an estimate of the number of tokens in the
+// text of the candidates of resp.
+func estimateResponseTokens(resp *GenerateContentResponse) int {
+	n := 0
+	for _, c := range resp.Candidates {
+		if c.Content == nil {
+			continue
+		}
+		for _, p := range c.Content.Parts {
+			if t, ok := p.(Text); ok {
+				n += EstimateTokens(string(t))
+			}
+		}
+	}
+	return n
+}
+
 // CountTokens counts the number of tokens in the content.
+// See [GenerativeModel.CountTokensForContents] for the errors it returns.
 func (m *GenerativeModel) CountTokens(ctx context.Context, parts ...Part) (*CountTokensResponse, error) {
-	req, err := m.newCountTokensRequest(NewUserContent(parts...))
+	return m.CountTokensForContents(ctx, NewUserContent(parts...))
+}
+
+// CountTokensForContents counts the number of tokens in a sequence of contents,
+// such as a conversation with both user and model turns.
+// Unlike [GenerativeModel.CountTokens], the contents are sent as is; their roles
+// are not changed.
+//
+// If the call fails because a [FileData] part refers to a file that is still
+// being processed, the error is a [*FileNotActiveError]. Otherwise, if the
+// service rejects the request, the error is a [*CountTokensError].
+func (m *GenerativeModel) CountTokensForContents(ctx context.Context, contents ...*Content) (*CountTokensResponse, error) {
+	req, err := m.newCountTokensRequest(contents...)
 	if err != nil {
 		return nil, err
 	}
-	res, err := m.c.gc.CountTokens(ctx, req)
-	if err != nil {
+	if err := m.c.fillFileDataMIMETypes(ctx, req.GenerateContentRequest.Contents); err != nil {
 		return nil, err
 	}
+	ctx, span := m.c.startSpan(ctx, "CountTokens", attrModel.String(req.Model))
+	start := time.Now()
+	res, err := m.c.gc.CountTokens(m.c.callContext(ctx), req)
+	m.c.recordCall(ctx, "CountTokens", req.Model, start, nil, err)
+	if span != nil && err == nil {
+		span.SetAttributes(attrInputTokens.Int(int(res.TotalTokens)))
+	}
+	endSpan(span, nil, FinishReasonUnspecified, err)
+	if err != nil {
+		err = wrapError(err)
+		if ferr := m.c.checkFilesActive(ctx, contents, err); ferr != err {
+			return nil, addRequestID(ctx, m.c.addRequestBody(ferr, req))
+		}
+		return nil, addRequestID(ctx, m.c.addRequestBody(newCountTokensError(err, contents), req))
+	}
 	return fromProto[CountTokensResponse](res)
 }
 
+// EstimateTokens returns a rough estimate of the number of tokens in text,
+// computed locally without calling the service. It is intended for quick
+// checks, like discarding inputs that are obviously too long, before calling
+// [GenerativeModel.CountTokens] for an exact count.
+//
+// The estimate counts one token for every four ASCII characters, rounded up,
+// and one token for every other character. For English text it is usually
+// within 25% of the actual count; for other languages it is less accurate.
+func EstimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
 func (m *GenerativeModel) newCountTokensRequest(contents ...*Content) (*pb.CountTokensRequest, error) {
 	gcr, err := m.newGenerateContentRequest(contents...)
 	if err != nil {
@@ -333,17 +987,246 @@ func (m *GenerativeModel) newCountTokensRequest(contents ...*Content) (*pb.Count
 	return req, nil
 }
 
+// RequestKey returns a key that identifies the request that
+// [GenerativeModel.GenerateContent] would send for parts, for use in an
+// application-level cache of responses. The key is a hash of the model name,
+// configuration, safety settings, tools, system instruction and contents.
+// Identical inputs produce identical keys, regardless of the order in which
+// the properties of a [Schema] were added.
+//
+// Keys are stable for a given version of this package, but may change
+// when it is upgraded, so a persistent cache should be invalidated then.
+func (m *GenerativeModel) RequestKey(parts ...Part) (string, error) {
+	req, err := m.newGenerateContentRequest(NewUserContent(parts...))
+	if err != nil {
+		return "", err
+	}
+	return requestKey(req)
+}
+
+// requestKey returns the hash of the deterministic encoding of req.
+func requestKey(req *pb.GenerateContentRequest) (string, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// TestResponseSchema checks that the service accepts the model's ResponseSchema.
+// It sends a short prompt asking for an example response, with the schema set and
+// the response MIME type set to "application/json" if it is empty.
+// It returns any error from the service, or nil if the schema was accepted.
+// The model is not modified.
+func (m *GenerativeModel) TestResponseSchema(ctx context.Context) error {
+	if m.ResponseSchema == nil {
+		return errors.New("genai.TestResponseSchema: ResponseSchema is not set")
+	}
+	m2 := *m
+	if m2.ResponseMIMEType == "" {
+		m2.ResponseMIMEType = "application/json"
+	}
+	// The content of the response doesn't matter, so keep it short.
+	m2.MaxOutputTokens = Ptr[int32](64)
+	_, err := m2.GenerateContent(ctx, Text("Give an example of a response that matches the schema."))
+	return err
+}
+
 // Info returns information about the model.
+// The information is fetched from the service on the first call, and the
+// same ModelInfo is returned by later calls, since it rarely changes; do not
+// modify it. Use [GenerativeModel.RefreshInfo] to fetch it again.
 func (m *GenerativeModel) Info(ctx context.Context) (*ModelInfo, error) {
-	return m.c.modelInfo(ctx, m.fullName)
+	return m.fetchInfo(ctx, false)
+}
+
+// RefreshInfo is like [GenerativeModel.Info], but always fetches the
+// information from the service, replacing the cached ModelInfo.
+func (m *GenerativeModel) RefreshInfo(ctx context.Context) (*ModelInfo, error) {
+	return m.fetchInfo(ctx, true)
+}
+
+func (m *GenerativeModel) fetchInfo(ctx context.Context, refresh bool) (*ModelInfo, error) {
+	if m.info == nil {
+		// The model was not created by a Client method.
+		return m.c.modelInfo(ctx, m.fullName)
+	}
+	m.info.mu.Lock()
+	defer m.info.mu.Unlock()
+	if m.info.info == nil || refresh {
+		info, err := m.c.modelInfo(ctx, m.fullName)
+		if err != nil {
+			return nil, err
+		}
+		m.info.info = info
+	}
+	return m.info.info, nil
+}
+
+// An infoCache holds the ModelInfo of a GenerativeModel.
+type infoCache struct {
+	mu   sync.Mutex
+	info *ModelInfo
+}
+
+// A ModelComparison holds the token count of a prompt for one model,
+// along with the model's limits. See [Client.CompareModels].
+type ModelComparison struct {
+	// The name of the model, as passed to CompareModels.
+	Model string
+	// The number of tokens in the prompt, according to the model.
+	TotalTokens int32
+	// The maximum number of input tokens allowed by the model.
+	InputTokenLimit int32
+	// The maximum number of output tokens the model can produce.
+	OutputTokenLimit int32
+}
+
+// Fits reports whether the prompt is within the model's input token limit.
+func (mc ModelComparison) Fits() bool {
+	return mc.TotalTokens <= mc.InputTokenLimit
+}
+
+// CompareModels counts the tokens in a prompt for each of the given models,
+// and returns the counts alongside the models' limits, in the order of models.
+// Use it to compare the cost of a prompt across models before choosing one.
+//
+// It makes two calls to the service for each model, one to count tokens and
+// one to get the model's limits. It fails if any call fails.
+func (c *Client) CompareModels(ctx context.Context, models []string, parts ...Part) ([]ModelComparison, error) {
+	var comps []ModelComparison
+	for _, name := range models {
+		m := c.GenerativeModel(name)
+		ct, err := m.CountTokens(ctx, parts...)
+		if err != nil {
+			return nil, fmt.Errorf("genai.CompareModels: %s: %w", name, err)
+		}
+		info, err := m.Info(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("genai.CompareModels: %s: %w", name, err)
+		}
+		comps = append(comps, ModelComparison{
+			Model:            name,
+			TotalTokens:      ct.TotalTokens,
+			InputTokenLimit:  info.InputTokenLimit,
+			OutputTokenLimit: info.OutputTokenLimit,
+		})
+	}
+	return comps, nil
+}
+
+// supportedMIMETypes are the MIME types documented as supported for inputs to
+// Gemini models, at https://ai.google.dev/gemini-api/docs/prompting_with_media.
+var supportedMIMETypes = map[string]bool{
+	// Images.
+	"image/png": true, "image/jpeg": true, "image/webp": true, "image/heic": true, "image/heif": true,
+	// Audio.
+	"audio/wav": true, "audio/mp3": true, "audio/aiff": true, "audio/aac": true, "audio/ogg": true, "audio/flac": true,
+	// Video.
+	"video/mp4": true, "video/mpeg": true, "video/mov": true, "video/avi": true, "video/x-flv": true,
+	"video/mpg": true, "video/webm": true, "video/wmv": true, "video/3gpp": true,
+	// Documents.
+	"application/pdf": true,
+	// Text.
+	"text/plain": true, "text/html": true, "text/css": true, "text/javascript": true,
+	"application/x-javascript": true, "text/x-typescript": true, "application/x-typescript": true,
+	"text/csv": true, "text/markdown": true, "text/x-python": true, "application/x-python-code": true,
+	"application/json": true, "text/xml": true, "application/rtf": true, "text/rtf": true,
+}
+
+// SupportsMIME reports whether mimeType is one of the MIME types that Gemini
+// models accept as input, either inline or as an uploaded file. Parameters,
+// such as "; charset=utf-8", are ignored. Call it before uploading a file to
+// avoid uploading one that can't be used.
+//
+// The service does not report the MIME types that a model supports, so
+// SupportsMIME consults the list of types in the Gemini API documentation.
+// Some models, such as older text-only models, support fewer types.
+func (m *GenerativeModel) SupportsMIME(mimeType string) bool {
+	mt, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	return supportedMIMETypes[mt]
+}
+
+// Documented limits of GenerationConfig fields that the service does not
+// report in ModelInfo.
+const (
+	maxCandidateCount = 8
+	maxStopSequences  = 5
+)
+
+// ValidateConfig checks the model's GenerationConfig against the capabilities
+// that [GenerativeModel.Info] reports, and against documented limits, so that
+// unsupported settings can be found before a request fails. It returns an
+// error listing every problem it finds, or nil if it finds none. It also
+// returns an error if the model does not support generating content, or if
+// the model's information cannot be retrieved.
+//
+// A nil result does not guarantee that the service will accept the
+// configuration: the service does not report every capability of a model,
+// such as whether it supports ResponseSchema.
+func (m *GenerativeModel) ValidateConfig(ctx context.Context) error {
+	info, err := m.Info(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if len(info.SupportedGenerationMethods) > 0 && !slices.Contains(info.SupportedGenerationMethods, "generateContent") {
+		add("model %s does not support generating content", info.Name)
+	}
+	gc := m.GenerationConfig
+	if n := gc.CandidateCount; n != nil && (*n < 1 || *n > maxCandidateCount) {
+		add("CandidateCount %d is not between 1 and %d", *n, maxCandidateCount)
+	}
+	if n := len(gc.StopSequences); n > maxStopSequences {
+		add("%d StopSequences is more than the maximum of %d", n, maxStopSequences)
+	}
+	if n := gc.MaxOutputTokens; n != nil {
+		if *n < 1 {
+			add("MaxOutputTokens %d is less than 1", *n)
+		} else if info.OutputTokenLimit > 0 && *n > info.OutputTokenLimit {
+			add("MaxOutputTokens %d exceeds the model's output token limit of %d", *n, info.OutputTokenLimit)
+		}
+	}
+	if t := gc.Temperature; t != nil {
+		if *t < 0 {
+			add("Temperature %g is negative", *t)
+		} else if info.MaxTemperature != nil && *t > *info.MaxTemperature {
+			add("Temperature %g exceeds the model's maximum of %g", *t, *info.MaxTemperature)
+		}
+	}
+	if p := gc.TopP; p != nil && (*p < 0 || *p > 1) {
+		add("TopP %g is not between 0 and 1", *p)
+	}
+	if k := gc.TopK; k != nil && *k < 0 {
+		add("TopK %d is negative", *k)
+	}
+	switch gc.ResponseMIMEType {
+	case "", "text/plain", "application/json", "text/x.enum":
+	default:
+		add("ResponseMIMEType %q is not one of text/plain, application/json or text/x.enum", gc.ResponseMIMEType)
+	}
+	if gc.ResponseSchema != nil && gc.ResponseMIMEType != "application/json" && gc.ResponseMIMEType != "text/x.enum" {
+		add("ResponseSchema requires a ResponseMIMEType of application/json or text/x.enum")
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("genai.ValidateConfig: unsupported settings for %s:\n%w", m.fullName, errors.Join(errs...))
 }
 
 func (c *Client) modelInfo(ctx context.Context, fullName string) (*ModelInfo, error) {
 	req := &pb.GetModelRequest{Name: fullName}
 	debugPrint(req)
-	res, err := c.mc.GetModel(ctx, req)
+	res, err := c.mc.GetModel(c.callContext(ctx), req)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 	return fromProto[ModelInfo](res)
 }
@@ -355,6 +1238,10 @@ type BlockedError struct {
 	// Consult the FinishReason field for details.
 	Candidate *Candidate
 
+	// For a streaming call, the content of the blocked candidate that earlier
+	// responses of the stream returned, or nil if there was none.
+	StreamedContent *Content
+
 	// If non-nil, there was a problem with the prompt.
 	PromptFeedback *PromptFeedback
 }
@@ -400,6 +1287,10 @@ func joinCandidateLists(dest, src []*Candidate) []*Candidate {
 			// d.FinishMessage = s.FinishMessage
 			d.SafetyRatings = s.SafetyRatings
 			d.CitationMetadata = joinCitationMetadata(d.CitationMetadata, s.CitationMetadata)
+			// The version of the API used by this package does not return log
+			// probabilities (Candidate.logprobs_result). When it does, the
+			// per-token results of each chunk should be appended here, as the
+			// parts are.
 		}
 	}
 	return dest
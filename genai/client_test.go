@@ -15,25 +15,37 @@
 package genai
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	gl "cloud.google.com/go/ai/generativelanguage/apiv1beta"
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
 	"github.com/googleapis/gax-go/v2/apierror"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 const (
@@ -169,6 +181,24 @@ func TestLive(t *testing.T) {
 		got := responseString(resp)
 		checkMatch(t, got, "sounds like")
 	})
+	t.Run("pdf-inline", func(t *testing.T) {
+		vmodel := client.GenerativeModel(modelForVision)
+		vmodel.Temperature = Ptr[float32](0)
+
+		data, err := os.ReadFile(filepath.Join("testdata", "test.pdf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := vmodel.GenerateContent(ctx,
+			Text("Give me a summary of this document:"),
+			PDFData(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := responseString(resp); got == "" {
+			t.Error("got empty response")
+		}
+	})
 
 	t.Run("blocked", func(t *testing.T) {
 		t.Skip("skipping until we find a prompt that is blocked")
@@ -245,6 +275,9 @@ func TestLive(t *testing.T) {
 		if g, w := res.TotalTokens, int32(11); g != w {
 			t.Errorf("got %d, want %d", g, w)
 		}
+		if e := EstimateTokens(string(text)); e < 8 || e > 14 {
+			t.Errorf("EstimateTokens: got %d, want about 11", e)
+		}
 
 		// Should count SystemInstruction tokens too.
 		model2 := client.GenerativeModel(defaultModel)
@@ -258,6 +291,19 @@ func TestLive(t *testing.T) {
 		}
 	})
 
+	t.Run("count-tokens-contents", func(t *testing.T) {
+		res, err := model.CountTokensForContents(ctx,
+			NewUserContent(Text("The rain in Spain falls mainly on the plain.")),
+			&Content{Role: roleModel, Parts: []Part{Text("Is that so?")}},
+			NewUserContent(Text("Yes.")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g, w := res.TotalTokens, int32(11); g <= w {
+			t.Errorf("got %d, want more than %d", g, w)
+		}
+	})
+
 	t.Run("ReadUsageMetadata", func(t *testing.T) {
 		resp, err := model.GenerateContent(ctx, Text("What is the average size of a swallow?"))
 		if err != nil {
@@ -603,6 +649,24 @@ func TestLive(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+	t.Run("test-response-schema", func(t *testing.T) {
+		model := client.GenerativeModel("gemini-1.5-pro-latest")
+		model.ResponseSchema = &Schema{
+			Type:  TypeArray,
+			Items: &Schema{Type: TypeString},
+		}
+		if err := model.TestResponseSchema(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if model.ResponseMIMEType != "" || model.MaxOutputTokens != nil {
+			t.Error("model was modified")
+		}
+
+		model.ResponseSchema = nil
+		if err := model.TestResponseSchema(ctx); err == nil {
+			t.Error("got nil, want error for missing schema")
+		}
+	})
 	t.Run("caching", func(t *testing.T) { testCaching(t, client) })
 	t.Run("code-execution", func(t *testing.T) {
 		model := client.GenerativeModel("gemini-1.5-flash")
@@ -682,6 +746,39 @@ func TestJoinResponses(t *testing.T) {
 	}
 }
 
+func TestJoinResponsesFunctionCalls(t *testing.T) {
+	chunk := func(parts ...Part) *GenerateContentResponse {
+		return &GenerateContentResponse{
+			Candidates: []*Candidate{{Content: &Content{Role: roleModel, Parts: parts}}},
+		}
+	}
+	fc1 := FunctionCall{Name: "lookup", Args: map[string]any{"city": "Paris"}}
+	fc2 := FunctionCall{Name: "convert", Args: map[string]any{"amount": 1.5}}
+	chunks := []*GenerateContentResponse{
+		chunk(Text("Let me ")),
+		chunk(Text("check."), fc1),
+		chunk(fc2),
+	}
+	var merged *GenerateContentResponse
+	var seen []FunctionCall
+	for _, c := range chunks {
+		// Each chunk holds complete function calls.
+		seen = append(seen, c.Candidates[0].FunctionCalls()...)
+		merged = joinResponses(merged, c)
+	}
+	want := []FunctionCall{fc1, fc2}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("calls from chunks: got %+v, want %+v", seen, want)
+	}
+	if got := merged.Candidates[0].FunctionCalls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls from merged response: got %+v, want %+v", got, want)
+	}
+	wantParts := []Part{Text("Let me check."), fc1, fc2}
+	if got := merged.Candidates[0].Content.Parts; !reflect.DeepEqual(got, wantParts) {
+		t.Errorf("merged parts: got %+v, want %+v", got, wantParts)
+	}
+}
+
 func TestMergeTexts(t *testing.T) {
 	for _, test := range []struct {
 		in   []Part
@@ -711,6 +808,267 @@ func TestMergeTexts(t *testing.T) {
 	}
 }
 
+func TestNewCountTokensRequest(t *testing.T) {
+	m := &GenerativeModel{c: &Client{}, fullName: "models/m"}
+	contents := []*Content{
+		NewUserContent(Text("u1")),
+		{Role: roleModel, Parts: []Part{Text("m1")}},
+		NewUserContent(Text("u2")),
+		{Role: roleModel, Parts: []Part{Text("m2")}},
+	}
+	req, err := m.newCountTokensRequest(contents...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := req.Model, m.fullName; g != w {
+		t.Errorf("model: got %q, want %q", g, w)
+	}
+	got := req.GenerateContentRequest.Contents
+	if len(got) != len(contents) {
+		t.Fatalf("got %d contents, want %d", len(got), len(contents))
+	}
+	for i, c := range got {
+		if g, w := c.Role, contents[i].Role; g != w {
+			t.Errorf("#%d: got role %q, want %q", i, g, w)
+		}
+		if g, w := c.Parts[0].GetText(), string(contents[i].Parts[0].(Text)); g != w {
+			t.Errorf("#%d: got text %q, want %q", i, g, w)
+		}
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	newModel := func(propNames ...string) *GenerativeModel {
+		m := &GenerativeModel{c: &Client{}, fullName: "models/m"}
+		m.SetTemperature(0.5)
+		m.ResponseMIMEType = "application/json"
+		m.ResponseSchema = &Schema{Type: TypeObject, Properties: map[string]*Schema{}}
+		for _, n := range propNames {
+			m.ResponseSchema.Properties[n] = &Schema{Type: TypeString}
+		}
+		m.Tools = []*Tool{{FunctionDeclarations: []*FunctionDeclaration{{Name: "f"}}}}
+		return m
+	}
+	key := func(m *GenerativeModel, parts ...Part) string {
+		t.Helper()
+		k, err := m.RequestKey(parts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	props := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	want := key(newModel(props...), Text("hi"))
+	// Identical inputs yield identical keys, even if map iteration order differs.
+	for i := 0; i < 10; i++ {
+		if got := key(newModel(props...), Text("hi")); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+	slices.Reverse(props)
+	if got := key(newModel(props...), Text("hi")); got != want {
+		t.Errorf("reversed properties: got %s, want %s", got, want)
+	}
+
+	// Different inputs yield different keys.
+	m := newModel(props...)
+	m.SetTemperature(0.6)
+	for _, got := range []string{
+		key(newModel(props...), Text("bye")),
+		key(newModel(props[1:]...), Text("hi")),
+		key(m, Text("hi")),
+	} {
+		if got == want {
+			t.Errorf("got same key %s for different inputs", got)
+		}
+	}
+}
+
+func TestSupportsMIME(t *testing.T) {
+	m := &GenerativeModel{fullName: "models/m"}
+	for _, test := range []struct {
+		in   string
+		want bool
+	}{
+		{"image/jpeg", true},
+		{"video/mp4", true},
+		{"application/pdf", true},
+		{"Text/Plain; charset=utf-8", true},
+		{"image/gif", false},
+		{"application/zip", false},
+		{"video", false},
+		{"", false},
+	} {
+		if got := m.SupportsMIME(test.in); got != test.want {
+			t.Errorf("%q: got %t, want %t", test.in, got, test.want)
+		}
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	for _, test := range []struct {
+		text  string
+		exact int // from CountTokens; see TestLive
+	}{
+		{"The rain in Spain falls mainly on the plain.", 11},
+		{"You are a swashbuckling pirate.", 9},
+	} {
+		got := EstimateTokens(test.text)
+		if lo, hi := test.exact*3/4, test.exact*5/4; got < lo || got > hi {
+			t.Errorf("%q: got %d, want between %d and %d", test.text, got, lo, hi)
+		}
+	}
+	for _, test := range []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"a", 1},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"日本語", 3},
+	} {
+		if got := EstimateTokens(test.text); got != test.want {
+			t.Errorf("%q: got %d, want %d", test.text, got, test.want)
+		}
+	}
+}
+
+func TestAppendSystemInstruction(t *testing.T) {
+	m := &GenerativeModel{}
+	m.AppendSystemInstruction(Text("You are a pirate."))
+	want := &Content{Parts: []Part{Text("You are a pirate.")}}
+	if !reflect.DeepEqual(m.SystemInstruction, want) {
+		t.Errorf("got %+v, want %+v", m.SystemInstruction, want)
+	}
+
+	shared := &Content{Role: "system", Parts: []Part{Text("Be brief.")}}
+	m.SystemInstruction = shared
+	m.AppendSystemInstruction(Text("Speak French."), Text("Use no emoji."))
+	want = &Content{Role: "system", Parts: []Part{Text("Be brief."), Text("Speak French."), Text("Use no emoji.")}}
+	if !reflect.DeepEqual(m.SystemInstruction, want) {
+		t.Errorf("got %+v, want %+v", m.SystemInstruction, want)
+	}
+	if len(shared.Parts) != 1 {
+		t.Errorf("shared Content was modified: %+v", shared)
+	}
+}
+
+func TestToolInstructions(t *testing.T) {
+	m := (&Client{}).GenerativeModel("m")
+	m.SystemInstruction = &Content{Parts: []Part{Text("You are a travel agent.")}}
+	m.Tools = []*Tool{
+		{FunctionDeclarations: []*FunctionDeclaration{{Name: "bookFlight"}, {Name: "cancelFlight"}}},
+		{FunctionDeclarations: []*FunctionDeclaration{{Name: "findHotel"}}},
+	}
+	m.ToolInstructions = map[string]string{
+		"findHotel":  "Prefer hotels near the city center.",
+		"bookFlight": "Confirm the dates first.",
+		"rentCar":    "Not installed.",
+	}
+	req, err := m.newGenerateContentRequest(NewUserContent(Text("hi")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fromProto[Content](req.SystemInstruction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Instructions follow the order of Tools, not of the map.
+	want := &Content{Parts: []Part{
+		Text("You are a travel agent."),
+		Text("Instructions for the function bookFlight: Confirm the dates first."),
+		Text("Instructions for the function findHotel: Prefer hotels near the city center."),
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if len(m.SystemInstruction.Parts) != 1 {
+		t.Errorf("SystemInstruction was modified: %+v", m.SystemInstruction)
+	}
+
+	// Without tools, no instructions are sent.
+	m.Tools = nil
+	m.SystemInstruction = nil
+	req, err = m.newGenerateContentRequest(NewUserContent(Text("hi")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.SystemInstruction != nil {
+		t.Errorf("got %v, want no system instruction", req.SystemInstruction)
+	}
+}
+
+func TestDisableSafetyFilters(t *testing.T) {
+	m := &GenerativeModel{
+		SafetySettings: []*SafetySetting{{Category: HarmCategoryHarassment, Threshold: HarmBlockLowAndAbove}},
+	}
+	m.DisableSafetyFilters()
+	got := map[HarmCategory]HarmBlockThreshold{}
+	for _, ss := range m.SafetySettings {
+		got[ss.Category] = ss.Threshold
+	}
+	want := map[HarmCategory]HarmBlockThreshold{
+		HarmCategoryHarassment:       HarmBlockNone,
+		HarmCategoryHateSpeech:       HarmBlockNone,
+		HarmCategorySexuallyExplicit: HarmBlockNone,
+		HarmCategoryDangerousContent: HarmBlockNone,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// newFakeClient returns a Client whose requests are served by h.
+// Any opts are passed to NewClient.
+func newFakeClient(t *testing.T, h http.Handler, opts ...option.ClientOption) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	// The API key is used only by the cache client, which does not support
+	// a custom HTTP client.
+	opts = append([]option.ClientOption{
+		option.WithEndpoint(srv.URL),
+		option.WithHTTPClient(srv.Client()),
+		option.WithAPIKey("fake"),
+	}, opts...)
+	client, err := NewClient(context.Background(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// writeJSONResponse writes a JSON response with a single candidate holding text.
+func writeJSONResponse(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"candidates": [{"content": {"role": "model", "parts": [{"text": %q}]}}]}`, text)
+}
+
+func TestHTTPTrace(t *testing.T) {
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, "hello")
+	}))
+	var gotConn, gotFirstByte bool
+	trace := &httptrace.ClientTrace{
+		GotConn:              func(httptrace.GotConnInfo) { gotConn = true },
+		GotFirstResponseByte: func() { gotFirstByte = true },
+	}
+	ctx := httptrace.WithClientTrace(context.Background(), trace)
+	resp, err := client.GenerativeModel("m").GenerateContent(ctx, Text("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := responseString(resp), "hello"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !gotConn || !gotFirstByte {
+		t.Errorf("trace callbacks: GotConn=%t, GotFirstResponseByte=%t; want both true", gotConn, gotFirstByte)
+	}
+}
+
 func checkMatch(t *testing.T, got string, wants ...string) {
 	t.Helper()
 	for _, want := range wants {
@@ -950,3 +1308,1118 @@ func TestAttribution(t *testing.T) {
 		t.Errorf("got %q, %q, want %q, %q", got.key, got.value, want.key, want.value)
 	}
 }
+
+func TestQuotaProject(t *testing.T) {
+	var got []string
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("x-goog-user-project"))
+		writeJSONResponse(w, "hello")
+	}), WithQuotaProject("my-project"))
+	ctx := context.Background()
+	if _, err := client.GenerativeModel("m").GenerateContent(ctx, Text("hi")); err != nil {
+		t.Fatal(err)
+	}
+	// The file is served by a different underlying client.
+	if _, err := client.GetFile(ctx, "f"); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want 2", len(got))
+	}
+	for _, g := range got {
+		if g != "my-project" {
+			t.Errorf("got header %q, want %q", g, "my-project")
+		}
+	}
+}
+
+func TestRawChunks(t *testing.T) {
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hello"}]}}]},`+
+			`{"candidates": [{"content": {"role": "model", "parts": [{"text": ", "}, {"text": "world"}]}}]}]`)
+	}))
+	iter := client.GenerativeModel("m").GenerateContentStream(context.Background(), Text("hi")).RawChunks()
+	want := [][]Part{
+		{Text("Hello")},
+		{Text(", "), Text("world")},
+	}
+	var chunks []*GenerateContentResponse
+	for range want {
+		resp, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, resp)
+	}
+	for i, c := range chunks {
+		if got := c.Candidates[0].Content.Parts; !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("chunk %d: got %v, want %v", i, got, want[i])
+		}
+	}
+	if got, want := responseString(iter.MergedResponse()), "Hello, world"; got != want {
+		t.Errorf("merged: got %q, want %q", got, want)
+	}
+}
+
+// fakeStreamClient is a pb.GenerativeService_StreamGenerateContentClient
+// that returns responses, then err.
+// useGRPCServer makes client send its generative service calls to srv over
+// an in-memory gRPC connection. Unlike the REST fakes, a gRPC stream can end
+// cleanly, so use it to test code that calls StreamGenerateContent, like
+// ChatSession.SendMessage.
+func useGRPCServer(t *testing.T, client *Client, srv pb.GenerativeServiceServer) {
+	t.Helper()
+	conn := dialGRPCServer(t, func(gs *grpc.Server) { pb.RegisterGenerativeServiceServer(gs, srv) })
+	gc, err := gl.NewGenerativeClient(context.Background(), option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gc.Close() })
+	client.gc = gc
+}
+
+// dialGRPCServer starts an in-memory gRPC server with the services that
+// register adds, and returns a connection to it.
+func dialGRPCServer(t *testing.T, register func(*grpc.Server)) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	register(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+type fakeStreamClient struct {
+	pb.GenerativeService_StreamGenerateContentClient
+	responses []*pb.GenerateContentResponse
+	err       error
+}
+
+func (c *fakeStreamClient) Recv() (*pb.GenerateContentResponse, error) {
+	if len(c.responses) == 0 {
+		return nil, c.err
+	}
+	r := c.responses[0]
+	c.responses = c.responses[1:]
+	return r, nil
+}
+
+func TestIteratorDone(t *testing.T) {
+	newIter := func(err error) *GenerateContentResponseIterator {
+		var responses []*pb.GenerateContentResponse
+		for _, text := range []string{"Hello", ", world"} {
+			responses = append(responses, &pb.GenerateContentResponse{
+				Candidates: []*pb.Candidate{{Content: NewUserContent(Text(text)).toProto()}},
+			})
+		}
+		return &GenerateContentResponseIterator{sc: &fakeStreamClient{responses: responses, err: err}}
+	}
+
+	iter := newIter(io.EOF)
+	if iter.Done() {
+		t.Fatal("Done before Next")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := iter.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if iter.Done() {
+			t.Fatalf("Done after response %d", i)
+		}
+	}
+	if _, err := iter.Next(); err != iterator.Done {
+		t.Fatalf("got %v, want iterator.Done", err)
+	}
+	if !iter.Done() {
+		t.Error("not Done after iterator.Done")
+	}
+
+	iter = newIter(errors.New("failed"))
+	for {
+		if _, err := iter.Next(); err != nil {
+			break
+		}
+	}
+	if iter.Done() {
+		t.Error("Done after error")
+	}
+}
+
+func TestModelName(t *testing.T) {
+	c := &Client{}
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"gemini-1.5-pro", "models/gemini-1.5-pro"},
+		{"gemini-1.5-pro-latest", "models/gemini-1.5-pro-latest"},
+		{"models/gemini-1.5-pro", "models/gemini-1.5-pro"},
+		{"tunedModels/my-model", "tunedModels/my-model"},
+	} {
+		if got := c.GenerativeModel(test.in).Name(); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestOutputTokens(t *testing.T) {
+	chunk := func(text string, usage *pb.GenerateContentResponse_UsageMetadata) *pb.GenerateContentResponse {
+		return &pb.GenerateContentResponse{
+			Candidates:    []*pb.Candidate{{Content: NewUserContent(Text(text)).toProto()}},
+			UsageMetadata: usage,
+		}
+	}
+	for _, test := range []struct {
+		name      string
+		usage     *pb.GenerateContentResponse_UsageMetadata
+		wantFinal int
+	}{
+		{"reported", &pb.GenerateContentResponse_UsageMetadata{CandidatesTokenCount: 4}, 4},
+		{"not reported", nil, 6},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			iter := &GenerateContentResponseIterator{sc: &fakeStreamClient{
+				responses: []*pb.GenerateContentResponse{
+					chunk("Hello, world", nil),  // 12 ASCII characters: 3 tokens
+					chunk("¡hola!", test.usage), // 5 ASCII characters and 1 other: 3 tokens
+				},
+				err: io.EOF,
+			}}
+			if got := iter.OutputTokens(); got != 0 {
+				t.Errorf("before Next: got %d, want 0", got)
+			}
+			var got []int
+			for {
+				if _, err := iter.Next(); err != nil {
+					if err != iterator.Done {
+						t.Fatal(err)
+					}
+					break
+				}
+				got = append(got, iter.OutputTokens())
+			}
+			got = append(got, iter.OutputTokens())
+			if want := []int{3, 6, test.wantFinal}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestStreamMultipleCandidates(t *testing.T) {
+	// Candidate 1 starts first, and the candidates' chunks interleave.
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"candidates": [{"index": 1, "content": {"role": "model", "parts": [{"text": "Bon"}]}}]},`+
+			`{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hel"}]}}, {"index": 1, "content": {"role": "model", "parts": [{"text": "jour"}]}}]},`+
+			`{"candidates": [{"content": {"role": "model", "parts": [{"text": "lo"}]}}]}]`)
+	}))
+	iter := client.GenerativeModel("m").GenerateContentStream(context.Background(), Text("hi")).RawChunks()
+	want := [][]string{
+		{"1:Bon"},
+		{"0:Hel", "1:jour"},
+		{"0:lo"},
+	}
+	for i, w := range want {
+		resp, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range resp.Candidates {
+			got = append(got, fmt.Sprintf("%d:%s", c.Index, c.Content.Parts[0]))
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("chunk %d: got %q, want %q", i, got, w)
+		}
+	}
+	// Only the candidate of the first response is merged.
+	merged := iter.MergedResponse()
+	if len(merged.Candidates) != 1 || merged.Candidates[0].Index != 1 {
+		t.Fatalf("merged: got %d candidates, want only candidate 1", len(merged.Candidates))
+	}
+	if got, want := responseString(merged), "Bonjour"; got != want {
+		t.Errorf("merged: got %q, want %q", got, want)
+	}
+}
+
+func TestStreamToolConfig(t *testing.T) {
+	// The fake service returns a call to the first allowed function when the
+	// mode is ANY, as the real one does.
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ToolConfig struct {
+				FunctionCallingConfig struct {
+					Mode                 FunctionCallingMode
+					AllowedFunctionNames []string
+				}
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fcc := req.ToolConfig.FunctionCallingConfig
+		if fcc.Mode != FunctionCallingAny || len(fcc.AllowedFunctionNames) == 0 {
+			http.Error(w, fmt.Sprintf("bad function calling config %+v", fcc), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[{"candidates": [{"content": {"role": "model", "parts": [{"functionCall": {"name": %q, "args": {}}}]}}]}]`,
+			fcc.AllowedFunctionNames[0])
+	}))
+	model := client.GenerativeModel("m")
+	model.Tools = []*Tool{{FunctionDeclarations: []*FunctionDeclaration{{Name: "a"}, {Name: "b"}}}}
+	model.ToolConfig = &ToolConfig{
+		FunctionCallingConfig: &FunctionCallingConfig{
+			Mode:                 FunctionCallingAny,
+			AllowedFunctionNames: []string{"b"},
+		},
+	}
+	ctx := context.Background()
+	for _, test := range []struct {
+		name string
+		iter *GenerateContentResponseIterator
+	}{
+		{"GenerateContentStream", model.GenerateContentStream(ctx, Text("hi"))},
+		{"SendMessageStream", model.StartChat().SendMessageStream(ctx, Text("hi"))},
+	} {
+		resp, err := test.iter.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		want := []FunctionCall{{Name: "b", Args: map[string]any{}}}
+		if got := resp.Candidates[0].FunctionCalls(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	var gotKey string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("x-goog-api-key")
+		writeJSONResponse(w, "hello")
+	}))
+	// Don't log the failed handshake.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	ctx := context.Background()
+	newClient := func(opts ...option.ClientOption) *Client {
+		t.Helper()
+		opts = append([]option.ClientOption{option.WithAPIKey("k"), option.WithEndpoint(srv.URL)}, opts...)
+		client, err := NewClient(ctx, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+
+	// Without the TLS config, the server's certificate is not trusted.
+	if _, err := newClient().GenerativeModel("m").GenerateContent(ctx, Text("hi")); err == nil {
+		t.Fatal("untrusted certificate: got nil, want error")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	client := newClient(WithTLSConfig(&tls.Config{RootCAs: pool}))
+	resp, err := client.GenerativeModel("m").GenerateContent(ctx, Text("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := responseString(resp), "hello"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if gotKey != "k" {
+		t.Errorf("got API key %q, want %q", gotKey, "k")
+	}
+
+	// The option requires an API key, and conflicts with a custom HTTP client.
+	for _, opts := range [][]option.ClientOption{
+		{option.WithTokenSource(nil), WithTLSConfig(&tls.Config{})},
+		{option.WithAPIKey("k"), option.WithHTTPClient(http.DefaultClient), WithTLSConfig(&tls.Config{})},
+	} {
+		if _, err := NewClient(ctx, opts...); err == nil {
+			t.Errorf("%v: got nil, want error", opts)
+		}
+	}
+}
+
+func TestCompareModels(t *testing.T) {
+	// Each model counts one token per word, times its factor.
+	factors := map[string]int{"a": 1, "b": 2}
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, method, _ := strings.Cut(r.URL.Path, ":")
+		name := path[strings.LastIndex(path, "/")+1:]
+		f, ok := factors[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": 404, "message": "no such model", "status": "NOT_FOUND"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch method {
+		case "countTokens":
+			var req struct {
+				GenerateContentRequest struct {
+					Contents []struct {
+						Parts []struct{ Text string }
+					}
+				}
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			n := len(strings.Fields(req.GenerateContentRequest.Contents[0].Parts[0].Text)) * f
+			fmt.Fprintf(w, `{"totalTokens": %d}`, n)
+		case "":
+			fmt.Fprintf(w, `{"name": "models/%s", "inputTokenLimit": %d, "outputTokenLimit": %d}`, name, 5*f, 100*f)
+		default:
+			http.Error(w, "bad method "+method, http.StatusBadRequest)
+		}
+	}))
+	ctx := context.Background()
+	got, err := client.CompareModels(ctx, []string{"b", "a"}, Text("one two three"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ModelComparison{
+		{Model: "b", TotalTokens: 6, InputTokenLimit: 10, OutputTokenLimit: 200},
+		{Model: "a", TotalTokens: 3, InputTokenLimit: 5, OutputTokenLimit: 100},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+	for _, mc := range got {
+		if !mc.Fits() {
+			t.Errorf("%s: does not fit", mc.Model)
+		}
+	}
+
+	if _, err := client.CompareModels(ctx, []string{"a", "c"}, Text("hi")); err == nil || !strings.Contains(err.Error(), "c:") {
+		t.Errorf("unknown model: got %v, want error mentioning the model", err)
+	}
+}
+
+func TestAllHarmEnums(t *testing.T) {
+	cats := AllHarmCategories()
+	if len(cats) != len(pb.HarmCategory_name)-1 {
+		t.Errorf("AllHarmCategories: got %d values, want %d", len(cats), len(pb.HarmCategory_name)-1)
+	}
+	for n := range pb.HarmCategory_name {
+		if n != 0 && !slices.Contains(cats, HarmCategory(n)) {
+			t.Errorf("AllHarmCategories: missing %s", pb.HarmCategory(n))
+		}
+	}
+	if !slices.IsSorted(cats) {
+		t.Errorf("AllHarmCategories: not sorted: %v", cats)
+	}
+	for _, c := range cats {
+		if s := c.String(); strings.HasPrefix(s, "HarmCategory(") {
+			t.Errorf("%d has no name", c)
+		}
+	}
+
+	ths := AllHarmBlockThresholds()
+	want := []HarmBlockThreshold{HarmBlockLowAndAbove, HarmBlockMediumAndAbove, HarmBlockOnlyHigh, HarmBlockNone}
+	if !reflect.DeepEqual(ths, want) {
+		t.Errorf("AllHarmBlockThresholds: got %v, want %v", ths, want)
+	}
+	for n := range pb.SafetySetting_HarmBlockThreshold_name {
+		if n != 0 && !slices.Contains(ths, HarmBlockThreshold(n)) {
+			t.Errorf("AllHarmBlockThresholds: missing %s", pb.SafetySetting_HarmBlockThreshold(n))
+		}
+	}
+}
+
+func TestGenerateContentRaw(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]any
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSONResponse(w, "hello")
+	}))
+	model := client.GenerativeModel("m")
+	model.SetTemperature(0.5) // not used
+	req := &pb.GenerateContentRequest{
+		Contents: []*pb.Content{{Role: "user", Parts: []*pb.Part{{Data: &pb.Part_Text{Text: "hi"}}}}},
+	}
+	resp, err := model.GenerateContentRaw(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := responseString(resp), "hello"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if want := "/v1beta/models/m:generateContent"; gotPath != want {
+		t.Errorf("got path %q, want %q", gotPath, want)
+	}
+	if _, ok := gotBody["generationConfig"]; ok {
+		t.Errorf("model's GenerationConfig was sent: %v", gotBody)
+	}
+	if req.Model != "" {
+		t.Errorf("request was modified: Model = %q", req.Model)
+	}
+	if _, err := model.GenerateContentRaw(context.Background(), nil); err == nil {
+		t.Error("nil request: got nil, want error")
+	}
+}
+
+func TestGenerateContentRawBypassesModelBehavior(t *testing.T) {
+	var requests int
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSONResponse(w, " ")
+	}), WithResponseCache(10, 0))
+	model := client.GenerativeModel("m")
+	model.BlankTextRetries = 3
+	// The request is cacheable, and its response is blank.
+	req := &pb.GenerateContentRequest{
+		Contents:         []*pb.Content{{Role: "user", Parts: []*pb.Part{{Data: &pb.Part_Text{Text: "hi"}}}}},
+		GenerationConfig: &pb.GenerationConfig{Temperature: Ptr[float32](0)},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := model.GenerateContentRaw(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Neither retried nor cached.
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+}
+
+func TestModelInfoCache(t *testing.T) {
+	calls := 0
+	fail := false
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": 404, "message": "not found", "status": "NOT_FOUND"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"name": "models/m", "inputTokenLimit": %d}`, calls)
+	}))
+	ctx := context.Background()
+	model := client.GenerativeModel("m")
+
+	// A failure is not cached.
+	fail = true
+	if _, err := model.Info(ctx); err == nil {
+		t.Fatal("got nil, want error")
+	}
+	fail = false
+	info, err := model.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.InputTokenLimit != 2 || calls != 2 {
+		t.Fatalf("got limit %d after %d calls, want 2 after 2", info.InputTokenLimit, calls)
+	}
+
+	// Later calls, including on copies of the model, use the cache.
+	model2 := *model
+	for _, m := range []*GenerativeModel{model, &model2} {
+		info, err := m.Info(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.InputTokenLimit != 2 {
+			t.Errorf("got limit %d, want 2", info.InputTokenLimit)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("got %d calls, want 2", calls)
+	}
+
+	// RefreshInfo fetches again, and updates the cache.
+	info, err = model.RefreshInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.InputTokenLimit != 3 || calls != 3 {
+		t.Errorf("got limit %d after %d calls, want 3 after 3", info.InputTokenLimit, calls)
+	}
+	if info, _ := model.Info(ctx); info.InputTokenLimit != 3 || calls != 3 {
+		t.Errorf("after refresh: got limit %d after %d calls, want 3 after 3", info.InputTokenLimit, calls)
+	}
+
+	// Other models have their own cache.
+	if _, err := client.GenerativeModel("m").Info(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 4 {
+		t.Errorf("got %d calls, want 4", calls)
+	}
+}
+
+// delayedStreamClient waits before returning its first response.
+type delayedStreamClient struct {
+	fakeStreamClient
+	delay time.Duration
+}
+
+func (c *delayedStreamClient) Recv() (*pb.GenerateContentResponse, error) {
+	time.Sleep(c.delay)
+	c.delay = 0
+	return c.fakeStreamClient.Recv()
+}
+
+func TestStreamTiming(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	var responses []*pb.GenerateContentResponse
+	for _, text := range []string{"Hello", ", world"} {
+		responses = append(responses, &pb.GenerateContentResponse{
+			Candidates: []*pb.Candidate{{Content: NewUserContent(Text(text)).toProto()}},
+		})
+	}
+	iter := &GenerateContentResponseIterator{
+		sc:  &delayedStreamClient{fakeStreamClient{responses: responses, err: io.EOF}, delay},
+		now: time.Now,
+	}
+	iter.timing.Start = time.Now()
+	if got := iter.Timing(); got.TimeToFirstResponse() != 0 || got.Duration() != 0 {
+		t.Errorf("before Next: got %+v, want no durations", got)
+	}
+	if _, err := iter.Next(); err != nil {
+		t.Fatal(err)
+	}
+	ttft := iter.Timing().TimeToFirstResponse()
+	if ttft < delay {
+		t.Errorf("got time to first response %s, want at least %s", ttft, delay)
+	}
+	if d := iter.Timing().Duration(); d != 0 {
+		t.Errorf("before the end: got duration %s, want 0", d)
+	}
+	for {
+		_, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	timing := iter.Timing()
+	if timing.TimeToFirstResponse() != ttft {
+		t.Errorf("time to first response changed from %s to %s", ttft, timing.TimeToFirstResponse())
+	}
+	if d := timing.Duration(); d < ttft {
+		t.Errorf("got duration %s, want at least %s", d, ttft)
+	}
+
+	// Streaming calls record the start time.
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"candidates": [{"content": {"role": "model", "parts": [{"text": "hi"}]}}]}]`)
+	}))
+	iter = client.GenerativeModel("m").GenerateContentStream(context.Background(), Text("hi"))
+	if _, err := iter.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if got := iter.Timing().TimeToFirstResponse(); got < delay {
+		t.Errorf("GenerateContentStream: got time to first response %s, want at least %s", got, delay)
+	}
+}
+
+func TestIteratorFinishReason(t *testing.T) {
+	chunk := func(text string, fr pb.Candidate_FinishReason) *pb.GenerateContentResponse {
+		return &pb.GenerateContentResponse{
+			Candidates: []*pb.Candidate{{Content: NewUserContent(Text(text)).toProto(), FinishReason: fr}},
+		}
+	}
+	iter := &GenerateContentResponseIterator{sc: &fakeStreamClient{
+		responses: []*pb.GenerateContentResponse{
+			chunk("The answer", pb.Candidate_FINISH_REASON_UNSPECIFIED),
+			chunk(" is", pb.Candidate_MAX_TOKENS),
+		},
+		err: io.EOF,
+	}}
+	if got := iter.FinishReason(); got != FinishReasonUnspecified {
+		t.Errorf("before Next: got %s, want FinishReasonUnspecified", got)
+	}
+	if _, err := iter.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if got := iter.FinishReason(); got != FinishReasonUnspecified {
+		t.Errorf("after the first response: got %s, want FinishReasonUnspecified", got)
+	}
+	for {
+		_, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := iter.FinishReason(); got != FinishReasonMaxTokens {
+		t.Errorf("after iteration: got %s, want FinishReasonMaxTokens", got)
+	}
+
+	// An iterator that failed to start has no finish reason.
+	iter = &GenerateContentResponseIterator{err: errors.New("no")}
+	if _, err := iter.Next(); err == nil {
+		t.Fatal("got nil, want error")
+	}
+	if got := iter.FinishReason(); got != FinishReasonUnspecified {
+		t.Errorf("after an error: got %s, want FinishReasonUnspecified", got)
+	}
+}
+
+func TestGenerateContentSortsCandidates(t *testing.T) {
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"candidates": [`+
+			`{"index": 2, "content": {"role": "model", "parts": [{"text": "c"}]}},`+
+			`{"content": {"role": "model", "parts": [{"text": "a"}]}},`+
+			`{"index": 1, "content": {"role": "model", "parts": [{"text": "b"}]}}]}`)
+	}))
+	model := client.GenerativeModel("m")
+	model.SetCandidateCount(3)
+	resp, err := model.GenerateContent(context.Background(), Text("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i, c := range resp.Candidates {
+		if c.Index != int32(i) {
+			t.Errorf("candidate %d has index %d", i, c.Index)
+		}
+		got = append(got, string(c.Content.Parts[0].(Text)))
+	}
+	if want := []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestContentTransformer(t *testing.T) {
+	var got [][]string // the texts of each request's contents
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Contents               []struct{ Parts []struct{ Text string } }
+			GenerateContentRequest *struct {
+				Contents []struct{ Parts []struct{ Text string } }
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contents := req.Contents
+		if req.GenerateContentRequest != nil {
+			contents = req.GenerateContentRequest.Contents
+		}
+		var texts []string
+		for _, c := range contents {
+			for _, p := range c.Parts {
+				texts = append(texts, p.Text)
+			}
+		}
+		got = append(got, texts)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, ":countTokens") {
+			fmt.Fprint(w, `{"totalTokens": 1}`)
+			return
+		}
+		writeJSONResponse(w, "ok")
+	}), WithContentTransformer(func(cs []*Content) []*Content {
+		// Redact, and add a final instruction.
+		var out []*Content
+		for _, c := range cs {
+			nc := &Content{Role: c.Role}
+			for _, p := range c.Parts {
+				if t, ok := p.(Text); ok {
+					p = Text(strings.ReplaceAll(string(t), "hunter2", "[REDACTED]"))
+				}
+				nc.Parts = append(nc.Parts, p)
+			}
+			out = append(out, nc)
+		}
+		return append(out, NewUserContent(Text("Be brief.")))
+	}))
+	ctx := context.Background()
+	model := client.GenerativeModel("m")
+
+	if _, err := model.GenerateContent(ctx, Text("my password is hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.CountTokens(ctx, Text("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	// SendMessageSelect makes a unary call that the fake server can answer,
+	// but requires a CandidateCount greater than one.
+	model.SetCandidateCount(2)
+	cs := model.StartChat()
+	first := func([]*Candidate) int { return 0 }
+	if _, err := cs.SendMessageSelect(ctx, first, Text("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.SendMessageSelect(ctx, first, Text("it is hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"my password is [REDACTED]", "Be brief."},
+		{"[REDACTED]", "Be brief."},
+		{"hi", "Be brief."},
+		// The transformer sees the whole history, but does not change it.
+		{"hi", "ok", "it is [REDACTED]", "Be brief."},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	if h := cs.History[2].Parts[0]; h != Text("it is hunter2") {
+		t.Errorf("history was modified: %v", h)
+	}
+}
+
+func TestBlankTextRetries(t *testing.T) {
+	replies := []string{" \n", "", "real text"}
+	var calls int
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONResponse(w, replies[calls%len(replies)])
+		calls++
+	}))
+	ctx := context.Background()
+	for _, test := range []struct {
+		retries   int
+		wantCalls int
+		wantText  string
+	}{
+		{0, 1, " \n"},
+		{1, 2, ""},
+		{2, 3, "real text"},
+		{5, 3, "real text"},
+	} {
+		calls = 0
+		model := client.GenerativeModel("m")
+		model.BlankTextRetries = test.retries
+		resp, err := model.GenerateContent(ctx, Text("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != test.wantCalls {
+			t.Errorf("retries=%d: got %d calls, want %d", test.retries, calls, test.wantCalls)
+		}
+		if got := responseString(resp); got != test.wantText {
+			t.Errorf("retries=%d: got %q, want %q", test.retries, got, test.wantText)
+		}
+	}
+}
+
+func TestIsBlankTextResponse(t *testing.T) {
+	cand := func(fr FinishReason, parts ...Part) *Candidate {
+		return &Candidate{FinishReason: fr, Content: &Content{Parts: parts}}
+	}
+	for _, test := range []struct {
+		cands []*Candidate
+		want  bool
+	}{
+		{nil, false},
+		{[]*Candidate{cand(FinishReasonStop)}, true},
+		{[]*Candidate{cand(FinishReasonStop, Text(" "), Text("\n"))}, true},
+		{[]*Candidate{cand(FinishReasonStop, Text(" ")), cand(FinishReasonStop, Text("x"))}, false},
+		{[]*Candidate{cand(FinishReasonStop, FunctionCall{Name: "f"})}, false},
+		{[]*Candidate{cand(FinishReasonStop, Blob{MIMEType: "image/png"})}, false},
+		{[]*Candidate{cand(FinishReasonSafety)}, false},
+		{[]*Candidate{cand(FinishReasonMaxTokens, Text(""))}, false},
+	} {
+		got := isBlankTextResponse(&GenerateContentResponse{Candidates: test.cands})
+		if got != test.want {
+			t.Errorf("%v: got %t, want %t", test.cands, got, test.want)
+		}
+	}
+}
+
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestGenerateContentStreamTo(t *testing.T) {
+	chunk := func(fr pb.Candidate_FinishReason, parts ...Part) *pb.GenerateContentResponse {
+		return &pb.GenerateContentResponse{
+			Candidates: []*pb.Candidate{{Content: NewUserContent(parts...).toProto(), FinishReason: fr}},
+		}
+	}
+	newIter := func(responses ...*pb.GenerateContentResponse) *GenerateContentResponseIterator {
+		return &GenerateContentResponseIterator{sc: &fakeStreamClient{responses: responses, err: io.EOF}}
+	}
+
+	var buf bytes.Buffer
+	err := writeStreamText(&buf, newIter(
+		chunk(pb.Candidate_FINISH_REASON_UNSPECIFIED, Text("Hello")),
+		chunk(pb.Candidate_FINISH_REASON_UNSPECIFIED, FunctionCall{Name: "f"}),
+		&pb.GenerateContentResponse{},
+		chunk(pb.Candidate_STOP, Text(", "), Text("world")),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "Hello, world"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	err = writeStreamText(&buf, newIter(
+		chunk(pb.Candidate_FINISH_REASON_UNSPECIFIED, Text("The answer")),
+		chunk(pb.Candidate_MAX_TOKENS, Text(" is")),
+	))
+	if err == nil || !strings.Contains(err.Error(), "FinishReasonMaxTokens") {
+		t.Errorf("got %v, want an error naming the finish reason", err)
+	}
+	if got, want := buf.String(), "The answer is"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	werr := errors.New("disk full")
+	if err := writeStreamText(errWriter{werr}, newIter(chunk(pb.Candidate_STOP, Text("x")))); err != werr {
+		t.Errorf("got %v, want %v", err, werr)
+	}
+
+	// An error from the service.
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such model", http.StatusNotFound)
+	}))
+	buf.Reset()
+	err = client.GenerativeModel("m").GenerateContentStreamTo(context.Background(), &buf, Text("hi"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %q, want nothing", buf.String())
+	}
+}
+
+func TestGenerateContentWithSafety(t *testing.T) {
+	var got []string // the JSON of the safety settings of each request
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ SafetySettings json.RawMessage }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = append(got, string(req.SafetySettings))
+		writeJSONResponse(w, "ok")
+	}))
+	ctx := context.Background()
+	model := client.GenerativeModel("m")
+	modelSettings := []*SafetySetting{{Category: HarmCategoryHarassment, Threshold: HarmBlockLowAndAbove}}
+	model.SafetySettings = modelSettings
+
+	relaxed := []*SafetySetting{{Category: HarmCategoryDangerousContent, Threshold: HarmBlockNone}}
+	if _, err := model.GenerateContentWithSafety(ctx, relaxed, Text("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.GenerateContent(ctx, Text("hi")); err != nil {
+		t.Fatal(err)
+	}
+	// The REST client sends enums as numbers.
+	want := []string{
+		fmt.Sprintf(`[{"category":%d,"threshold":%d}]`, HarmCategoryDangerousContent, HarmBlockNone),
+		fmt.Sprintf(`[{"category":%d,"threshold":%d}]`, HarmCategoryHarassment, HarmBlockLowAndAbove),
+	}
+	for i := range got {
+		got[i] = strings.Join(strings.Fields(got[i]), "")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	if !reflect.DeepEqual(model.SafetySettings, modelSettings) {
+		t.Errorf("model's SafetySettings changed to %v", model.SafetySettings)
+	}
+}
+
+func TestStreamBlockedLate(t *testing.T) {
+	chunk := func(text string, fr pb.Candidate_FinishReason) *pb.GenerateContentResponse {
+		c := &pb.Candidate{FinishReason: fr}
+		if text != "" {
+			c.Content = NewUserContent(Text(text)).toProto()
+			c.Content.Role = "model"
+		}
+		return &pb.GenerateContentResponse{Candidates: []*pb.Candidate{c}}
+	}
+	iter := &GenerateContentResponseIterator{sc: &fakeStreamClient{
+		responses: []*pb.GenerateContentResponse{
+			chunk("Here is how", pb.Candidate_FINISH_REASON_UNSPECIFIED),
+			chunk(" to", pb.Candidate_FINISH_REASON_UNSPECIFIED),
+			chunk("", pb.Candidate_SAFETY),
+		},
+		err: io.EOF,
+	}}
+	var texts []string
+	var err error
+	for {
+		var resp *GenerateContentResponse
+		resp, err = iter.Next()
+		if err != nil {
+			break
+		}
+		texts = append(texts, responseString(resp))
+	}
+	if want := []string{"Here is how", " to"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("got %q, want %q", texts, want)
+	}
+	var berr *BlockedError
+	if !errors.As(err, &berr) {
+		t.Fatalf("got %v, want BlockedError", err)
+	}
+	if berr.Candidate.FinishReason != FinishReasonSafety {
+		t.Errorf("got finish reason %s, want FinishReasonSafety", berr.Candidate.FinishReason)
+	}
+	want := &Content{Role: "model", Parts: []Part{Text("Here is how to")}}
+	if !reflect.DeepEqual(berr.StreamedContent, want) {
+		t.Errorf("got streamed content %v, want %v", berr.StreamedContent, want)
+	}
+	if _, err2 := iter.Next(); err2 != err {
+		t.Errorf("after the block: got %v, want the same error", err2)
+	}
+
+	// A candidate blocked before any text was streamed has no streamed content.
+	iter = &GenerateContentResponseIterator{sc: &fakeStreamClient{
+		responses: []*pb.GenerateContentResponse{chunk("", pb.Candidate_SAFETY)},
+		err:       io.EOF,
+	}}
+	_, err = iter.Next()
+	if !errors.As(err, &berr) || berr.StreamedContent != nil {
+		t.Errorf("got %v with streamed content %v, want BlockedError without", err, berr.StreamedContent)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var (
+		ids      []string
+		failures int // the number of attempts to fail with 503
+	)
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("x-request-id"))
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if strings.Contains(r.URL.Path, "missing") {
+			http.Error(w, "no such model", http.StatusNotFound)
+			return
+		}
+		writeJSONResponse(w, "hello")
+	}))
+	id := NewRequestID()
+	if len(id) != 32 || id == NewRequestID() {
+		t.Fatalf("bad request ID %q", id)
+	}
+	ctx := WithRequestID(context.Background(), id)
+
+	// The retried attempt has the same ID.
+	failures = 1
+	if _, err := client.GenerativeModel("m").GenerateContent(ctx, Text("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{id, id}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got IDs %q, want %q", ids, want)
+	}
+
+	ids = nil
+	_, err := client.GenerativeModel("missing").GenerateContent(ctx, Text("hi"))
+	if got := RequestID(err); got != id {
+		t.Errorf("got request ID %q from error, want %q", got, id)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+	if !strings.Contains(err.Error(), id) {
+		t.Errorf("error message %q does not contain the ID", err)
+	}
+
+	// Without an ID, no header is sent and errors have none.
+	ids = nil
+	_, err = client.GenerativeModel("missing").GenerateContent(context.Background(), Text("hi"))
+	if RequestID(err) != "" || !reflect.DeepEqual(ids, []string{""}) {
+		t.Errorf("got IDs %q and %q from error, want none", ids, RequestID(err))
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1beta/models/m":
+			fmt.Fprint(w, `{"name": "models/m", "outputTokenLimit": 8192, "maxTemperature": 2,
+				"supportedGenerationMethods": ["generateContent", "countTokens"]}`)
+		case "/v1beta/models/embedder":
+			fmt.Fprint(w, `{"name": "models/embedder", "supportedGenerationMethods": ["embedContent"]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ctx := context.Background()
+
+	model := client.GenerativeModel("m")
+	model.SetCandidateCount(2)
+	model.SetMaxOutputTokens(8192)
+	model.SetTemperature(2)
+	model.ResponseMIMEType = "application/json"
+	model.ResponseSchema = &Schema{Type: TypeString}
+	if err := model.ValidateConfig(ctx); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+	// Enum mode.
+	model.ResponseMIMEType = "text/x.enum"
+	model.ResponseSchema = &Schema{Type: TypeString, Format: "enum", Enum: []string{"a", "b"}}
+	if err := model.ValidateConfig(ctx); err != nil {
+		t.Errorf("valid enum config: %v", err)
+	}
+	model.ResponseSchema = nil
+	if err := model.ValidateConfig(ctx); err != nil {
+		t.Errorf("valid enum MIME type: %v", err)
+	}
+	model.ResponseSchema = &Schema{Type: TypeString}
+
+	model.SetCandidateCount(9)
+	model.StopSequences = []string{"a", "b", "c", "d", "e", "f"}
+	model.SetMaxOutputTokens(10000)
+	model.SetTemperature(2.5)
+	model.SetTopP(1.5)
+	model.SetTopK(-1)
+	model.ResponseMIMEType = "text/plain"
+	err := model.ValidateConfig(ctx)
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	for _, want := range []string{
+		"CandidateCount 9",
+		"6 StopSequences",
+		"MaxOutputTokens 10000 exceeds the model's output token limit of 8192",
+		"Temperature 2.5 exceeds the model's maximum of 2",
+		"TopP 1.5",
+		"TopK -1",
+		"ResponseSchema requires",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not contain %q:\n%v", want, err)
+		}
+	}
+
+	if err := client.GenerativeModel("embedder").ValidateConfig(ctx); err == nil || !strings.Contains(err.Error(), "does not support generating content") {
+		t.Errorf("embedding model: got %v", err)
+	}
+	if err := client.GenerativeModel("missing").ValidateConfig(ctx); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing model: got %v, want ErrNotFound", err)
+	}
+}
@@ -15,7 +15,13 @@
 package genai
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
 
 	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
 )
@@ -53,6 +59,8 @@ func partFromProto(p *pb.Part) Part {
 			MIMEType: d.InlineData.MimeType,
 			Data:     d.InlineData.Data,
 		}
+	case *pb.Part_FileData:
+		return *(FileData{}).fromProto(d.FileData)
 	case *pb.Part_FunctionCall:
 		return *(FunctionCall{}).fromProto(d.FunctionCall)
 
@@ -77,6 +85,67 @@ func (t Text) toPart() *pb.Part {
 	}
 }
 
+// JSONData is a convenience function for creating a Text part
+// holding the compact JSON encoding of v.
+// It returns an error if v cannot be encoded as JSON.
+func JSONData(v any) (Text, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("genai.JSONData: %w", err)
+	}
+	return Text(b), nil
+}
+
+// untrustedTagRE matches the tags that WrapUntrusted uses as delimiters,
+// including partial and malformed ones.
+var untrustedTagRE = regexp.MustCompile(`(?i)<\s*/?\s*untrusted_input\b[^<>]*>?`)
+
+// WrapUntrusted is a convenience function for creating a Text part holding
+// text that comes from an untrusted source, such as an end user, enclosed in
+// <untrusted_input> tags:
+//
+//	<untrusted_input>
+//	text
+//	</untrusted_input>
+//
+// Any such tags in text are removed, so the text cannot end the section early.
+// Tell the model in the SystemInstruction to treat the contents of these
+// sections as data and not to follow instructions in them.
+//
+// WrapUntrusted is a defense-in-depth measure against prompt injection, not a
+// guarantee: a model may still follow instructions in the wrapped text.
+// Use [StripInjectionMarkers] to also remove common prompt-format markers.
+func WrapUntrusted(text string) Text {
+	text = removeAll(untrustedTagRE, text)
+	return Text("<untrusted_input>\n" + text + "\n</untrusted_input>")
+}
+
+// injectionMarkerRE matches markers of prompt formats used by various models
+// to delimit turns and system prompts, which untrusted text may include in an
+// attempt to be treated as instructions.
+var injectionMarkerRE = regexp.MustCompile(`(?i)<start_of_turn>|<end_of_turn>|` +
+	`<\|(?:im_start|im_end|system|user|assistant|endoftext)\|>|` +
+	`\[/?INST\]|<</?SYS>>`)
+
+// StripInjectionMarkers returns text with known prompt-format markers, such
+// as "<start_of_turn>" and "[INST]", removed. Matching is case-insensitive.
+// Like [WrapUntrusted], it is a defense-in-depth measure.
+func StripInjectionMarkers(text string) string {
+	return removeAll(injectionMarkerRE, text)
+}
+
+// removeAll removes all matches of re from s, repeatedly, since removing a
+// match can join the surrounding text into a new one.
+func removeAll(re *regexp.Regexp, s string) string {
+	for {
+		t := re.ReplaceAllString(s, "")
+		if t == s {
+			return s
+		}
+		s = t
+	}
+}
+
 func (b Blob) toPart() *pb.Part {
 	return &pb.Part{
 		Data: &pb.Part_InlineData{
@@ -96,6 +165,20 @@ func ImageData(format string, data []byte) Blob {
 	}
 }
 
+// PDFData is a convenience function for creating a PDF document
+// Blob for input to a model.
+//
+// The document is sent inline, as part of the request, rather than being
+// uploaded with [Client.UploadFile]. The service limits the size of a request,
+// including all its inline data, to 20MB; use the File API for larger
+// documents, or for documents that will be used in more than one request.
+func PDFData(data []byte) Blob {
+	return Blob{
+		MIMEType: "application/pdf",
+		Data:     data,
+	}
+}
+
 func (f FunctionCall) toPart() *pb.Part {
 	return &pb.Part{
 		Data: &pb.Part_FunctionCall{
@@ -104,6 +187,39 @@ func (f FunctionCall) toPart() *pb.Part {
 	}
 }
 
+// DecodeArgs decodes the arguments of the call into v, which should be a
+// pointer, as [json.Unmarshal] does, except that numbers decoded into an
+// interface value become [json.Number]s rather than float64s. Use it to get
+// arguments as typed values, like an int64 field of a struct, without
+// converting them from float64.
+//
+// The service sends all numbers as double-precision floating-point values,
+// so integers whose magnitude is greater than 2^53 may have been rounded
+// before DecodeArgs sees them. Declare parameters that hold large integers,
+// like IDs, with [TypeString] instead.
+func (f FunctionCall) DecodeArgs(v any) error {
+	if err := decodeJSONArgs(f.Args, v, false); err != nil {
+		return fmt.Errorf("genai.FunctionCall.DecodeArgs: %w", err)
+	}
+	return nil
+}
+
+// decodeJSONArgs decodes args into v, representing numbers in interface
+// values as json.Numbers. If strict is true, it is an error for args to hold
+// a key that does not correspond to a field of v.
+func decodeJSONArgs(args map[string]any, v any, strict bool) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
 func (f FunctionResponse) toPart() *pb.Part {
 	return &pb.Part{
 		Data: &pb.Part_FunctionResponse{
@@ -136,6 +252,16 @@ func (c CodeExecutionResult) toPart() *pb.Part {
 	}
 }
 
+// Succeeded reports whether the code ran to completion successfully.
+//
+// The service does not report the exit status of the code, or separate its
+// standard output from its standard error: Output holds the standard output
+// if the code succeeded, and the standard error or another description of
+// the failure otherwise.
+func (c *CodeExecutionResult) Succeeded() bool {
+	return c != nil && c.Outcome == CodeExecutionResultOutcomeOK
+}
+
 // Ptr returns a pointer to its argument.
 // It can be used to initialize pointer fields:
 //
@@ -157,6 +283,111 @@ func (c *GenerationConfig) SetTopP(x float32) { c.TopP = &x }
 // SetTopK sets the TopK field.
 func (c *GenerationConfig) SetTopK(x int32) { c.TopK = &x }
 
+// Creativity is a preset combination of Temperature, TopP and TopK,
+// for use with [GenerationConfig.SetCreativity].
+type Creativity int
+
+const (
+	// CreativityLow makes responses focused and consistent,
+	// for tasks like extraction, classification and factual answers.
+	CreativityLow Creativity = iota
+	// CreativityMedium balances consistency and variety,
+	// for general-purpose chat and writing.
+	CreativityMedium
+	// CreativityHigh makes responses varied and surprising,
+	// for brainstorming and fiction.
+	CreativityHigh
+)
+
+// SetCreativity sets the Temperature, TopP and TopK fields to a preset
+// combination. The presets are a starting point for users who are not
+// familiar with these parameters; tune the fields directly for finer control.
+//
+//	Creativity        Temperature  TopP  TopK
+//	CreativityLow     0.2          0.8   20
+//	CreativityMedium  0.7          0.95  40
+//	CreativityHigh    1.0          0.99  64
+//
+// If cr is not one of the presets, SetCreativity does nothing.
+func (c *GenerationConfig) SetCreativity(cr Creativity) {
+	switch cr {
+	case CreativityLow:
+		c.SetTemperature(0.2)
+		c.SetTopP(0.8)
+		c.SetTopK(20)
+	case CreativityMedium:
+		c.SetTemperature(0.7)
+		c.SetTopP(0.95)
+		c.SetTopK(40)
+	case CreativityHigh:
+		c.SetTemperature(1.0)
+		c.SetTopP(0.99)
+		c.SetTopK(64)
+	}
+}
+
+// DiffGenerationConfig compares a and b field by field, and returns the
+// fields that differ, keyed by field name. Each value holds the field's value
+// in a and in b, in that order. Pointers to numbers are dereferenced, and the
+// value of an unset pointer field or an empty slice is nil. A nil config is
+// treated as one with no fields set. The result is empty if the configs are
+// equal.
+//
+// Use it to see which settings changed between two experiments:
+//
+//	for name, v := range genai.DiffGenerationConfig(&old, &new) {
+//		fmt.Printf("%s: %v -> %v\n", name, v[0], v[1])
+//	}
+func DiffGenerationConfig(a, b *GenerationConfig) map[string][2]any {
+	if a == nil {
+		a = &GenerationConfig{}
+	}
+	if b == nil {
+		b = &GenerationConfig{}
+	}
+	diffs := map[string][2]any{}
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		f := va.Type().Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		fa, fb := configFieldValue(va.Field(i)), configFieldValue(vb.Field(i))
+		if !reflect.DeepEqual(fa, fb) {
+			diffs[f.Name] = [2]any{fa, fb}
+		}
+	}
+	return diffs
+}
+
+// configFieldValue returns the value of a GenerationConfig field for
+// DiffGenerationConfig.
+func configFieldValue(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Elem().Kind() != reflect.Struct {
+			return v.Elem().Interface()
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+	}
+	return v.Interface()
+}
+
+// HasContent reports whether the candidate has content with at least one part.
+// A candidate may have no content, or content with no parts, for example when
+// it was blocked or the model produced nothing. Check HasContent before
+// indexing c.Content.Parts. The other methods of Candidate handle candidates
+// without content.
+func (c *Candidate) HasContent() bool {
+	return c != nil && c.Content != nil && len(c.Content.Parts) > 0
+}
+
 // FunctionCalls return all the FunctionCall parts in the candidate.
 func (c *Candidate) FunctionCalls() []FunctionCall {
 	if c.Content == nil {
@@ -171,8 +402,185 @@ func (c *Candidate) FunctionCalls() []FunctionCall {
 	return fcs
 }
 
+// AsContent returns the candidate's content in a form suitable for adding to
+// a conversation history: a copy with the role set to "model" and with empty
+// text parts removed.
+// It returns nil if the candidate has no content or no parts.
+func (c *Candidate) AsContent() *Content {
+	if !c.HasContent() {
+		return nil
+	}
+	return copySanitizedModelContent(c.Content)
+}
+
+// Split separates the parts of the candidate by kind, for handling a response
+// that mixes text with function calls, such as an explanation of a plan
+// followed by the calls that carry it out.
+// It returns the concatenation of the candidate's Text parts, its FunctionCall
+// parts, and all other parts. Each preserves the order of the parts in the
+// candidate.
+func (c *Candidate) Split() (text string, calls []FunctionCall, other []Part) {
+	if c.Content == nil {
+		return "", nil, nil
+	}
+	var b strings.Builder
+	for _, p := range c.Content.Parts {
+		switch p := p.(type) {
+		case Text:
+			b.WriteString(string(p))
+		case FunctionCall:
+			calls = append(calls, p)
+		default:
+			other = append(other, p)
+		}
+	}
+	return b.String(), calls, other
+}
+
+// Blobs returns all the Blob parts in all the candidates of the response,
+// in order. Each Blob holds the raw bytes of the data and its MIME type.
+func (r *GenerateContentResponse) Blobs() []Blob {
+	var bs []Blob
+	for _, c := range r.Candidates {
+		if c.Content == nil {
+			continue
+		}
+		for _, p := range c.Content.Parts {
+			if b, ok := p.(Blob); ok {
+				bs = append(bs, b)
+			}
+		}
+	}
+	return bs
+}
+
+// BestCandidate returns the candidate with the highest score, as computed by
+// the score function. If several candidates have the highest score, the first
+// one is returned. It returns nil if there are no candidates.
+//
+// Set [GenerationConfig.CandidateCount] to request more than one candidate.
+func (r *GenerateContentResponse) BestCandidate(score func(*Candidate) float64) *Candidate {
+	var (
+		best      *Candidate
+		bestScore float64
+	)
+	for _, c := range r.Candidates {
+		if s := score(c); best == nil || s > bestScore {
+			best, bestScore = c, s
+		}
+	}
+	return best
+}
+
+// SplitCandidates returns one response per candidate of r, in order.
+// Each response has a single candidate, along with copies of r's PromptFeedback
+// and UsageMetadata. The candidates and their contents are copied, so modifying
+// one of the returned responses does not affect r or the others. The parts
+// themselves are not copied.
+//
+// Set [GenerationConfig.CandidateCount] to request more than one candidate.
+func (r *GenerateContentResponse) SplitCandidates() []*GenerateContentResponse {
+	var rs []*GenerateContentResponse
+	for _, c := range r.Candidates {
+		rs = append(rs, copyResponse(&GenerateContentResponse{
+			Candidates:     []*Candidate{c},
+			PromptFeedback: r.PromptFeedback,
+			UsageMetadata:  r.UsageMetadata,
+		}))
+	}
+	return rs
+}
+
+// ResponseView is a flattened view of a [GenerateContentResponse], for use in
+// templates and other places where checking nested pointers is inconvenient.
+// Fields whose source is missing have their zero values.
+type ResponseView struct {
+	// Text is the concatenation of the Text parts of the first candidate.
+	Text string
+	// FinishReason is the finish reason of the first candidate.
+	FinishReason FinishReason
+	// BlockReason is the reason that the prompt was blocked, if it was.
+	BlockReason BlockReason
+	// Citations are the citation sources of the first candidate.
+	Citations []CitationView
+
+	PromptTokenCount        int32
+	CachedContentTokenCount int32
+	CandidatesTokenCount    int32
+	TotalTokenCount         int32
+}
+
+// CitationView is a flattened [CitationSource].
+type CitationView struct {
+	StartIndex, EndIndex int32
+	URI                  string
+	License              string
+}
+
+// View returns a flattened view of r. It can be called on a nil response.
+func (r *GenerateContentResponse) View() ResponseView {
+	var v ResponseView
+	if r == nil {
+		return v
+	}
+	if len(r.Candidates) > 0 && r.Candidates[0] != nil {
+		c := r.Candidates[0]
+		v.Text, _, _ = c.Split()
+		v.FinishReason = c.FinishReason
+		if c.CitationMetadata != nil {
+			for _, s := range c.CitationMetadata.CitationSources {
+				if s == nil {
+					continue
+				}
+				v.Citations = append(v.Citations, CitationView{
+					StartIndex: pvDerefOrZero(s.StartIndex),
+					EndIndex:   pvDerefOrZero(s.EndIndex),
+					URI:        pvDerefOrZero(s.URI),
+					License:    s.License,
+				})
+			}
+		}
+	}
+	if r.PromptFeedback != nil {
+		v.BlockReason = r.PromptFeedback.BlockReason
+	}
+	if u := r.UsageMetadata; u != nil {
+		v.PromptTokenCount = u.PromptTokenCount
+		v.CachedContentTokenCount = u.CachedContentTokenCount
+		v.CandidatesTokenCount = u.CandidatesTokenCount
+		v.TotalTokenCount = u.TotalTokenCount
+	}
+	return v
+}
+
+// copyResponse returns a copy of r that can be modified without affecting r,
+// except for the parts themselves.
+func copyResponse(r *GenerateContentResponse) *GenerateContentResponse {
+	r2 := &GenerateContentResponse{}
+	for _, c := range r.Candidates {
+		c2 := *c
+		if c.Content != nil {
+			c2.Content = &Content{Role: c.Content.Role, Parts: slices.Clone(c.Content.Parts)}
+		}
+		if c.CitationMetadata != nil {
+			c2.CitationMetadata = &CitationMetadata{CitationSources: slices.Clone(c.CitationMetadata.CitationSources)}
+		}
+		r2.Candidates = append(r2.Candidates, &c2)
+	}
+	if r.PromptFeedback != nil {
+		pf := *r.PromptFeedback
+		r2.PromptFeedback = &pf
+	}
+	if r.UsageMetadata != nil {
+		um := *r.UsageMetadata
+		r2.UsageMetadata = &um
+	}
+	return r2
+}
+
 // NewUserContent returns a *Content with a "user" role set and one or more
-// parts.
+// parts. The parts are kept in the order given, and are sent to the model in
+// that order, so text can refer to the image or other data that precedes it.
 func NewUserContent(parts ...Part) *Content {
 	content := &Content{Role: roleUser, Parts: []Part{}}
 	for _, part := range parts {
@@ -180,3 +588,26 @@ func NewUserContent(parts ...Part) *Content {
 	}
 	return content
 }
+
+// PricingTier returns the pricing tier that a request with usage u falls in,
+// for models whose price per token depends on the size of the prompt.
+// The thresholds are the prompt sizes, in increasing order, above which each
+// tier after the first applies; PricingTier returns the number of thresholds
+// that u.PromptTokenCount exceeds. For example, for a model that charges more
+// for prompts over 128K tokens, PricingTier(128_000) returns 0 for the lower
+// price and 1 for the higher one.
+//
+// The service does not report usage by tier, so the tier is computed from
+// PromptTokenCount. It returns 0 if u is nil.
+func (u *UsageMetadata) PricingTier(thresholds ...int32) int {
+	if u == nil {
+		return 0
+	}
+	tier := 0
+	for _, t := range thresholds {
+		if u.PromptTokenCount > t {
+			tier++
+		}
+	}
+	return tier
+}
@@ -17,14 +17,20 @@
 package genai
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"os"
 
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // printRequests controls whether request protobufs are written to stderr.
+// The data of inline Blobs is elided.
 var printRequests = false
 
 func debugPrint(m proto.Message) {
@@ -33,6 +39,101 @@ func debugPrint(m proto.Message) {
 	}
 	fmt.Fprintln(os.Stderr, "--------")
 	fmt.Fprintf(os.Stderr, "%T\n", m)
-	fmt.Fprint(os.Stderr, prototext.Format(m))
+	fmt.Fprint(os.Stderr, prototext.Format(withElidedBlobs(m)))
 	fmt.Fprintln(os.Stderr, "^^^^^^^^")
 }
+
+// elidedBlobData returns the text that replaces the n bytes of an inline Blob
+// in request dumps.
+func elidedBlobData(n int) string {
+	return fmt.Sprintf("<%d bytes elided>", n)
+}
+
+// withElidedBlobs returns a copy of m in which the data of every Blob is
+// replaced by a short note of its size, so that dumps of requests with large
+// inline data remain readable. If m has no Blobs, it is returned unchanged.
+func withElidedBlobs(m proto.Message) proto.Message {
+	if !hasBlobs(m.ProtoReflect()) {
+		return m
+	}
+	m = proto.Clone(m)
+	walkBlobs(m.ProtoReflect(), func(b *pb.Blob) {
+		b.Data = []byte(elidedBlobData(len(b.Data)))
+	})
+	return m
+}
+
+func hasBlobs(m protoreflect.Message) bool {
+	found := false
+	walkBlobs(m, func(*pb.Blob) { found = true })
+	return found
+}
+
+// walkBlobs calls f on every Blob in m.
+func walkBlobs(m protoreflect.Message, f func(*pb.Blob)) {
+	if b, ok := m.Interface().(*pb.Blob); ok {
+		f(b)
+		return
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			l := v.List()
+			for i := 0; i < l.Len(); i++ {
+				walkBlobs(l.Get(i).Message(), f)
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				walkBlobs(mv.Message(), f)
+				return true
+			})
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			walkBlobs(v.Message(), f)
+		}
+		return true
+	})
+}
+
+// elideBlobsInJSON replaces the base64-encoded data of every inline Blob in
+// body, the protojson encoding of a request, with a short note of its size.
+// If body has no inline data, it is returned unchanged.
+func elideBlobsInJSON(body []byte) []byte {
+	if !bytes.Contains(body, []byte(`"inlineData"`)) {
+		return body
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+	elideJSONValue(v)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return body
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+func elideJSONValue(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if blob, ok := e.(map[string]any); ok && k == "inlineData" {
+				if s, ok := blob["data"].(string); ok {
+					n := base64.StdEncoding.DecodedLen(len(s))
+					if d, err := base64.StdEncoding.DecodeString(s); err == nil {
+						n = len(d)
+					}
+					blob["data"] = elidedBlobData(n)
+				}
+				continue
+			}
+			elideJSONValue(e)
+		}
+	case []any:
+		for _, e := range v {
+			elideJSONValue(e)
+		}
+	}
+}
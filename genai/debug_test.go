@@ -0,0 +1,58 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWithElidedBlobs(t *testing.T) {
+	m := (&Client{}).GenerativeModel("m")
+	data := []byte(strings.Repeat("pixel", 100))
+	req, err := m.newGenerateContentRequest(
+		NewUserContent(Text("compare"), ImageData("png", data)),
+		&Content{Role: "model", Parts: []Part{Text("ok")}},
+		NewUserContent(PDFData(data[:10])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := proto.Clone(req)
+	// prototext varies its whitespace, so normalize it.
+	got := strings.Join(strings.Fields(prototext.Format(withElidedBlobs(req))), " ")
+	for _, want := range []string{`data: "<500 bytes elided>"`, `data: "<10 bytes elided>"`, `mime_type: "image/png"`, `text: "compare"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("dump does not contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "pixelpixel") {
+		t.Errorf("dump contains the data:\n%s", got)
+	}
+	if !proto.Equal(req, orig) {
+		t.Error("request was modified")
+	}
+
+	// Without Blobs, the message is returned as is.
+	req2, err := m.newGenerateContentRequest(NewUserContent(Text("hi")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withElidedBlobs(req2) != proto.Message(req2) {
+		t.Error("message without Blobs was copied")
+	}
+}
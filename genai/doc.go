@@ -25,8 +25,43 @@
 // You will need an API key to use the service.
 // See the [setup tutorial] for details.
 //
+// To connect through a network that requires a custom certificate authority,
+// pass a TLS configuration along with the API key:
+//
+//	pool, err := x509.SystemCertPool()
+//	...
+//	pool.AppendCertsFromPEM(corporateCAPEM)
+//	client, err := genai.NewClient(ctx,
+//		option.WithAPIKey(os.Getenv("GEMINI_API_KEY")),
+//		genai.WithTLSConfig(&tls.Config{RootCAs: pool}))
+//
+// # Data residency
+//
+// The Gemini API is served from a single global endpoint; it has no regional
+// endpoints, so this client cannot keep requests or data in a particular
+// region. Applications with data residency requirements should use Gemini
+// through Vertex AI, whose endpoints are regional, with the
+// cloud.google.com/go/vertexai/genai package.
+//
+// # Tracing HTTP requests
+//
+// The client honors an [net/http/httptrace.ClientTrace] attached to the context
+// passed to its methods. Use it to observe the timing of DNS lookups, connections,
+// TLS handshakes and the first response byte of each request:
+//
+//	trace := &httptrace.ClientTrace{
+//		GotFirstResponseByte: func() { log.Print("first byte") },
+//	}
+//	ctx = httptrace.WithClientTrace(ctx, trace)
+//	resp, err := model.GenerateContent(ctx, genai.Text("..."))
+//
 // # Errors
 //
+// Errors from the service can be compared with the sentinel errors of this package,
+// like [ErrNotFound] and [ErrResourceExhausted], using [errors.Is].
+// Use [ErrorDetails] to obtain the structured details of an error, like its reason
+// and any quota violations.
+//
 // [examples]: https://pkg.go.dev/github.com/google/generative-ai-go/genai#pkg-examples
 // [setup tutorial]: https://ai.google.dev/tutorials/setup
 package genai
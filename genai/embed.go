@@ -16,6 +16,8 @@ package genai
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
 )
@@ -38,6 +40,15 @@ type EmbeddingModel struct {
 	fullName string
 	// TaskType describes how the embedding will be used.
 	TaskType TaskType
+
+	// StreamConcurrency is the maximum number of requests that
+	// [EmbeddingModel.EmbedContentStream] has in progress at once.
+	// If it is zero or less, requests are made one at a time.
+	StreamConcurrency int
+	// If StreamOrdered is true, [EmbeddingModel.EmbedContentStream] delivers
+	// results in the order of its input. Otherwise, results are delivered
+	// as soon as they are available.
+	StreamOrdered bool
 }
 
 // Name returns the name of the EmbeddingModel.
@@ -55,10 +66,17 @@ func (m *EmbeddingModel) EmbedContent(ctx context.Context, parts ...Part) (*Embe
 // the task type is set to TaskTypeRetrievalDocument.
 func (m *EmbeddingModel) EmbedContentWithTitle(ctx context.Context, title string, parts ...Part) (*EmbedContentResponse, error) {
 	req := newEmbedContentRequest(m.fullName, m.TaskType, title, parts)
-	res, err := m.c.gc.EmbedContent(ctx, req)
-	if err != nil {
+	if err := m.c.rl.wait(ctx, 1); err != nil {
 		return nil, err
 	}
+	ctx, span := m.c.startSpan(ctx, "EmbedContent", attrModel.String(m.fullName))
+	start := time.Now()
+	res, err := m.c.gc.EmbedContent(m.c.callContext(ctx), req)
+	m.c.recordCall(ctx, "EmbedContent", m.fullName, start, nil, err)
+	endSpan(span, nil, FinishReasonUnspecified, err)
+	if err != nil {
+		return nil, addRequestID(ctx, m.c.addRequestBody(wrapError(err), req))
+	}
 	return (EmbedContentResponse{}).fromProto(res), nil
 }
 
@@ -113,13 +131,115 @@ func (b *EmbeddingBatch) AddContentWithTitle(title string, parts ...Part) *Embed
 
 // BatchEmbedContents returns the embeddings for all the contents in the batch.
 func (m *EmbeddingModel) BatchEmbedContents(ctx context.Context, b *EmbeddingBatch) (*BatchEmbedContentsResponse, error) {
-	res, err := m.c.gc.BatchEmbedContents(ctx, b.req)
-	if err != nil {
+	// Each request in the batch counts against the quota.
+	if err := m.c.rl.wait(ctx, len(b.req.Requests)); err != nil {
 		return nil, err
 	}
+	ctx, span := m.c.startSpan(ctx, "BatchEmbedContents", attrModel.String(m.fullName))
+	start := time.Now()
+	res, err := m.c.gc.BatchEmbedContents(m.c.callContext(ctx), b.req)
+	m.c.recordCall(ctx, "BatchEmbedContents", m.fullName, start, nil, err)
+	endSpan(span, nil, FinishReasonUnspecified, err)
+	if err != nil {
+		return nil, addRequestID(ctx, m.c.addRequestBody(wrapError(err), b.req))
+	}
 	return (BatchEmbedContentsResponse{}).fromProto(res), nil
 }
 
+// An EmbedResult is the result of embedding one input of [EmbeddingModel.EmbedContentStream].
+type EmbedResult struct {
+	// The position of the input in the stream, starting at zero.
+	Index int
+	// The response, if Err is nil.
+	Response *EmbedContentResponse
+	// The error from the call, if any.
+	Err error
+}
+
+// EmbedContentStream computes an embedding for each list of parts received
+// from in, and sends the results on the returned channel. Up to
+// m.StreamConcurrency requests are in progress at once; set m.StreamOrdered
+// to receive the results in the same order as the inputs.
+//
+// The returned channel is closed after in is closed and all results have been
+// delivered, or when ctx is done. The caller must receive from the returned
+// channel until it is closed, or cancel ctx.
+func (m *EmbeddingModel) EmbedContentStream(ctx context.Context, in <-chan []Part) <-chan EmbedResult {
+	n := m.StreamConcurrency
+	if n <= 0 {
+		n = 1
+	}
+	out := make(chan EmbedResult)
+	// send delivers r, unless ctx is done first.
+	send := func(r EmbedResult) {
+		select {
+		case out <- r:
+		case <-ctx.Done():
+		}
+	}
+	go func() {
+		defer close(out)
+		sem := make(chan struct{}, n)
+		var wg sync.WaitGroup
+		// If the results are ordered, queue holds a channel for each result,
+		// in input order, and a separate goroutine delivers them.
+		var queue chan chan EmbedResult
+		delivered := make(chan struct{})
+		if m.StreamOrdered {
+			queue = make(chan chan EmbedResult, n)
+			go func() {
+				defer close(delivered)
+				for rc := range queue {
+					send(<-rc)
+				}
+			}()
+		} else {
+			close(delivered)
+		}
+	loop:
+		for i := 0; ; i++ {
+			var parts []Part
+			select {
+			case p, ok := <-in:
+				if !ok {
+					break loop
+				}
+				parts = p
+			case <-ctx.Done():
+				break loop
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break loop
+			}
+			var rc chan EmbedResult
+			if queue != nil {
+				rc = make(chan EmbedResult, 1)
+				queue <- rc
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				res, err := m.EmbedContent(ctx, parts...)
+				r := EmbedResult{Index: i, Response: res, Err: err}
+				if rc != nil {
+					rc <- r
+				} else {
+					send(r)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if queue != nil {
+			close(queue)
+		}
+		<-delivered
+	}()
+	return out
+}
+
 // Info returns information about the model.
 func (m *EmbeddingModel) Info(ctx context.Context) (*ModelInfo, error) {
 	return m.c.modelInfo(ctx, m.fullName)
@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEmbedHandler serves EmbedContent requests whose text is an integer,
+// returning that integer as the single value of the embedding.
+// Smaller integers take longer, so results complete out of order.
+type fakeEmbedHandler struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (h *fakeEmbedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.inFlight++
+	h.maxInFlight = max(h.maxInFlight, h.inFlight)
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.inFlight--
+		h.mu.Unlock()
+	}()
+
+	var req struct {
+		Content struct {
+			Parts []struct{ Text string }
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := strconv.Atoi(req.Content.Parts[0].Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	time.Sleep(time.Duration(10-n%10) * time.Millisecond)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"embedding": {"values": [%d]}}`, n)
+}
+
+func TestEmbedContentStream(t *testing.T) {
+	const (
+		ninputs     = 20
+		concurrency = 3
+	)
+	for _, ordered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ordered=%t", ordered), func(t *testing.T) {
+			h := &fakeEmbedHandler{}
+			em := newFakeClient(t, h).EmbeddingModel("m")
+			em.StreamConcurrency = concurrency
+			em.StreamOrdered = ordered
+
+			in := make(chan []Part)
+			go func() {
+				defer close(in)
+				for i := 0; i < ninputs; i++ {
+					in <- []Part{Text(strconv.Itoa(i))}
+				}
+			}()
+			seen := map[int]bool{}
+			var indexes []int
+			for r := range em.EmbedContentStream(context.Background(), in) {
+				if r.Err != nil {
+					t.Fatal(r.Err)
+				}
+				if got := r.Response.Embedding.Values; len(got) != 1 || int(got[0]) != r.Index {
+					t.Errorf("#%d: got values %v", r.Index, got)
+				}
+				seen[r.Index] = true
+				indexes = append(indexes, r.Index)
+			}
+			if len(seen) != ninputs {
+				t.Errorf("got %d distinct results, want %d", len(seen), ninputs)
+			}
+			if ordered {
+				for i, idx := range indexes {
+					if idx != i {
+						t.Fatalf("result %d has index %d", i, idx)
+					}
+				}
+			}
+			if h.maxInFlight > concurrency {
+				t.Errorf("%d requests in flight, want at most %d", h.maxInFlight, concurrency)
+			}
+		})
+	}
+}
+
+func TestEmbedContentStreamCancel(t *testing.T) {
+	em := newFakeClient(t, &fakeEmbedHandler{}).EmbeddingModel("m")
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan []Part) // never closed
+	out := em.EmbedContentStream(ctx, in)
+	in <- []Part{Text("1")}
+	if r := <-out; r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	cancel()
+	// The output channel is closed, even though the input is still open.
+	for range out {
+	}
+}
@@ -0,0 +1,404 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Errors returned by the service can be compared to these values with [errors.Is].
+// For example:
+//
+//	if errors.Is(err, genai.ErrResourceExhausted) {
+//		// wait, then retry
+//	}
+//
+// The original error is still available with [errors.As].
+var (
+	ErrInvalidArgument   = errors.New("genai: invalid argument")
+	ErrUnauthenticated   = errors.New("genai: unauthenticated")
+	ErrPermissionDenied  = errors.New("genai: permission denied")
+	ErrNotFound          = errors.New("genai: not found")
+	ErrAlreadyExists     = errors.New("genai: already exists")
+	ErrResourceExhausted = errors.New("genai: resource exhausted")
+	ErrInternal          = errors.New("genai: internal error")
+	ErrUnavailable       = errors.New("genai: unavailable")
+	ErrDeadlineExceeded  = errors.New("genai: deadline exceeded")
+)
+
+var httpStatusErrors = map[int]error{
+	http.StatusBadRequest:          ErrInvalidArgument,
+	http.StatusUnauthorized:        ErrUnauthenticated,
+	http.StatusForbidden:           ErrPermissionDenied,
+	http.StatusNotFound:            ErrNotFound,
+	http.StatusConflict:            ErrAlreadyExists,
+	http.StatusTooManyRequests:     ErrResourceExhausted,
+	http.StatusInternalServerError: ErrInternal,
+	http.StatusServiceUnavailable:  ErrUnavailable,
+	http.StatusGatewayTimeout:      ErrDeadlineExceeded,
+}
+
+var grpcCodeErrors = map[codes.Code]error{
+	codes.InvalidArgument:   ErrInvalidArgument,
+	codes.Unauthenticated:   ErrUnauthenticated,
+	codes.PermissionDenied:  ErrPermissionDenied,
+	codes.NotFound:          ErrNotFound,
+	codes.AlreadyExists:     ErrAlreadyExists,
+	codes.ResourceExhausted: ErrResourceExhausted,
+	codes.Internal:          ErrInternal,
+	codes.Unavailable:       ErrUnavailable,
+	codes.DeadlineExceeded:  ErrDeadlineExceeded,
+}
+
+// statusError is an error from the service that also matches one of the
+// sentinel errors above.
+type statusError struct {
+	err      error
+	sentinel error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+
+func (e *statusError) Unwrap() []error { return []error{e.err, e.sentinel} }
+
+// wrapError returns err wrapped so that it matches the sentinel error for its
+// status, if it has one. Otherwise it returns err unchanged.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if s := sentinelFor(err); s != nil {
+		return &statusError{err: err, sentinel: s}
+	}
+	return err
+}
+
+func sentinelFor(err error) error {
+	var ae *apierror.APIError
+	if errors.As(err, &ae) {
+		if c := ae.HTTPCode(); c > 0 {
+			return httpStatusErrors[c]
+		}
+		if s := ae.GRPCStatus(); s != nil {
+			return grpcCodeErrors[s.Code()]
+		}
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return httpStatusErrors[gerr.Code]
+	}
+	return nil
+}
+
+// Details holds the structured details of an error returned by the service.
+type Details struct {
+	// The reason for the error, like "API_KEY_INVALID" or "CONSUMER_SUSPENDED".
+	Reason string
+	// The logical grouping to which the reason belongs, typically the name of the service.
+	Domain string
+	// Additional information about the error.
+	Metadata map[string]string
+	// The quota checks that failed, if the error is due to exhausted quota.
+	QuotaViolations []QuotaViolation
+	// If non-zero, how long the service suggests waiting before retrying.
+	RetryDelay time.Duration
+}
+
+// A QuotaViolation describes a single quota check that failed.
+type QuotaViolation struct {
+	// The subject on which the quota check failed, like "project:123".
+	Subject string
+	// A description of how the quota check failed.
+	Description string
+}
+
+// ErrorDetails returns the structured details of err, which should come from a call to the service.
+// It returns nil if err does not have any details.
+func ErrorDetails(err error) *Details {
+	var ae *apierror.APIError
+	if !errors.As(err, &ae) {
+		var ok bool
+		ae, ok = apierror.ParseError(err, false)
+		if !ok {
+			return nil
+		}
+	}
+	d := &Details{
+		Reason:   ae.Reason(),
+		Domain:   ae.Domain(),
+		Metadata: ae.Metadata(),
+	}
+	ed := ae.Details()
+	if qf := ed.QuotaFailure; qf != nil {
+		for _, v := range qf.GetViolations() {
+			d.QuotaViolations = append(d.QuotaViolations, QuotaViolation{
+				Subject:     v.GetSubject(),
+				Description: v.GetDescription(),
+			})
+		}
+	}
+	if ri := ed.RetryInfo; ri != nil && ri.GetRetryDelay() != nil {
+		d.RetryDelay = ri.GetRetryDelay().AsDuration()
+	}
+	return d
+}
+
+// WithRequestBodyInErrors returns an option that attaches the body of a
+// failed request to the error returned by the call, to help diagnose why
+// the service rejected it. Retrieve the body with [RequestBody]; it also
+// appears in the error message. Any occurrence of the client's API key
+// in the body is redacted.
+//
+// The data of inline Blobs, such as images, is replaced by a note of its
+// size, like "<1024 bytes elided>", to keep the body readable; use
+// [WithInlineDataInRequestBodies] to keep it.
+//
+// The option applies to calls that generate content, count tokens, compute
+// embeddings and create cached contents. It is intended for debugging:
+// request bodies can be large, and may contain sensitive data.
+func WithRequestBodyInErrors() option.ClientOption {
+	return &requestBodyInErrors{}
+}
+
+type requestBodyInErrors struct {
+	internaloption.EmbeddableAdapter
+}
+
+// WithInlineDataInRequestBodies returns an option that keeps the data of
+// inline Blobs in the request bodies attached to errors by
+// [WithRequestBodyInErrors], instead of eliding it.
+func WithInlineDataInRequestBodies() option.ClientOption {
+	return &inlineDataInRequestBodies{}
+}
+
+type inlineDataInRequestBodies struct {
+	internaloption.EmbeddableAdapter
+}
+
+// requestBodyError is an error that carries the body of the request that caused it.
+type requestBodyError struct {
+	err  error
+	body string
+}
+
+func (e *requestBodyError) Error() string {
+	return fmt.Sprintf("%v\nrequest body: %s", e.err, e.body)
+}
+
+func (e *requestBodyError) Unwrap() error { return e.err }
+
+// RequestBody returns the body of the request that caused err, if the client
+// was created with [WithRequestBodyInErrors]. Otherwise it returns the empty string.
+func RequestBody(err error) string {
+	var rerr *requestBodyError
+	if errors.As(err, &rerr) {
+		return rerr.body
+	}
+	return ""
+}
+
+// addRequestBody returns err with the JSON encoding of req attached, if the
+// client was configured to do so. Otherwise it returns err unchanged.
+func (c *Client) addRequestBody(err error, req proto.Message) error {
+	if err == nil || !c.requestBodyInErrors {
+		return err
+	}
+	b, merr := protojson.Marshal(req)
+	if merr != nil {
+		return err
+	}
+	if !c.inlineDataInRequestBodies {
+		b = elideBlobsInJSON(b)
+	}
+	body := string(b)
+	if c.apiKey != "" {
+		body = strings.ReplaceAll(body, c.apiKey, "REDACTED")
+	}
+	return &requestBodyError{err: err, body: body}
+}
+
+// Errors for common reasons that the service rejects the contents of a
+// request. They are recognized from the service's error message, so they
+// are matched on a best-effort basis. Compare errors to them with [errors.Is].
+var (
+	ErrUnsupportedMIMEType = errors.New("genai: unsupported MIME type")
+	ErrTooManyTokens       = errors.New("genai: input exceeds the token limit")
+)
+
+// contentErrorReasons maps lower-case fragments of error messages to the
+// errors above.
+var contentErrorReasons = []struct {
+	fragment string
+	err      error
+}{
+	{"unsupported mime type", ErrUnsupportedMIMEType},
+	{"mime type is not supported", ErrUnsupportedMIMEType},
+	{"exceeds the maximum number of tokens", ErrTooManyTokens},
+	{"input token count exceeds", ErrTooManyTokens},
+}
+
+// A CountTokensError is returned by [GenerativeModel.CountTokens] and
+// [GenerativeModel.CountTokensForContents] when the service rejects the
+// request. Besides the service's error, it holds the contents that were
+// sent and, if the service identified it, the part that it rejected.
+//
+// A CountTokensError matches [ErrUnsupportedMIMEType] or [ErrTooManyTokens]
+// with [errors.Is] when the service's message gives that reason, as well as
+// the sentinel errors for its status, like [ErrInvalidArgument].
+type CountTokensError struct {
+	// The contents of the request.
+	Contents []*Content
+	// The indexes of the rejected part in Contents and in its Parts,
+	// or -1 if the service did not identify a part.
+	ContentIndex, PartIndex int
+	// The error from the service.
+	Err error
+
+	reason error // one of the errors for content reasons, or nil
+}
+
+func (e *CountTokensError) Error() string {
+	if p := e.Part(); p != nil {
+		return fmt.Sprintf("genai.CountTokens: contents[%d].parts[%d] (%T): %v", e.ContentIndex, e.PartIndex, p, e.Err)
+	}
+	return fmt.Sprintf("genai.CountTokens: %v", e.Err)
+}
+
+func (e *CountTokensError) Unwrap() []error {
+	if e.reason != nil {
+		return []error{e.Err, e.reason}
+	}
+	return []error{e.Err}
+}
+
+// Part returns the part that the service rejected, or nil if it is not known.
+func (e *CountTokensError) Part() Part {
+	if e.ContentIndex < 0 || e.ContentIndex >= len(e.Contents) {
+		return nil
+	}
+	c := e.Contents[e.ContentIndex]
+	if c == nil || e.PartIndex < 0 || e.PartIndex >= len(c.Parts) {
+		return nil
+	}
+	return c.Parts[e.PartIndex]
+}
+
+// partPathRE matches the path of a part in an error message, like
+// "contents[0].parts[1]".
+var partPathRE = regexp.MustCompile(`contents\[(\d+)\]\.parts\[(\d+)\]`)
+
+// newCountTokensError returns a CountTokensError for err, the error from a
+// request with contents.
+func newCountTokensError(err error, contents []*Content) *CountTokensError {
+	e := &CountTokensError{Contents: contents, ContentIndex: -1, PartIndex: -1, Err: err}
+	msg := err.Error()
+	if m := partPathRE.FindStringSubmatch(msg); m != nil {
+		ci, cerr := strconv.Atoi(m[1])
+		pi, perr := strconv.Atoi(m[2])
+		if cerr == nil && perr == nil {
+			e.ContentIndex, e.PartIndex = ci, pi
+		}
+	}
+	lmsg := strings.ToLower(msg)
+	for _, r := range contentErrorReasons {
+		if strings.Contains(lmsg, r.fragment) {
+			e.reason = r.err
+			break
+		}
+	}
+	return e
+}
+
+// schemaTooLargeFragments are lower-case fragments of the messages with which
+// the service rejects a schema that is too large or complex to serve.
+var schemaTooLargeFragments = []string{
+	"too many states",
+	"schema is too large",
+	"schema is too complex",
+	"schema has too many",
+}
+
+// A SchemaTooLargeError is returned by calls that generate content when the
+// service rejects the request because its schemas are too large or complex.
+// The limit applies to the response schema and the parameters of the function
+// declarations together, and depends on the structure of the schemas as well
+// as their size. Reduce it by shortening property names and descriptions,
+// flattening nested objects, and removing enums and optional properties.
+//
+// A SchemaTooLargeError also matches the sentinel errors for its status,
+// like [ErrInvalidArgument].
+type SchemaTooLargeError struct {
+	// The size in bytes of the JSON encoding of all the schemas in the request.
+	Size int
+	// The error from the service.
+	Err error
+}
+
+func (e *SchemaTooLargeError) Error() string {
+	return fmt.Sprintf("genai: the service rejected the schemas of the request (%d bytes of JSON) as too large or complex: %v", e.Size, e.Err)
+}
+
+func (e *SchemaTooLargeError) Unwrap() error { return e.Err }
+
+// wrapSchemaError returns err as a SchemaTooLargeError if it is the service's
+// rejection of the schemas in req. Otherwise it returns err unchanged.
+func wrapSchemaError(err error, req *pb.GenerateContentRequest) error {
+	if err == nil {
+		return nil
+	}
+	msg := strings.ToLower(err.Error())
+	if !slices.ContainsFunc(schemaTooLargeFragments, func(f string) bool { return strings.Contains(msg, f) }) {
+		return err
+	}
+	return &SchemaTooLargeError{Size: schemaSize(req), Err: err}
+}
+
+// schemaSize returns the total size of the JSON encodings of the schemas in req.
+func schemaSize(req *pb.GenerateContentRequest) int {
+	var schemas []*pb.Schema
+	if gc := req.GetGenerationConfig(); gc.GetResponseSchema() != nil {
+		schemas = append(schemas, gc.GetResponseSchema())
+	}
+	for _, t := range req.GetTools() {
+		for _, fd := range t.GetFunctionDeclarations() {
+			if fd.GetParameters() != nil {
+				schemas = append(schemas, fd.GetParameters())
+			}
+		}
+	}
+	n := 0
+	for _, s := range schemas {
+		if b, err := protojson.Marshal(s); err == nil {
+			n += len(b)
+		}
+	}
+	return n
+}
@@ -0,0 +1,307 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestWrapError(t *testing.T) {
+	for _, test := range []struct {
+		code int
+		want error
+	}{
+		{http.StatusBadRequest, ErrInvalidArgument},
+		{http.StatusUnauthorized, ErrUnauthenticated},
+		{http.StatusForbidden, ErrPermissionDenied},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusConflict, ErrAlreadyExists},
+		{http.StatusTooManyRequests, ErrResourceExhausted},
+		{http.StatusInternalServerError, ErrInternal},
+		{http.StatusServiceUnavailable, ErrUnavailable},
+		{http.StatusGatewayTimeout, ErrDeadlineExceeded},
+	} {
+		gerr := &googleapi.Error{Code: test.code, Message: "msg"}
+		// The REST clients return an *apierror.APIError wrapping the *googleapi.Error.
+		ae, ok := apierror.FromError(gerr)
+		if !ok {
+			t.Fatal("apierror.FromError failed")
+		}
+		for _, err := range []error{gerr, ae, fmt.Errorf("wrapped: %w", ae)} {
+			got := wrapError(err)
+			if !errors.Is(got, test.want) {
+				t.Errorf("%d, %T: does not match %v", test.code, err, test.want)
+			}
+			if got.Error() != err.Error() {
+				t.Errorf("%d: message changed from %q to %q", test.code, err.Error(), got.Error())
+			}
+			var g *googleapi.Error
+			if !errors.As(got, &g) || g.Code != test.code {
+				t.Errorf("%d: lost the *googleapi.Error", test.code)
+			}
+		}
+	}
+
+	// gRPC errors, from the cache client.
+	ae, ok := apierror.FromError(status.Error(codes.NotFound, "no cache"))
+	if !ok {
+		t.Fatal("apierror.FromError failed")
+	}
+	if err := wrapError(ae); !errors.Is(err, ErrNotFound) {
+		t.Errorf("gRPC NotFound: got %v, want match with ErrNotFound", err)
+	}
+
+	// Other errors are unchanged.
+	for _, err := range []error{nil, iterator.Done, errors.New("x"), &googleapi.Error{Code: http.StatusTeapot}} {
+		if got := wrapError(err); got != err {
+			t.Errorf("%v: got %v, want unchanged", err, got)
+		}
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	// The error format v2 for Google JSON REST APIs, per https://cloud.google.com/apis/design/errors#http_mapping.
+	jsonErrStr := "{\"error\":{\"details\":[{\"@type\":\"type.googleapis.com/google.rpc.ErrorInfo\", \"reason\":\"just because\", \"domain\":\"tests\"}]}}"
+	gerr := &googleapi.Error{Code: http.StatusForbidden, Body: jsonErrStr}
+	want := &Details{Reason: "just because", Domain: "tests"}
+	ae, _ := apierror.FromError(gerr)
+	for _, err := range []error{gerr, ae, wrapError(ae)} {
+		if got := ErrorDetails(err); !cmp.Equal(got, want) {
+			t.Errorf("%T: got %+v, want %+v", err, got, want)
+		}
+	}
+
+	jsonErrStr = `{"error": {"details": [
+		{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "CONSUMER_SUSPENDED",
+		 "domain": "googleapis.com", "metadata": {"consumer": "projects/123"}},
+		{"@type": "type.googleapis.com/google.rpc.QuotaFailure",
+		 "violations": [{"subject": "project:123", "description": "too many requests"}]},
+		{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "30s"}
+	]}}`
+	got := ErrorDetails(&googleapi.Error{Code: http.StatusTooManyRequests, Body: jsonErrStr})
+	want = &Details{
+		Reason:          "CONSUMER_SUSPENDED",
+		Domain:          "googleapis.com",
+		Metadata:        map[string]string{"consumer": "projects/123"},
+		QuotaViolations: []QuotaViolation{{Subject: "project:123", Description: "too many requests"}},
+		RetryDelay:      30 * time.Second,
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if got := ErrorDetails(errors.New("x")); got != nil {
+		t.Errorf("got %+v, want nil", got)
+	}
+}
+
+func TestRequestBodyInErrors(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": {"code": 400, "message": "bad schema", "status": "INVALID_ARGUMENT"}}`)
+	})
+	ctx := context.Background()
+	// newFakeClient uses "fake" as the API key.
+	prompt := Text("my key is fake")
+
+	model := newFakeClient(t, h).GenerativeModel("m")
+	_, err := model.GenerateContent(ctx, prompt)
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	if got := RequestBody(err); got != "" {
+		t.Errorf("without option: got body %q, want empty", got)
+	}
+
+	model = newFakeClient(t, h, WithRequestBodyInErrors()).GenerativeModel("m")
+	model.SetTemperature(0.5)
+	_, err = model.GenerateContent(ctx, prompt)
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("got %v, want match with ErrInvalidArgument", err)
+	}
+	body := RequestBody(err)
+	for _, want := range []string{`"temperature":0.5`, "my key is REDACTED"} {
+		if !strings.Contains(strings.ReplaceAll(body, " ", ""), strings.ReplaceAll(want, " ", "")) {
+			t.Errorf("body %q does not contain %q", body, want)
+		}
+	}
+	if strings.Contains(body, "fake") {
+		t.Errorf("body %q contains the API key", body)
+	}
+	if !strings.Contains(err.Error(), body) {
+		t.Errorf("error message %q does not contain the body", err.Error())
+	}
+}
+
+func TestCountTokensError(t *testing.T) {
+	var message string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": {"code": 400, "message": %q, "status": "INVALID_ARGUMENT"}}`, message)
+	})
+	ctx := context.Background()
+	model := newFakeClient(t, h).GenerativeModel("m")
+	bad := Blob{MIMEType: "application/x-foo", Data: []byte("data")}
+
+	message = "* GenerateContentRequest.contents[0].parts[1].inline_data.mime_type: Unsupported MIME type: application/x-foo"
+	_, err := model.CountTokens(ctx, Text("describe"), bad)
+	var cterr *CountTokensError
+	if !errors.As(err, &cterr) {
+		t.Fatalf("got %v (%[1]T), want CountTokensError", err)
+	}
+	if got, want := cterr.Part(), Part(bad); !cmp.Equal(got, want) {
+		t.Errorf("got part %v, want %v", got, want)
+	}
+	if cterr.ContentIndex != 0 || cterr.PartIndex != 1 {
+		t.Errorf("got indexes %d, %d, want 0, 1", cterr.ContentIndex, cterr.PartIndex)
+	}
+	for _, target := range []error{ErrUnsupportedMIMEType, ErrInvalidArgument} {
+		if !errors.Is(err, target) {
+			t.Errorf("error does not match %v", target)
+		}
+	}
+	if errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("error matches %v", ErrTooManyTokens)
+	}
+	if !strings.Contains(err.Error(), "contents[0].parts[1] (genai.Blob)") {
+		t.Errorf("error message does not describe the part: %v", err)
+	}
+
+	// An error that does not identify a part or a known reason.
+	message = "Request contains an invalid argument."
+	_, err = model.CountTokensForContents(ctx, NewUserContent(Text("hi")))
+	if !errors.As(err, &cterr) {
+		t.Fatalf("got %v (%[1]T), want CountTokensError", err)
+	}
+	if cterr.Part() != nil || cterr.ContentIndex != -1 {
+		t.Errorf("got part %v at %d, want none", cterr.Part(), cterr.ContentIndex)
+	}
+	if len(cterr.Contents) != 1 {
+		t.Errorf("got %d contents, want 1", len(cterr.Contents))
+	}
+	if errors.Is(err, ErrUnsupportedMIMEType) || errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("error matches a content reason: %v", err)
+	}
+
+	message = "The input token count (2000000) exceeds the maximum number of tokens allowed (1048576)."
+	if _, err := model.CountTokens(ctx, Text("long")); !errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("got %v, want ErrTooManyTokens", err)
+	}
+}
+
+func TestRequestBodyElidesInlineData(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": {"code": 400, "message": "bad image", "status": "INVALID_ARGUMENT"}}`)
+	})
+	ctx := context.Background()
+	data := bytes.Repeat([]byte{0xff, 0xd8}, 1000)
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	model := newFakeClient(t, h, WithRequestBodyInErrors()).GenerativeModel("m")
+	_, err := model.GenerateContent(ctx, Text("describe"), ImageData("jpeg", data))
+	body := RequestBody(err)
+	if strings.Contains(body, encoded) {
+		t.Error("body contains the image data")
+	}
+	for _, want := range []string{`"data":"<2000 bytes elided>"`, `"mimeType":"image/jpeg"`, `"text":"describe"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body %q does not contain %q", body, want)
+		}
+	}
+
+	model = newFakeClient(t, h, WithRequestBodyInErrors(), WithInlineDataInRequestBodies()).GenerativeModel("m")
+	_, err = model.GenerateContent(ctx, ImageData("jpeg", data))
+	if body := RequestBody(err); !strings.Contains(body, encoded) {
+		t.Errorf("with WithInlineDataInRequestBodies: body %q does not contain the image data", body)
+	}
+}
+
+func TestSchemaTooLargeError(t *testing.T) {
+	const message = "The specified schema produces a constraint that has too many states for serving. " +
+		"Typical causes of this error are schemas with lots of text (for example, very long property or enum names)."
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error": {"code": 400, "message": %q, "status": "INVALID_ARGUMENT"}}`, message)
+	})
+	ctx := context.Background()
+	model := newFakeClient(t, h).GenerativeModel("m")
+	model.ResponseMIMEType = "application/json"
+	model.ResponseSchema = &Schema{Type: TypeArray, Items: &Schema{Type: TypeString, Enum: []string{"a", "b"}}}
+	params := &Schema{Type: TypeObject, Properties: map[string]*Schema{"x": {Type: TypeInteger}}}
+	model.Tools = []*Tool{{FunctionDeclarations: []*FunctionDeclaration{{Name: "f", Parameters: params}, {Name: "g"}}}}
+
+	var wantSize int
+	for _, s := range []*Schema{model.ResponseSchema, params} {
+		b, err := protojson.Marshal(s.toProto())
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantSize += len(b)
+	}
+
+	check := func(err error) {
+		t.Helper()
+		var serr *SchemaTooLargeError
+		if !errors.As(err, &serr) {
+			t.Fatalf("got %v (%[1]T), want SchemaTooLargeError", err)
+		}
+		if serr.Size != wantSize {
+			t.Errorf("got size %d, want %d", serr.Size, wantSize)
+		}
+		if !errors.Is(err, ErrInvalidArgument) {
+			t.Error("error does not match ErrInvalidArgument")
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("(%d bytes of JSON)", wantSize)) {
+			t.Errorf("error message does not give the size: %v", err)
+		}
+	}
+	_, err := model.GenerateContent(ctx, Text("hi"))
+	check(err)
+	_, err = model.GenerateContentStream(ctx, Text("hi")).Next()
+	check(err)
+
+	// Other errors are not affected.
+	h2 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": {"code": 400, "message": "Request contains an invalid argument.", "status": "INVALID_ARGUMENT"}}`)
+	})
+	_, err = newFakeClient(t, h2).GenerativeModel("m").GenerateContent(ctx, Text("hi"))
+	var serr *SchemaTooLargeError
+	if errors.As(err, &serr) {
+		t.Errorf("got SchemaTooLargeError for %v", err)
+	}
+}
@@ -17,14 +17,23 @@ package genai
 //go:generate ../devtools/generate_discovery_client.sh
 
 import (
+	"container/list"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	gl "cloud.google.com/go/ai/generativelanguage/apiv1beta"
 	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
 	gld "github.com/google/generative-ai-go/genai/internal/generativelanguage/v1beta" // discovery client
+	"github.com/googleapis/gax-go/v2"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
@@ -41,6 +50,21 @@ type UploadFileOptions struct {
 	//
 	// [this page]: https://ai.google.dev/gemini-api/docs/document-processing?lang=go#technical-details
 	MIMEType string
+
+	// The size, in bytes, of each chunk of a resumable upload. It is rounded
+	// up to a multiple of 256 KiB. A larger chunk size means fewer requests;
+	// a smaller one means less data to send again if a request fails.
+	// If zero, the default of 16 MiB is used.
+	ChunkSize int
+
+	// If positive, the maximum number of times to retry sending a chunk of a
+	// resumable upload after a transient failure, such as a network error or
+	// a 5xx status. If zero, a chunk is retried for up to 32 seconds.
+	MaxChunkRetries int
+
+	// The backoff between retries of a chunk, if MaxChunkRetries is positive.
+	// If nil, the backoff starts at 100 milliseconds.
+	ChunkRetryBackoff *gax.Backoff
 }
 
 // UploadFile copies the contents of the given io.Reader to file storage associated
@@ -57,7 +81,25 @@ type UploadFileOptions struct {
 // Use the returned file's URI field with a [FileData] Part to use it for generation.
 //
 // It is an error to upload a file that already exists.
-func (c *Client) UploadFile(ctx context.Context, name string, r io.Reader, opts *UploadFileOptions) (*File, error) {
+//
+// To avoid uploading a file twice when a call is repeated, pass a context
+// created with [WithIdempotencyKey].
+//
+// If a large upload fails partway, the error is an [UploadInterruptedError],
+// and the upload can be continued with [Client.ResumeUpload].
+func (c *Client) UploadFile(ctx context.Context, name string, r io.Reader, opts *UploadFileOptions) (_ *File, err error) {
+	ctx, span := c.startSpan(ctx, "UploadFile", attrFileName.String(name))
+	defer func() { endSpan(span, nil, FinishReasonUnspecified, err) }()
+	pf, err := idempotent(ctx, &c.ic, "UploadFile", func() (*pb.File, error) {
+		return c.uploadFile(ctx, name, r, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return (File{}).fromProto(pf), nil
+}
+
+func (c *Client) uploadFile(ctx context.Context, name string, r io.Reader, opts *UploadFileOptions) (*pb.File, error) {
 	if name != "" {
 		name = userNameToServiceName(name)
 	}
@@ -67,21 +109,34 @@ func (c *Client) UploadFile(ctx context.Context, name string, r io.Reader, opts
 	if opts != nil && opts.DisplayName != "" {
 		req.File.DisplayName = opts.DisplayName
 	}
-	call := c.ds.Media.Upload(req)
+	sess := &uploadSession{}
+	if opts != nil {
+		sess.maxChunkRetries = opts.MaxChunkRetries
+		sess.chunkRetryBackoff = opts.ChunkRetryBackoff
+	}
+	call := c.ds.Media.Upload(req).Context(context.WithValue(c.callContext(ctx), uploadSessionKey{}, sess))
 	var mopts []googleapi.MediaOption
 	if opts != nil && opts.MIMEType != "" {
 		mopts = append(mopts, googleapi.ContentType(opts.MIMEType))
 	}
+	if opts != nil && opts.ChunkSize > 0 {
+		mopts = append(mopts, googleapi.ChunkSize(opts.ChunkSize))
+	}
 	call.Media(r, mopts...)
+	// The progress updater must be set after the media.
+	call.ProgressUpdater(func(current, _ int64) { sess.offset = current })
 	res, err := call.Do()
 	if err != nil {
-		return nil, err
+		if sess.url != "" {
+			return nil, &UploadInterruptedError{URL: sess.url, Offset: sess.offset, Err: wrapError(err)}
+		}
+		return nil, wrapError(err)
 	}
 	// Don't return the result, because it contains a file as represented by the
 	// discovery client and we'd have to write code to convert it to this package's
 	// File type.
 	// Instead, make a GetFile call to get the proto file, which our generated code can convert.
-	return c.GetFile(ctx, res.File.Name)
+	return c.getFile(ctx, res.File.Name)
 }
 
 // UploadFileFromPath is a convenience method wrapping [UploadFile]. It takes
@@ -97,23 +152,171 @@ func (c *Client) UploadFileFromPath(ctx context.Context, path string, opts *Uplo
 	return c.UploadFile(ctx, "", osf, opts)
 }
 
+// PartsFromDirOptions are options for [Client.PartsFromDir].
+type PartsFromDirOptions struct {
+	// Files of at most this many bytes are sent inline, as Blobs. Larger
+	// files are uploaded, and referred to with FileData parts. If zero, the
+	// limit is 1 MiB. If negative, all files are uploaded.
+	MaxInlineSize int64
+
+	// If non-nil, Skipped is called with the path and MIME type of each file
+	// that is skipped because Gemini models do not support its MIME type.
+	// Otherwise, such files are skipped silently.
+	Skipped func(path, mimeType string)
+}
+
+const defaultMaxInlineSize = 1 << 20
+
+// PartsFromDir returns a Part for each regular file in dir, in order by
+// filename, for passing to [GenerativeModel.GenerateContent]. Small files
+// are included inline; others are uploaded as with [Client.UploadFileFromPath].
+// Subdirectories are ignored, as are files whose MIME type is not supported
+// (see [GenerativeModel.SupportsMIME]).
+//
+// The MIME type of a file is determined from its extension or, if that is
+// not known, from its contents. Uploaded videos may need processing before
+// they can be used; see [Client.WaitForFile]. If PartsFromDir fails, it
+// deletes the files that it uploaded.
+func (c *Client) PartsFromDir(ctx context.Context, dir string, opts *PartsFromDirOptions) (_ []Part, err error) {
+	var o PartsFromDirOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.MaxInlineSize == 0 {
+		o.MaxInlineSize = defaultMaxInlineSize
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var uploaded []string
+	defer func() {
+		if err != nil {
+			for _, name := range uploaded {
+				_ = c.DeleteFile(ctx, name)
+			}
+		}
+	}()
+	var parts []Part
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		mimeType, err := fileMIMEType(path)
+		if err != nil {
+			return nil, err
+		}
+		if !supportedMIMETypes[mimeType] {
+			if o.Skipped != nil {
+				o.Skipped(path, mimeType)
+			}
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		if o.MaxInlineSize > 0 && info.Size() <= o.MaxInlineSize {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, Blob{MIMEType: mimeType, Data: data})
+			continue
+		}
+		f, err := c.UploadFileFromPath(ctx, path, &UploadFileOptions{DisplayName: e.Name(), MIMEType: mimeType})
+		if err != nil {
+			return nil, fmt.Errorf("genai.PartsFromDir: uploading %s: %w", path, err)
+		}
+		uploaded = append(uploaded, f.Name)
+		parts = append(parts, FileData{MIMEType: mimeType, URI: f.URI})
+	}
+	return parts, nil
+}
+
+// extensionMIMETypes holds the MIME types, in the form that the service
+// expects, of file extensions that the mime package may not know or may
+// map to a different name.
+var extensionMIMETypes = map[string]string{
+	".txt":  "text/plain",
+	".md":   "text/markdown",
+	".csv":  "text/csv",
+	".py":   "text/x-python",
+	".rtf":  "text/rtf",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".wav":  "audio/wav",
+	".mp3":  "audio/mp3",
+	".aif":  "audio/aiff",
+	".aiff": "audio/aiff",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".flac": "audio/flac",
+	".mov":  "video/mov",
+	".avi":  "video/avi",
+	".mpg":  "video/mpg",
+	".wmv":  "video/wmv",
+	".3gp":  "video/3gpp",
+}
+
+// fileMIMEType returns the MIME type of the file at path, without parameters.
+func fileMIMEType(path string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	mt := extensionMIMETypes[ext]
+	if mt == "" {
+		mt = mime.TypeByExtension(ext)
+	}
+	if mt == "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		buf := make([]byte, 512)
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		mt = http.DetectContentType(buf[:n])
+	}
+	if t, _, err := mime.ParseMediaType(mt); err == nil {
+		mt = t
+	}
+	return mt, nil
+}
+
 // GetFile returns the named file.
 func (c *Client) GetFile(ctx context.Context, name string) (*File, error) {
-	req := &pb.GetFileRequest{Name: userNameToServiceName(name)}
-	debugPrint(req)
-	pf, err := c.fc.GetFile(ctx, req)
+	pf, err := c.getFile(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 	return (File{}).fromProto(pf), nil
 }
 
+func (c *Client) getFile(ctx context.Context, name string) (*pb.File, error) {
+	req := &pb.GetFileRequest{Name: userNameToServiceName(name)}
+	debugPrint(req)
+	ctx, span := c.startSpan(ctx, "GetFile", attrFileName.String(req.Name))
+	pf, err := c.fc.GetFile(c.callContext(ctx), req)
+	endSpan(span, nil, FinishReasonUnspecified, err)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	c.fileMIMETypes.add(pf)
+	return pf, nil
+}
+
 // DeleteFile deletes the file with the given name.
 // It is an error to delete a file that does not exist.
 func (c *Client) DeleteFile(ctx context.Context, name string) error {
 	req := &pb.DeleteFileRequest{Name: userNameToServiceName(name)}
 	debugPrint(req)
-	return c.fc.DeleteFile(ctx, req)
+	ctx, span := c.startSpan(ctx, "DeleteFile", attrFileName.String(req.Name))
+	err := c.fc.DeleteFile(c.callContext(ctx), req)
+	endSpan(span, nil, FinishReasonUnspecified, err)
+	return wrapError(err)
 }
 
 // userNameToServiceName converts a name supplied by the user to a name required by the service.
@@ -127,13 +330,15 @@ func userNameToServiceName(name string) string {
 // ListFiles returns an iterator over the uploaded files.
 func (c *Client) ListFiles(ctx context.Context) *FileIterator {
 	return &FileIterator{
-		it: c.fc.ListFiles(ctx, &pb.ListFilesRequest{}),
+		it: c.fc.ListFiles(c.callContext(ctx), &pb.ListFilesRequest{}),
+		c:  c,
 	}
 }
 
 // A FileIterator iterates over Files.
 type FileIterator struct {
 	it *gl.FileIterator
+	c  *Client
 }
 
 // Next returns the next result. Its second return value is iterator.Done if there are no more
@@ -141,8 +346,9 @@ type FileIterator struct {
 func (it *FileIterator) Next() (*File, error) {
 	m, err := it.it.Next()
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
+	it.c.fileMIMETypes.add(m)
 	return (File{}).fromProto(m), nil
 }
 
@@ -151,6 +357,192 @@ func (it *FileIterator) PageInfo() *iterator.PageInfo {
 	return it.it.PageInfo()
 }
 
+// fileWaitInterval is how long WaitForFile waits between calls to GetFile.
+var fileWaitInterval = 5 * time.Second
+
+// WaitForFile waits until the named file is no longer being processed,
+// calling [Client.GetFile] periodically, and returns it. Files such as videos
+// must be processed before they can be used in a request. It returns an error
+// if processing fails, or if ctx is done first.
+func (c *Client) WaitForFile(ctx context.Context, name string) (*File, error) {
+	for {
+		f, err := c.GetFile(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		switch f.State {
+		case FileStateProcessing:
+		case FileStateFailed:
+			return f, fmt.Errorf("genai.WaitForFile: processing of %s failed", f.Name)
+		default:
+			return f, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(fileWaitInterval):
+		}
+	}
+}
+
+// A FileNotActiveError is returned when a request fails because it refers to
+// an uploaded file that is not active, usually because the service has not
+// finished processing it. Use [Client.WaitForFile] to wait for processing to
+// finish.
+type FileNotActiveError struct {
+	// The file, as returned by GetFile.
+	File *File
+	// The error returned by the service for the request.
+	Err error
+}
+
+func (e *FileNotActiveError) Error() string {
+	return fmt.Sprintf("genai: file %s is not active (state %s); wait for it with Client.WaitForFile: %v",
+		e.File.Name, e.File.State, e.Err)
+}
+
+func (e *FileNotActiveError) Unwrap() error { return e.Err }
+
+// checkFilesActive returns a FileNotActiveError wrapping err if err reports an
+// invalid argument and one of the uploaded files referred to by contents is not
+// active. Otherwise, it returns err.
+func (c *Client) checkFilesActive(ctx context.Context, contents []*Content, err error) error {
+	if !errors.Is(err, ErrInvalidArgument) {
+		return err
+	}
+	for _, content := range contents {
+		if content == nil {
+			continue
+		}
+		for _, p := range content.Parts {
+			fd, ok := p.(FileData)
+			if !ok {
+				continue
+			}
+			name := fileNameFromURI(fd.URI)
+			if name == "" {
+				continue
+			}
+			f, gerr := c.GetFile(ctx, name)
+			if gerr != nil {
+				continue
+			}
+			if f.State != FileStateActive {
+				return &FileNotActiveError{File: f, Err: err}
+			}
+		}
+	}
+	return err
+}
+
+// fileNameFromURI returns the name of the uploaded file with the given URI,
+// like "files/abc", or the empty string if the URI does not refer to one.
+func fileNameFromURI(uri string) string {
+	i := strings.LastIndex(uri, "/files/")
+	if i < 0 {
+		return ""
+	}
+	name := uri[i+1:]
+	if strings.Count(name, "/") != 1 || strings.HasSuffix(name, "/") {
+		return ""
+	}
+	return name
+}
+
+// maxMIMETypeCacheSize is the number of files whose MIME types a client remembers.
+const maxMIMETypeCacheSize = 1000
+
+// A mimeTypeCache remembers the MIME types of the files most recently seen
+// by the client, keyed by URI. It is an LRU cache of at most
+// maxMIMETypeCacheSize entries. The zero value is ready to use, and a nil
+// *mimeTypeCache remembers nothing.
+type mimeTypeCache struct {
+	mu    sync.Mutex
+	order *list.List               // of *mimeTypeEntry, most recently used first
+	items map[string]*list.Element // by URI
+}
+
+type mimeTypeEntry struct {
+	uri, mimeType string
+}
+
+func (c *mimeTypeCache) add(f *pb.File) {
+	if f.Uri == "" || f.MimeType == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.order = list.New()
+		c.items = map[string]*list.Element{}
+	}
+	e := &mimeTypeEntry{uri: f.Uri, mimeType: f.MimeType}
+	if el, ok := c.items[f.Uri]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[f.Uri] = c.order.PushFront(e)
+	if c.order.Len() > maxMIMETypeCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*mimeTypeEntry).uri)
+	}
+}
+
+func (c *mimeTypeCache) get(uri string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[uri]
+	if !ok {
+		return ""
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*mimeTypeEntry).mimeType
+}
+
+// fillFileDataMIMETypes sets the MIME type of each FileData part in contents
+// that lacks one, if the file was uploaded, retrieved or listed recently by
+// this client.
+func (c *mimeTypeCache) fillFileDataMIMETypes(contents []*pb.Content) {
+	for _, content := range contents {
+		for _, part := range content.GetParts() {
+			if fd := part.GetFileData(); fd != nil && fd.MimeType == "" {
+				fd.MimeType = c.get(fd.FileUri)
+			}
+		}
+	}
+}
+
+// fillFileDataMIMETypes sets the MIME type of each FileData part in contents
+// that lacks one. Types the client does not remember are looked up with
+// GetFile. It is an error if the lookup fails. Parts whose URIs do not refer
+// to uploaded files are left for the service to handle.
+func (c *Client) fillFileDataMIMETypes(ctx context.Context, contents []*pb.Content) error {
+	c.fileMIMETypes.fillFileDataMIMETypes(contents)
+	for _, content := range contents {
+		for _, part := range content.GetParts() {
+			fd := part.GetFileData()
+			if fd == nil || fd.MimeType != "" {
+				continue
+			}
+			name := fileNameFromURI(fd.FileUri)
+			if name == "" {
+				continue
+			}
+			f, err := c.GetFile(ctx, name)
+			if err != nil {
+				return fmt.Errorf("genai: unknown MIME type for FileData with URI %q; set its MIMEType field: %w", fd.FileUri, err)
+			}
+			fd.MimeType = f.MIMEType
+		}
+	}
+	return nil
+}
+
 // FileMetadata holds metadata about a file.
 type FileMetadata struct {
 	// Set if the file contains video.
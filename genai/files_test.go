@@ -15,12 +15,25 @@
 package genai
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/option"
 	"google.golang.org/protobuf/types/known/durationpb"
 	// google.golang.org/protobuf/proto
 )
@@ -59,3 +72,431 @@ func TestPopulateFile(t *testing.T) {
 		}
 	}
 }
+
+func TestFillFileDataMIMETypes(t *testing.T) {
+	client := &Client{}
+	client.fileMIMETypes.add(&pb.File{Uri: "https://files/a", MimeType: "video/mp4"})
+	client.fileMIMETypes.add(&pb.File{Uri: "https://files/b"}) // no MIME type; ignored
+
+	m := &GenerativeModel{c: client, fullName: "models/m"}
+	req, err := m.newGenerateContentRequest(NewUserContent(
+		FileData{URI: "https://files/a"},
+		FileData{URI: "https://files/a", MIMEType: "text/plain"},
+		FileData{URI: "https://files/unknown", MIMEType: "image/png"},
+		Text("describe these"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range req.Contents[0].Parts {
+		if fd := p.GetFileData(); fd != nil {
+			got = append(got, fd.MimeType)
+		}
+	}
+	want := []string{"video/mp4", "text/plain", "image/png"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// A FileData without a MIME type that the client doesn't know is sent
+	// unchanged, with or without a client.
+	for _, m := range []*GenerativeModel{m, {fullName: "models/m"}} {
+		req, err := m.newGenerateContentRequest(NewUserContent(FileData{URI: "https://files/b"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Contents[0].Parts[0].GetFileData().MimeType; got != "" {
+			t.Errorf("got MIME type %q, want none", got)
+		}
+	}
+}
+
+func TestFillFileDataMIMETypesLookup(t *testing.T) {
+	var gets int
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1beta/files/other":
+			// Uploaded by another client.
+			gets++
+			fmt.Fprint(w, `{"name": "files/other", "uri": "https://example.com/v1beta/files/other", "mimeType": "video/mp4"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		contents := []*pb.Content{NewUserContent(
+			FileData{URI: "https://example.com/v1beta/files/other"},
+			FileData{URI: "https://example.com/cat.jpg"},
+		).toProto()}
+		if err := client.fillFileDataMIMETypes(ctx, contents); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, p := range contents[0].Parts {
+			got = append(got, p.GetFileData().MimeType)
+		}
+		// A URI that does not refer to an uploaded file is left unchanged.
+		if want := []string{"video/mp4", ""}; !cmp.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if gets != 1 {
+		t.Errorf("got %d GetFile calls, want 1", gets)
+	}
+
+	// A failed lookup is an error.
+	uri := "https://example.com/v1beta/files/missing"
+	err := client.fillFileDataMIMETypes(ctx, []*pb.Content{NewUserContent(FileData{URI: uri}).toProto()})
+	if err == nil || !strings.Contains(err.Error(), uri) {
+		t.Errorf("got %v, want an error naming the URI", err)
+	}
+}
+
+func TestMIMETypeCacheBounded(t *testing.T) {
+	var c mimeTypeCache
+	uri := func(i int) string { return fmt.Sprintf("https://files/%d", i) }
+	for i := 0; i <= maxMIMETypeCacheSize; i++ {
+		if i == maxMIMETypeCacheSize {
+			// Use the first file, so the second is the least recently used.
+			c.get(uri(0))
+		}
+		c.add(&pb.File{Uri: uri(i), MimeType: "text/plain"})
+	}
+	if got := len(c.items); got != maxMIMETypeCacheSize {
+		t.Errorf("got %d entries, want %d", got, maxMIMETypeCacheSize)
+	}
+	if c.get(uri(0)) == "" || c.get(uri(1)) != "" || c.get(uri(maxMIMETypeCacheSize)) == "" {
+		t.Error("wrong entry evicted")
+	}
+}
+
+func TestUploadFileChunkSize(t *testing.T) {
+	const chunkSize = 256 * 1024
+	data := bytes.Repeat([]byte("x"), 2*chunkSize+100)
+	var chunkSizes []int
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/upload/v1beta/files":
+			// Start of a resumable upload.
+			w.Header().Set("Location", "http://"+r.Host+"/session")
+		case r.URL.Path == "/session":
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			chunkSizes = append(chunkSizes, len(body))
+			if strings.HasSuffix(r.Header.Get("Content-Range"), "/*") {
+				// More chunks to come.
+				w.Header().Set("X-Http-Status-Code-Override", "308")
+				return
+			}
+			fmt.Fprint(w, `{"file": {"name": "files/f"}}`)
+		case r.URL.Path == "/v1beta/files/f":
+			fmt.Fprint(w, `{"name": "files/f", "mimeType": "text/plain"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	f, err := client.UploadFile(context.Background(), "", bytes.NewReader(data), &UploadFileOptions{ChunkSize: chunkSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "files/f" {
+		t.Errorf("got name %q, want %q", f.Name, "files/f")
+	}
+	want := []int{chunkSize, chunkSize, 100}
+	if !cmp.Equal(chunkSizes, want) {
+		t.Errorf("got chunk sizes %v, want %v", chunkSizes, want)
+	}
+}
+
+func TestCountTokensFileNotActive(t *testing.T) {
+	defer func(d time.Duration) { fileWaitInterval = d }(fileWaitInterval)
+	fileWaitInterval = time.Millisecond
+
+	gets := 0
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1beta/models/m:countTokens":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"code": 400, "message": "File is not in an ACTIVE state", "status": "FAILED_PRECONDITION"}}`)
+		case "/v1beta/files/v":
+			// The file is active after the third call.
+			gets++
+			state := "PROCESSING"
+			if gets >= 3 {
+				state = "ACTIVE"
+			}
+			fmt.Fprintf(w, `{"name": "files/v", "mimeType": "video/mp4", "state": %q}`, state)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ctx := context.Background()
+	model := client.GenerativeModel("m")
+	_, err := model.CountTokens(ctx, FileData{URI: "https://generativelanguage.googleapis.com/v1beta/files/v", MIMEType: "video/mp4"}, Text("describe"))
+	var fnae *FileNotActiveError
+	if !errors.As(err, &fnae) {
+		t.Fatalf("got %v, want a FileNotActiveError", err)
+	}
+	if fnae.File.Name != "files/v" || fnae.File.State != FileStateProcessing {
+		t.Errorf("got file %s in state %s, want files/v in state FileStateProcessing", fnae.File.Name, fnae.File.State)
+	}
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("got %v, want it to wrap the service's error", err)
+	}
+
+	f, err := client.WaitForFile(ctx, "files/v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.State != FileStateActive || gets != 3 {
+		t.Errorf("got state %s after %d calls, want FileStateActive after 3", f.State, gets)
+	}
+
+	// Errors unrelated to files are unchanged.
+	_, err = model.CountTokens(ctx, Text("describe"))
+	if errors.As(err, &fnae) || !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("without files: got %v", err)
+	}
+}
+
+func TestFileNameFromURI(t *testing.T) {
+	for _, test := range []struct {
+		uri, want string
+	}{
+		{"https://generativelanguage.googleapis.com/v1beta/files/abc", "files/abc"},
+		{"https://example.com/video.mp4", ""},
+		{"https://example.com/files/", ""},
+		{"https://example.com/files/a/b", ""},
+	} {
+		if got := fileNameFromURI(test.uri); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.uri, got, test.want)
+		}
+	}
+}
+
+// flakyChunkTransport fails each chunk of an upload a number of times,
+// alternating between a network error and a 503, before sending it.
+type flakyChunkTransport struct {
+	failures int
+	attempts map[string]int // by Content-Range
+}
+
+func (t *flakyChunkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cr := req.Header.Get("Content-Range"); cr != "" {
+		t.attempts[cr]++
+		if n := t.attempts[cr]; n <= t.failures {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			if n%2 == 1 {
+				return nil, errors.New("connection reset")
+			}
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Status:     "503 Service Unavailable",
+				Body:       io.NopCloser(strings.NewReader("unavailable")),
+				Header:     http.Header{},
+				Request:    req,
+			}, nil
+		}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestUploadFileChunkRetries(t *testing.T) {
+	const chunkSize = 256 * 1024
+	data := bytes.Repeat([]byte("x"), chunkSize+100)
+	var received int
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/upload/v1beta/files":
+			w.Header().Set("Location", "http://"+r.Host+"/session")
+		case "/session":
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			received += len(body)
+			if strings.HasSuffix(r.Header.Get("Content-Range"), "/*") {
+				w.Header().Set("X-Http-Status-Code-Override", "308")
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+				return
+			}
+			fmt.Fprint(w, `{"file": {"name": "files/f"}}`)
+		case "/v1beta/files/f":
+			fmt.Fprint(w, `{"name": "files/f"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	opts := func(retries int) *UploadFileOptions {
+		return &UploadFileOptions{
+			ChunkSize:         chunkSize,
+			MaxChunkRetries:   retries,
+			ChunkRetryBackoff: &gax.Backoff{Initial: time.Millisecond},
+		}
+	}
+	ctx := context.Background()
+
+	// Each chunk fails three times, then succeeds.
+	ft := &flakyChunkTransport{failures: 3, attempts: map[string]int{}}
+	client := newFakeClient(t, h, option.WithHTTPClient(&http.Client{Transport: ft}))
+	if _, err := client.UploadFile(ctx, "", bytes.NewReader(data), opts(3)); err != nil {
+		t.Fatal(err)
+	}
+	if received != len(data) {
+		t.Errorf("received %d bytes, want %d", received, len(data))
+	}
+	if len(ft.attempts) != 2 {
+		t.Errorf("got %d chunks, want 2", len(ft.attempts))
+	}
+	for cr, n := range ft.attempts {
+		if n != 4 {
+			t.Errorf("%s: got %d attempts, want 4", cr, n)
+		}
+	}
+
+	// With too few retries, the upload is interrupted after the retries of the
+	// first chunk, without further retries.
+	received = 0
+	ft = &flakyChunkTransport{failures: 3, attempts: map[string]int{}}
+	client = newFakeClient(t, h, option.WithHTTPClient(&http.Client{Transport: ft}))
+	_, err := client.UploadFile(ctx, "", bytes.NewReader(data), opts(2))
+	var uie *UploadInterruptedError
+	if !errors.As(err, &uie) {
+		t.Fatalf("got %v, want UploadInterruptedError", err)
+	}
+	if len(ft.attempts) != 1 {
+		t.Errorf("got %d chunks, want 1", len(ft.attempts))
+	}
+	for cr, n := range ft.attempts {
+		if n != 3 {
+			t.Errorf("%s: got %d attempts, want 3", cr, n)
+		}
+	}
+
+	// ResumeUpload uses the same options.
+	ft.failures = 1
+	ft.attempts = map[string]int{}
+	if _, err := client.ResumeUpload(ctx, uie.URL, uie.Offset, bytes.NewReader(data[uie.Offset:]), opts(1)); err != nil {
+		t.Fatal(err)
+	}
+	if received != len(data) {
+		t.Errorf("after resuming, received %d bytes, want %d", received, len(data))
+	}
+}
+
+func TestPartsFromDir(t *testing.T) {
+	dir := t.TempDir()
+	png := []byte("\x89PNG\r\n\x1a\n....")
+	for name, data := range map[string][]byte{
+		"a.png":     png,
+		"b.pdf":     bytes.Repeat([]byte("%PDF"), 100),
+		"c":         []byte("plain text notes"),
+		"d.zip":     []byte("PK\x03\x04"),
+		"e.mp3":     bytes.Repeat([]byte{0xff}, 1000),
+		"sub/x.txt": []byte("ignored"),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		uploads     int
+		failUpload  int // fail the upload with this number, if positive
+		deleted     []string
+		uploadTypes []string
+	)
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/upload/v1beta/files":
+			uploads++
+			if uploads == failUpload {
+				http.Error(w, `{"error": {"code": 400, "message": "bad file"}}`, http.StatusBadRequest)
+				return
+			}
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				t.Error(err)
+			}
+			// The media is the second part of the multipart body.
+			mr := multipart.NewReader(r.Body, params["boundary"])
+			for i := 0; i < 2; i++ {
+				p, err := mr.NextPart()
+				if err != nil {
+					t.Fatal(err)
+				}
+				uploadTypes = append(uploadTypes, p.Header.Get("Content-Type"))
+			}
+			fmt.Fprintf(w, `{"file": {"name": "files/f%d"}}`, uploads)
+		case strings.HasPrefix(r.URL.Path, "/v1beta/files/"):
+			name := strings.TrimPrefix(r.URL.Path, "/v1beta/")
+			if r.Method == http.MethodDelete {
+				deleted = append(deleted, name)
+				fmt.Fprint(w, `{}`)
+				return
+			}
+			fmt.Fprintf(w, `{"name": %q, "uri": "https://example.com/%s"}`, name, name)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ctx := context.Background()
+	var skipped []string
+	opts := &PartsFromDirOptions{
+		MaxInlineSize: 100,
+		Skipped:       func(path, mimeType string) { skipped = append(skipped, filepath.Base(path)+" "+mimeType) },
+	}
+	parts, err := client.PartsFromDir(ctx, dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Part{
+		Blob{MIMEType: "image/png", Data: png},
+		FileData{MIMEType: "application/pdf", URI: "https://example.com/files/f1"},
+		Blob{MIMEType: "text/plain", Data: []byte("plain text notes")},
+		FileData{MIMEType: "audio/mp3", URI: "https://example.com/files/f2"},
+	}
+	if !cmp.Equal(parts, want) {
+		t.Errorf("got %v\nwant %v", parts, want)
+	}
+	if want := []string{"d.zip application/zip"}; !cmp.Equal(skipped, want) {
+		t.Errorf("got skipped %q, want %q", skipped, want)
+	}
+	if want := []string{"application/json", "application/pdf", "application/json", "audio/mp3"}; !cmp.Equal(uploadTypes, want) {
+		t.Errorf("got upload content types %q, want %q", uploadTypes, want)
+	}
+
+	// Without a Skipped function, unsupported files are skipped silently.
+	uploads = 0
+	parts, err = client.PartsFromDir(ctx, dir, &PartsFromDirOptions{MaxInlineSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != len(want) {
+		t.Errorf("without Skipped: got %d parts, want %d", len(parts), len(want))
+	}
+
+	// If an upload fails, the files uploaded so far are deleted.
+	uploads, failUpload = 0, 2
+	if _, err := client.PartsFromDir(ctx, dir, opts); err == nil {
+		t.Fatal("got nil, want error")
+	}
+	if want := []string{"files/f1"}; !cmp.Equal(deleted, want) {
+		t.Errorf("got deleted %q, want %q", deleted, want)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package genaitest provides helpers for tests that use the genai package.
+package genaitest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// A Scope tracks the files and cached contents that a test creates, and
+// deletes them when the test finishes, whether it passes or fails:
+//
+//	func TestSummarize(t *testing.T) {
+//		s := genaitest.NewScope(t, client)
+//		f, err := s.UploadFileFromPath(s.Context(), "testdata/report.pdf", nil)
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		// use f; it is deleted when the test finishes
+//	}
+//
+// Resources created in other ways can be tracked with [Scope.TrackFile] and
+// [Scope.TrackCachedContent].
+//
+// The methods of a Scope are safe for concurrent use by multiple goroutines.
+type Scope struct {
+	tb     testing.TB
+	client *genai.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// For testing.
+	deleteFile          func(context.Context, string) error
+	deleteCachedContent func(context.Context, string) error
+
+	mu             sync.Mutex
+	files          []string
+	cachedContents []string
+}
+
+// NewScope returns a Scope that uses client, and registers a cleanup
+// function with tb that cancels the Scope's context and then deletes the
+// resources that the Scope tracks, most recent first. Failures to delete are
+// reported with tb.Errorf; resources that no longer exist are ignored.
+func NewScope(tb testing.TB, client *genai.Client) *Scope {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Scope{
+		tb:                  tb,
+		client:              client,
+		ctx:                 ctx,
+		cancel:              cancel,
+		deleteFile:          client.DeleteFile,
+		deleteCachedContent: client.DeleteCachedContent,
+	}
+	tb.Cleanup(s.cleanup)
+	return s
+}
+
+// Context returns a context that is canceled when the test finishes,
+// before the Scope's resources are deleted. Use it for calls that should not
+// outlive the test.
+func (s *Scope) Context() context.Context {
+	return s.ctx
+}
+
+// UploadFile calls [genai.Client.UploadFile] and tracks the uploaded file.
+func (s *Scope) UploadFile(ctx context.Context, name string, r io.Reader, opts *genai.UploadFileOptions) (*genai.File, error) {
+	f, err := s.client.UploadFile(ctx, name, r, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.TrackFile(f.Name)
+	return f, nil
+}
+
+// UploadFileFromPath calls [genai.Client.UploadFileFromPath] and tracks the
+// uploaded file.
+func (s *Scope) UploadFileFromPath(ctx context.Context, path string, opts *genai.UploadFileOptions) (*genai.File, error) {
+	f, err := s.client.UploadFileFromPath(ctx, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.TrackFile(f.Name)
+	return f, nil
+}
+
+// CreateCachedContent calls [genai.Client.CreateCachedContent] and tracks
+// the created CachedContent.
+func (s *Scope) CreateCachedContent(ctx context.Context, cc *genai.CachedContent) (*genai.CachedContent, error) {
+	cc, err := s.client.CreateCachedContent(ctx, cc)
+	if err != nil {
+		return nil, err
+	}
+	s.TrackCachedContent(cc.Name)
+	return cc, nil
+}
+
+// TrackFile arranges for the file with the given name to be deleted when
+// the test finishes.
+func (s *Scope) TrackFile(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = append(s.files, name)
+}
+
+// TrackCachedContent arranges for the CachedContent with the given name to be
+// deleted when the test finishes.
+func (s *Scope) TrackCachedContent(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cachedContents = append(s.cachedContents, name)
+}
+
+func (s *Scope) cleanup() {
+	s.cancel()
+	s.mu.Lock()
+	files, caches := s.files, s.cachedContents
+	s.files, s.cachedContents = nil, nil
+	s.mu.Unlock()
+
+	// The Scope's context is canceled, so use a new one.
+	ctx := context.Background()
+	// Delete caches first, since they may refer to files.
+	for i := len(caches) - 1; i >= 0; i-- {
+		if err := s.deleteCachedContent(ctx, caches[i]); err != nil && !errors.Is(err, genai.ErrNotFound) {
+			s.tb.Errorf("genaitest: deleting cached content %s: %v", caches[i], err)
+		}
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		if err := s.deleteFile(ctx, files[i]); err != nil && !errors.Is(err, genai.ErrNotFound) {
+			s.tb.Errorf("genaitest: deleting file %s: %v", files[i], err)
+		}
+	}
+}
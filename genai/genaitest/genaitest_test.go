@@ -0,0 +1,146 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genaitest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/option"
+)
+
+// fakeTB records the cleanup functions and errors of a test.
+type fakeTB struct {
+	testing.TB
+	cleanups []func()
+	errors   []string
+}
+
+func (tb *fakeTB) Cleanup(f func()) { tb.cleanups = append(tb.cleanups, f) }
+
+func (tb *fakeTB) Errorf(format string, args ...any) {
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+// finish runs the cleanup functions, as the testing package does.
+func (tb *fakeTB) finish() {
+	for i := len(tb.cleanups) - 1; i >= 0; i-- {
+		tb.cleanups[i]()
+	}
+}
+
+func TestScopeUploadFile(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/upload/v1beta/files":
+			fmt.Fprint(w, `{"file": {"name": "files/a"}}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1beta/files/a":
+			fmt.Fprint(w, `{"name": "files/a"}`)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1beta/files/"):
+			mu.Lock()
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/v1beta/"))
+			mu.Unlock()
+			if r.URL.Path == "/v1beta/files/gone" {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error": {"code": 404, "message": "not found", "status": "NOT_FOUND"}}`)
+				return
+			}
+			fmt.Fprint(w, `{}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	client, err := genai.NewClient(context.Background(),
+		option.WithEndpoint(srv.URL),
+		option.WithHTTPClient(srv.Client()),
+		option.WithAPIKey("fake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tb := &fakeTB{}
+	s := NewScope(tb, client)
+	f, err := s.UploadFile(s.Context(), "", strings.NewReader("data"), &genai.UploadFileOptions{MIMEType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "files/a" {
+		t.Errorf("got name %q, want files/a", f.Name)
+	}
+	s.TrackFile("files/gone") // already deleted; ignored
+	s.TrackFile("files/b")
+	if len(deleted) > 0 {
+		t.Fatalf("deleted %v before the test finished", deleted)
+	}
+
+	tb.finish()
+	if s.Context().Err() == nil {
+		t.Error("context not canceled")
+	}
+	if diff := cmp.Diff([]string{"files/b", "files/gone", "files/a"}, deleted); diff != "" {
+		t.Errorf("deleted mismatch (-want, +got):\n%s", diff)
+	}
+	if len(tb.errors) > 0 {
+		t.Errorf("got errors %q", tb.errors)
+	}
+}
+
+func TestScopeCleanup(t *testing.T) {
+	// The cache client does not use HTTP, so fake the deletions.
+	var deleted []string
+	tb := &fakeTB{}
+	s := NewScope(tb, &genai.Client{})
+	s.deleteFile = func(_ context.Context, name string) error {
+		deleted = append(deleted, name)
+		if name == "files/bad" {
+			return errors.New("permission denied")
+		}
+		return nil
+	}
+	s.deleteCachedContent = func(ctx context.Context, name string) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		deleted = append(deleted, name)
+		return nil
+	}
+	s.TrackFile("files/a")
+	s.TrackCachedContent("cachedContents/c1")
+	s.TrackFile("files/bad")
+	s.TrackCachedContent("cachedContents/c2")
+
+	tb.finish()
+	// Caches are deleted before files, most recent first.
+	want := []string{"cachedContents/c2", "cachedContents/c1", "files/bad", "files/a"}
+	if diff := cmp.Diff(want, deleted); diff != "" {
+		t.Errorf("deleted mismatch (-want, +got):\n%s", diff)
+	}
+	if len(tb.errors) != 1 || !strings.Contains(tb.errors[0], "files/bad") {
+		t.Errorf("got errors %q, want one for files/bad", tb.errors)
+	}
+}
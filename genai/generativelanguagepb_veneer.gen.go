@@ -224,6 +224,10 @@ func (CachedContentUsageMetadata) fromProto(p *pb.CachedContent_UsageMetadata) *
 // Candidate is a response candidate generated from the model.
 type Candidate struct {
 	// Output only. Index of the candidate in the list of candidates.
+	// When streaming with CandidateCount greater than one, each streamed
+	// response may hold chunks of any subset of the candidates, in any order.
+	// Use Index, not the position in Candidates, to tell which candidate a
+	// chunk belongs to.
 	Index int32
 	// Output only. Generated content returned from the model.
 	Content *Content
@@ -344,6 +348,12 @@ func (CitationSource) fromProto(p *pb.CitationSource) *CitationSource {
 //
 // See also `ExecutableCode` and `CodeExecutionResult` which are only generated
 // when using this tool.
+//
+// The tool has no configuration. In particular, the service provides no way
+// to make files, including uploaded ones, available to the code: the code
+// runs in a sandbox that holds only what the model writes. To give the code
+// data, include the data in the prompt, so the model can write it into the
+// code.
 type CodeExecution struct {
 }
 
@@ -1201,6 +1211,10 @@ func (v HarmProbability) String() string {
 }
 
 // ModelInfo is information about a language model.
+//
+// The service does not report the languages or locales that a model
+// supports, so ModelInfo does not include them. Consult the documentation
+// of the model instead.
 type ModelInfo struct {
 	// Required. The resource name of the `Model`.
 	//
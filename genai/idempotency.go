@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+type idempotencyKeyType struct{}
+
+// WithIdempotencyKey returns a context that carries the given idempotency key.
+// Pass it to [Client.UploadFile], [Client.UploadFileFromPath] or
+// [Client.CreateCachedContent] so that repeating a call does not create the
+// resource twice.
+//
+// The service does not support idempotency keys, so they are implemented by
+// the Client: once a call with a key succeeds, later calls of the same method
+// on the same Client with the same key return a copy of the original result
+// without contacting the service. A call with a key that is already in
+// progress waits for the first call to finish.
+//
+// Only calls that succeeded or are still running are remembered. If a call
+// fails, even after the service created the resource, as when the connection
+// drops before the response arrives, a retry with the same key creates
+// another resource.
+//
+// The Client remembers the most recent keys, up to a limit.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyType{}, key)
+}
+
+// maxIdempotencyKeys is the number of idempotency keys a client remembers.
+const maxIdempotencyKeys = 1000
+
+// An idempotencyCache remembers the results of calls made with idempotency
+// keys. It is an LRU cache of at most maxIdempotencyKeys entries.
+type idempotencyCache struct {
+	mu    sync.Mutex
+	order *list.List               // of *idempotentCall, most recently used first
+	calls map[string]*list.Element // by method and key
+}
+
+type idempotentCall struct {
+	key  string
+	done chan struct{} // closed when the call completes
+	ok   bool          // the call succeeded
+	val  any
+}
+
+// get returns the call for key, or nil if there is none.
+// ic.mu must be held.
+func (ic *idempotencyCache) get(key string) *idempotentCall {
+	el, ok := ic.calls[key]
+	if !ok {
+		return nil
+	}
+	ic.order.MoveToFront(el)
+	return el.Value.(*idempotentCall)
+}
+
+// add adds a new call for key, evicting the least recently used call if the
+// cache is full. ic.mu must be held.
+func (ic *idempotencyCache) add(key string) *idempotentCall {
+	if ic.calls == nil {
+		ic.order = list.New()
+		ic.calls = map[string]*list.Element{}
+	}
+	c := &idempotentCall{key: key, done: make(chan struct{})}
+	ic.calls[key] = ic.order.PushFront(c)
+	if ic.order.Len() > maxIdempotencyKeys {
+		oldest := ic.order.Back()
+		ic.order.Remove(oldest)
+		delete(ic.calls, oldest.Value.(*idempotentCall).key)
+	}
+	return c
+}
+
+// remove removes c from the cache, unless it has already been evicted.
+func (ic *idempotencyCache) remove(c *idempotentCall) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if el, ok := ic.calls[c.key]; ok && el.Value == c {
+		ic.order.Remove(el)
+		delete(ic.calls, c.key)
+	}
+}
+
+// idempotent calls f, unless ctx has an idempotency key and a call with the
+// same method and key has already succeeded, in which case it returns the
+// result of that call. Results are shared between callers, so they must not
+// be modified; callers convert them to fresh values.
+func idempotent[T any](ctx context.Context, ic *idempotencyCache, method string, f func() (T, error)) (T, error) {
+	key, _ := ctx.Value(idempotencyKeyType{}).(string)
+	if key == "" {
+		return f()
+	}
+	key = method + "/" + key
+	for {
+		ic.mu.Lock()
+		c := ic.get(key)
+		if c == nil {
+			c = ic.add(key)
+			ic.mu.Unlock()
+			return runIdempotent(ic, c, f)
+		}
+		ic.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			var z T
+			return z, ctx.Err()
+		case <-c.done:
+		}
+		if c.ok {
+			return c.val.(T), nil
+		}
+		// The earlier call failed; try again.
+	}
+}
+
+// runIdempotent calls f for c. If f fails or panics, c is forgotten so that
+// the call can be retried. Either way, callers waiting for c are released.
+func runIdempotent[T any](ic *idempotencyCache, c *idempotentCall, f func() (T, error)) (T, error) {
+	defer func() {
+		if !c.ok {
+			ic.remove(c)
+		}
+		close(c.done)
+	}()
+	v, err := f()
+	if err == nil {
+		c.val, c.ok = v, true
+	}
+	return v, err
+}
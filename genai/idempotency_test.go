@@ -0,0 +1,171 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	gl "cloud.google.com/go/ai/generativelanguage/apiv1beta"
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestIdempotent(t *testing.T) {
+	var ic idempotencyCache
+	ncalls := 0
+	fail := false
+	create := func() (*CachedContent, error) {
+		ncalls++
+		if fail {
+			return nil, errors.New("unavailable")
+		}
+		return &CachedContent{Name: fmt.Sprintf("cachedContents/%d", ncalls)}, nil
+	}
+	call := func(ctx context.Context, method string) (*CachedContent, error) {
+		return idempotent(ctx, &ic, method, create)
+	}
+	ctx := context.Background()
+	ctxA := WithIdempotencyKey(ctx, "a")
+
+	cc1, err := call(ctxA, "Create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A retry with the same key returns the same resource.
+	cc2, err := call(ctxA, "Create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc2 != cc1 || ncalls != 1 {
+		t.Errorf("retry: got %s after %d calls, want %s after 1", cc2.Name, ncalls, cc1.Name)
+	}
+
+	// Without a key, or with a different key or method, the call is made.
+	for _, c := range []struct {
+		ctx    context.Context
+		method string
+	}{
+		{ctx, "Create"},
+		{WithIdempotencyKey(ctx, "b"), "Create"},
+		{ctxA, "Upload"},
+	} {
+		n := ncalls
+		got, err := call(c.ctx, c.method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == cc1 || ncalls != n+1 {
+			t.Errorf("%s: call was not made", c.method)
+		}
+	}
+
+	// Failures are not remembered.
+	ctxC := WithIdempotencyKey(ctx, "c")
+	fail = true
+	if _, err := call(ctxC, "Create"); err == nil {
+		t.Fatal("got nil, want error")
+	}
+	fail = false
+	n := ncalls
+	if _, err := call(ctxC, "Create"); err != nil {
+		t.Fatal(err)
+	}
+	if ncalls != n+1 {
+		t.Error("call after failure was not made")
+	}
+}
+
+func TestIdempotentPanic(t *testing.T) {
+	var ic idempotencyCache
+	ctx := WithIdempotencyKey(context.Background(), "a")
+	func() {
+		defer func() { recover() }()
+		idempotent(ctx, &ic, "Create", func() (int, error) { panic("boom") })
+	}()
+	// The panicking call is forgotten, so the next one is made.
+	got, err := idempotent(ctx, &ic, "Create", func() (int, error) { return 1, nil })
+	if err != nil || got != 1 {
+		t.Errorf("got (%d, %v), want (1, nil)", got, err)
+	}
+}
+
+func TestIdempotencyCacheBounded(t *testing.T) {
+	var ic idempotencyCache
+	ctx := context.Background()
+	ncalls := 0
+	create := func() (int, error) {
+		ncalls++
+		return ncalls, nil
+	}
+	for i := 0; i <= maxIdempotencyKeys; i++ {
+		idempotent(WithIdempotencyKey(ctx, fmt.Sprint(i)), &ic, "Create", create)
+	}
+	if got := len(ic.calls); got != maxIdempotencyKeys {
+		t.Errorf("got %d entries, want %d", got, maxIdempotencyKeys)
+	}
+	// The oldest key was forgotten, so its call is made again.
+	n := ncalls
+	idempotent(WithIdempotencyKey(ctx, "0"), &ic, "Create", create)
+	if ncalls != n+1 {
+		t.Error("call for evicted key was not made")
+	}
+}
+
+type cacheServer struct {
+	pb.UnimplementedCacheServiceServer
+	calls int
+}
+
+func (s *cacheServer) CreateCachedContent(_ context.Context, req *pb.CreateCachedContentRequest) (*pb.CachedContent, error) {
+	s.calls++
+	cc := proto.Clone(req.CachedContent).(*pb.CachedContent)
+	cc.Name = Ptr("cachedContents/c")
+	return cc, nil
+}
+
+func TestCreateCachedContentIdempotentCopies(t *testing.T) {
+	srv := &cacheServer{}
+	client := newFakeClient(t, http.NotFoundHandler())
+	conn := dialGRPCServer(t, func(gs *grpc.Server) { pb.RegisterCacheServiceServer(gs, srv) })
+	cc, err := gl.NewCacheClient(context.Background(), option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	client.cc = cc
+
+	ctx := WithIdempotencyKey(context.Background(), "k")
+	cc1, err := client.CreateCachedContent(ctx, &CachedContent{Model: "m", DisplayName: "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc1.DisplayName = "changed"
+	cc2, err := client.CreateCachedContent(ctx, &CachedContent{Model: "m", DisplayName: "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.calls != 1 {
+		t.Errorf("got %d calls, want 1", srv.calls)
+	}
+	if cc2 == cc1 || cc2.DisplayName != "d" {
+		t.Errorf("got %+v, want an unchanged copy", cc2)
+	}
+}
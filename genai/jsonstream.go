@@ -0,0 +1,251 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// A JSONField is a top-level key of a JSON object and its value.
+type JSONField struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// A JSONStreamParser reports the top-level fields of a JSON object as they
+// are completed, while the object's text is still arriving. Use it to display
+// a streamed JSON response progressively:
+//
+//	var p genai.JSONStreamParser
+//	iter := model.GenerateContentStream(ctx, genai.Text("..."))
+//	for {
+//		resp, err := iter.Next()
+//		if err == iterator.Done {
+//			break
+//		}
+//		// handle err
+//		for _, part := range resp.Candidates[0].Content.Parts {
+//			if t, ok := part.(genai.Text); ok {
+//				fields, err := p.Feed(string(t))
+//				// handle err, display fields
+//			}
+//		}
+//	}
+//
+// Text before the opening brace, such as a Markdown code fence, is ignored,
+// as is any text after the closing brace.
+//
+// The zero value is ready to use. A JSONStreamParser parses a single object.
+type JSONStreamParser struct {
+	buf   []byte
+	pos   int    // start of the unparsed part of buf
+	state int    // one of the js constants below
+	key   string // key of the field whose value is being parsed
+	err   error
+}
+
+const (
+	jsStart      = iota // before the opening brace
+	jsFirstKey          // after the opening brace
+	jsKey               // after a comma
+	jsValue             // after a key and colon
+	jsAfterValue        // after a value
+	jsDone              // after the closing brace
+)
+
+// Feed adds the next piece of text to the parser and returns the fields that
+// the text completed, in order. Values are returned as they appear in the
+// text. Once Feed returns an error, it returns the same error on every call.
+func (p *JSONStreamParser) Feed(text string) ([]JSONField, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	p.buf = append(p.buf, text...)
+	var fields []JSONField
+	for {
+		f, progress, err := p.step()
+		if err != nil {
+			p.err = fmt.Errorf("genai.JSONStreamParser: offset %d: %w", p.pos, err)
+			return fields, p.err
+		}
+		if f != nil {
+			fields = append(fields, *f)
+		}
+		if !progress {
+			break
+		}
+	}
+	// Discard parsed text, which is no longer needed.
+	if p.pos > 0 {
+		p.buf = append(p.buf[:0], p.buf[p.pos:]...)
+		p.pos = 0
+	}
+	return fields, nil
+}
+
+// Done reports whether the parser has seen the end of the object.
+func (p *JSONStreamParser) Done() bool {
+	return p.state == jsDone
+}
+
+// step advances the parser by at most one token. It reports whether it made
+// progress, and returns the field it completed, if any.
+func (p *JSONStreamParser) step() (*JSONField, bool, error) {
+	i := skipSpace(p.buf, p.pos)
+	switch p.state {
+	case jsStart:
+		for ; i < len(p.buf); i++ {
+			if p.buf[i] == '{' {
+				p.pos = i + 1
+				p.state = jsFirstKey
+				return nil, true, nil
+			}
+		}
+		p.pos = len(p.buf)
+		return nil, false, nil
+
+	case jsFirstKey, jsKey:
+		if i == len(p.buf) {
+			return nil, false, nil
+		}
+		if p.buf[i] == '}' && p.state == jsFirstKey {
+			p.pos = i + 1
+			p.state = jsDone
+			return nil, true, nil
+		}
+		if p.buf[i] != '"' {
+			return nil, false, fmt.Errorf("expected object key, got %q", p.buf[i])
+		}
+		n := scanString(p.buf[i:])
+		if n == 0 {
+			return nil, false, nil
+		}
+		end := i + n
+		j := skipSpace(p.buf, end)
+		if j == len(p.buf) {
+			return nil, false, nil
+		}
+		if p.buf[j] != ':' {
+			return nil, false, fmt.Errorf("expected colon after object key, got %q", p.buf[j])
+		}
+		if err := json.Unmarshal(p.buf[i:end], &p.key); err != nil {
+			return nil, false, err
+		}
+		p.pos = j + 1
+		p.state = jsValue
+		return nil, true, nil
+
+	case jsValue:
+		if i == len(p.buf) {
+			return nil, false, nil
+		}
+		n, err := scanValue(p.buf[i:])
+		if err != nil || n == 0 {
+			return nil, false, err
+		}
+		v := p.buf[i : i+n]
+		if !json.Valid(v) {
+			return nil, false, fmt.Errorf("invalid value for key %q: %s", p.key, v)
+		}
+		f := &JSONField{Key: p.key, Value: json.RawMessage(append([]byte(nil), v...))}
+		p.pos = i + n
+		p.state = jsAfterValue
+		return f, true, nil
+
+	case jsAfterValue:
+		if i == len(p.buf) {
+			return nil, false, nil
+		}
+		switch p.buf[i] {
+		case ',':
+			p.state = jsKey
+		case '}':
+			p.state = jsDone
+		default:
+			return nil, false, fmt.Errorf("expected comma or closing brace, got %q", p.buf[i])
+		}
+		p.pos = i + 1
+		return nil, true, nil
+
+	case jsDone:
+		p.pos = len(p.buf)
+		return nil, false, nil
+	}
+	panic("unreachable")
+}
+
+func skipSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\n' || b[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// scanString returns the length of the JSON string at the start of b,
+// including its quotes, or 0 if the string is not yet complete.
+func scanString(b []byte) int {
+	for i := 1; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// scanValue returns the length of the JSON value at the start of b, or 0 if
+// the value is not yet complete. A number or literal is complete only when it
+// is followed by another character, since more digits or letters may follow.
+// The value is not validated.
+func scanValue(b []byte) (int, error) {
+	switch b[0] {
+	case '"':
+		return scanString(b), nil
+	case '{', '[':
+		depth := 0
+		for i := 0; i < len(b); i++ {
+			switch b[i] {
+			case '"':
+				n := scanString(b[i:])
+				if n == 0 {
+					return 0, nil
+				}
+				i += n - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, nil
+				}
+			}
+		}
+		return 0, nil
+	case '}', ']', ',', ':':
+		return 0, errors.New("expected value")
+	default:
+		for i := 0; i < len(b); i++ {
+			switch b[i] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return i, nil
+			}
+		}
+		return 0, nil
+	}
+}
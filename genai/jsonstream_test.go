@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJSONStreamParser(t *testing.T) {
+	const in = "```json\n" + `{
+  "title": "A \"quoted\" {title}",
+  "count": 12,
+  "ratio": -1.5e3,
+  "ok": true,
+  "missing": null,
+  "tags": ["a", "b]", {"c": [1, 2]}],
+  "nested": {"x": {"y": "}"}}
+}` + "\n```"
+	want := []JSONField{
+		{"title", json.RawMessage(`"A \"quoted\" {title}"`)},
+		{"count", json.RawMessage(`12`)},
+		{"ratio", json.RawMessage(`-1.5e3`)},
+		{"ok", json.RawMessage(`true`)},
+		{"missing", json.RawMessage(`null`)},
+		{"tags", json.RawMessage(`["a", "b]", {"c": [1, 2]}]`)},
+		{"nested", json.RawMessage(`{"x": {"y": "}"}}`)},
+	}
+	// Feed the text in chunks of every size.
+	for size := 1; size <= len(in); size++ {
+		var p JSONStreamParser
+		var got []JSONField
+		for i := 0; i < len(in); i += size {
+			fields, err := p.Feed(in[i:min(i+size, len(in))])
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+			got = append(got, fields...)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("size %d: (-want, +got)\n%s", size, diff)
+		}
+		if !p.Done() {
+			t.Errorf("size %d: not done", size)
+		}
+	}
+}
+
+func TestJSONStreamParserProgress(t *testing.T) {
+	var p JSONStreamParser
+	// Each chunk, and the fields it completes.
+	for _, step := range []struct {
+		chunk string
+		want  []string
+	}{
+		{`{"name": "Ga`, nil},
+		{`ndalf", "age": 2`, []string{"name"}},
+		{`019`, nil}, // the number may continue
+		{`, "staff": true`, []string{"age"}},
+		{`}`, []string{"staff"}},
+	} {
+		fields, err := p.Feed(step.chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range fields {
+			got = append(got, f.Key)
+		}
+		if !cmp.Equal(got, step.want) {
+			t.Errorf("after %q: got %q, want %q", step.chunk, got, step.want)
+		}
+		if p.Done() != (step.chunk == "}") {
+			t.Errorf("after %q: Done() = %t", step.chunk, p.Done())
+		}
+	}
+}
+
+func TestJSONStreamParserErrors(t *testing.T) {
+	for _, in := range []string{
+		`{1: 2}`,
+		`{"a" 1}`,
+		`{"a": ]`,
+		`{"a": tru }`,
+		`{"a": [1, }`,
+		`{"a": 1 "b": 2}`,
+		`{"a": 1, }`,
+	} {
+		var p JSONStreamParser
+		if _, err := p.Feed(in); err == nil {
+			t.Errorf("%s: got nil error", in)
+			continue
+		}
+		// The error is sticky.
+		if _, err := p.Feed(`}`); err == nil {
+			t.Errorf("%s: second Feed: got nil error", in)
+		}
+	}
+}
@@ -25,7 +25,7 @@ import (
 
 func (c *Client) ListModels(ctx context.Context) *ModelInfoIterator {
 	return &ModelInfoIterator{
-		it: c.mc.ListModels(ctx, &pb.ListModelsRequest{}),
+		it: c.mc.ListModels(c.callContext(ctx), &pb.ListModelsRequest{}),
 	}
 }
 
@@ -39,7 +39,7 @@ type ModelInfoIterator struct {
 func (it *ModelInfoIterator) Next() (*ModelInfo, error) {
 	m, err := it.it.Next()
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 	return (ModelInfo{}).fromProto(m), nil
 }
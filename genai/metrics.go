@@ -0,0 +1,84 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+)
+
+// WithMetrics returns an option that reports each of the client's calls to
+// generate content, count tokens and compute embeddings to r, so that they
+// can be exported to a metrics system such as Prometheus or OpenTelemetry.
+func WithMetrics(r Recorder) option.ClientOption {
+	return &metricsOption{r: r}
+}
+
+type metricsOption struct {
+	internaloption.EmbeddableAdapter
+	r Recorder
+}
+
+// A Recorder receives metrics about calls to the service.
+// Its methods may be called concurrently.
+type Recorder interface {
+	// RecordCall is called when a call completes, successfully or not.
+	// For a streaming call, that is when the stream ends or fails; a stream
+	// that is abandoned before it ends is not reported.
+	RecordCall(ctx context.Context, m CallMetrics)
+}
+
+// CallMetrics describes a completed call to the service.
+type CallMetrics struct {
+	// The name of the RPC, like "GenerateContent", "StreamGenerateContent",
+	// "CountTokens", "EmbedContent" or "BatchEmbedContents".
+	Method string
+	// The full name of the model, like "models/gemini-1.5-flash".
+	Model string
+	// The time from the start of the call to its completion, including
+	// retries and, for a streaming call, the time taken to read the stream.
+	Latency time.Duration
+	// The token usage reported by the service, or nil if it reported none.
+	Usage *UsageMetadata
+	// The error that the call failed with, or nil if it succeeded.
+	Err error
+	// The HTTP status code of the service's error, or zero if the call
+	// succeeded or failed without a response from the service.
+	HTTPStatus int
+}
+
+// recordCall reports a call to the client's Recorder, if it has one.
+func (c *Client) recordCall(ctx context.Context, method, model string, start time.Time, usage *UsageMetadata, err error) {
+	if c.metrics == nil {
+		return
+	}
+	m := CallMetrics{
+		Method:  method,
+		Model:   model,
+		Latency: time.Since(start),
+		Usage:   usage,
+		Err:     err,
+	}
+	var ae *apierror.APIError
+	if errors.As(err, &ae) {
+		m.HTTPStatus = ae.HTTPCode()
+	}
+	c.metrics.RecordCall(ctx, m)
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"google.golang.org/api/iterator"
+)
+
+type fakeRecorder struct {
+	mu    sync.Mutex
+	calls []CallMetrics
+}
+
+func (r *fakeRecorder) RecordCall(_ context.Context, m CallMetrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, m)
+}
+
+func TestMetrics(t *testing.T) {
+	rec := &fakeRecorder{}
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "missing"):
+			http.Error(w, "no such model", http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, ":countTokens"):
+			fmt.Fprint(w, `{"totalTokens": 3}`)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"candidates": [{"content": {"role": "model", "parts": [{"text": "hi"}]}}],
+				"usageMetadata": {"promptTokenCount": 2, "candidatesTokenCount": 1, "totalTokenCount": 3}}`)
+		}
+	}), WithMetrics(rec))
+	ctx := context.Background()
+
+	if _, err := client.GenerativeModel("m").GenerateContent(ctx, Text("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GenerativeModel("missing").GenerateContent(ctx, Text("hi")); err == nil {
+		t.Fatal("got nil, want error")
+	}
+	if _, err := client.GenerativeModel("m").CountTokens(ctx, Text("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(rec.calls), 3; got != want {
+		t.Fatalf("got %d calls, want %d", got, want)
+	}
+	c := rec.calls[0]
+	if c.Method != "GenerateContent" || c.Model != "models/m" || c.Err != nil || c.HTTPStatus != 0 {
+		t.Errorf("got %+v, want a successful GenerateContent call to models/m", c)
+	}
+	if c.Usage == nil || c.Usage.TotalTokenCount != 3 {
+		t.Errorf("got usage %+v, want 3 total tokens", c.Usage)
+	}
+	if c.Latency <= 0 {
+		t.Errorf("got latency %v, want positive", c.Latency)
+	}
+	c = rec.calls[1]
+	if c.Model != "models/missing" || c.Err == nil || c.HTTPStatus != http.StatusNotFound {
+		t.Errorf("got %+v, want a failed call with status 404", c)
+	}
+	if got, want := rec.calls[2].Method, "CountTokens"; got != want {
+		t.Errorf("got method %q, want %q", got, want)
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"done", io.EOF, false},
+		{"failed", errors.New("broken"), true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var calls []error
+			iter := &GenerateContentResponseIterator{
+				sc: &fakeStreamClient{
+					responses: []*pb.GenerateContentResponse{{
+						Candidates:    []*pb.Candidate{{Content: &pb.Content{Parts: []*pb.Part{{Data: &pb.Part_Text{Text: "hi"}}}}}},
+						UsageMetadata: &pb.GenerateContentResponse_UsageMetadata{TotalTokenCount: 5},
+					}},
+					err: test.err,
+				},
+				recordEnd: func(usage *UsageMetadata, err error) {
+					if usage == nil || usage.TotalTokenCount != 5 {
+						t.Errorf("got usage %+v, want 5 total tokens", usage)
+					}
+					calls = append(calls, err)
+				},
+			}
+			for {
+				_, err := iter.Next()
+				if err != nil {
+					if (err == iterator.Done) == test.wantErr {
+						t.Fatalf("got %v", err)
+					}
+					break
+				}
+			}
+			// A second call to Next does not report the stream again.
+			iter.Next()
+			if len(calls) != 1 {
+				t.Fatalf("got %d reports, want 1", len(calls))
+			}
+			if got := calls[0] != nil; got != test.wantErr {
+				t.Errorf("got error %v, want error: %t", calls[0], test.wantErr)
+			}
+		})
+	}
+}
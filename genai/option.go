@@ -15,8 +15,20 @@
 package genai
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/googleapis/gax-go/v2/callctx"
 	"google.golang.org/api/option"
 	"google.golang.org/api/option/internaloption"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // WithClientInfo sets request information identifying the
@@ -30,6 +42,176 @@ type clientInfo struct {
 	key, value string
 }
 
+// WithQuotaProject returns an option that bills every request made by the
+// client to the given project, by setting the x-goog-user-project header.
+// The caller must have the serviceusage.services.use permission on the project.
+func WithQuotaProject(projectID string) option.ClientOption {
+	return &quotaProject{id: projectID}
+}
+
+type quotaProject struct {
+	internaloption.EmbeddableAdapter
+	id string
+}
+
+// callContext returns a context carrying the headers that the client adds
+// to every request.
+func (c *Client) callContext(ctx context.Context) context.Context {
+	if c.quotaProject != "" {
+		ctx = callctx.SetHeaders(ctx, "x-goog-user-project", c.quotaProject)
+	}
+	if id := requestIDFromContext(ctx); id != "" {
+		ctx = callctx.SetHeaders(ctx, requestIDHeader, id)
+	}
+	return ctx
+}
+
+// requestIDHeader is the header that carries a request ID.
+const requestIDHeader = "x-request-id"
+
+type requestIDKeyType struct{}
+
+// WithRequestID returns a context that carries the given request ID, for
+// tracing a logical request across systems. Calls made with the context send
+// the ID in the x-request-id header of every attempt, including retries, so
+// all the attempts of a call share it. Use [NewRequestID] to generate one.
+//
+// If a call to generate content, count tokens or compute embeddings fails,
+// the error includes the ID; retrieve it with [RequestID].
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKeyType{}, id)
+}
+
+// NewRequestID returns a new random request ID for [WithRequestID].
+func NewRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("genai.NewRequestID: %v", err))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKeyType{}).(string)
+	return id
+}
+
+// requestIDError is an error from a call made with a request ID.
+type requestIDError struct {
+	err error
+	id  string
+}
+
+func (e *requestIDError) Error() string {
+	return fmt.Sprintf("%v (request ID %s)", e.err, e.id)
+}
+
+func (e *requestIDError) Unwrap() error { return e.err }
+
+// RequestID returns the request ID of the call that caused err, if the call
+// was made with a context from [WithRequestID]. Otherwise it returns the
+// empty string.
+func RequestID(err error) string {
+	var rerr *requestIDError
+	if errors.As(err, &rerr) {
+		return rerr.id
+	}
+	return ""
+}
+
+// addRequestID returns err with the request ID of ctx attached, if it has one.
+func addRequestID(ctx context.Context, err error) error {
+	id := requestIDFromContext(ctx)
+	if err == nil || id == "" {
+		return err
+	}
+	return &requestIDError{err: err, id: id}
+}
+
+// WithContentTransformer returns an option that makes the client call f with
+// the contents of every request that generates content or counts tokens, just
+// before the request is sent, and send the contents that f returns instead.
+// Use it for concerns that apply to every request, like redacting personal
+// data or adding a final instruction.
+//
+// For a [ChatSession], f runs after the History and the new message have been
+// assembled, so it sees the whole conversation; the History itself is not
+// changed. f must not modify the Contents it is passed, since they may belong
+// to a History; return new ones instead. f may be called concurrently.
+func WithContentTransformer(f func([]*Content) []*Content) option.ClientOption {
+	return &contentTransformer{f: f}
+}
+
+type contentTransformer struct {
+	internaloption.EmbeddableAdapter
+	f func([]*Content) []*Content
+}
+
+// WithTLSConfig returns an option that makes the client use cfg for its
+// TLS connections, for example to trust a corporate certificate authority
+// by setting cfg.RootCAs.
+//
+// The option must be combined with [option.WithAPIKey], and cannot be combined
+// with [option.WithHTTPClient]. To use a custom HTTP client with an API key,
+// wrap its transport in an [APIKeyTransport].
+func WithTLSConfig(cfg *tls.Config) option.ClientOption {
+	return &tlsConfig{cfg: cfg}
+}
+
+type tlsConfig struct {
+	internaloption.EmbeddableAdapter
+	cfg *tls.Config
+}
+
+// applyTLSConfig returns opts with an option added that makes the HTTP-based
+// clients use cfg for their connections while authenticating with the API key
+// in opts.
+func applyTLSConfig(opts []option.ClientOption, cfg *tls.Config) ([]option.ClientOption, error) {
+	key := apiKeyFromOptions(opts)
+	if key == "" {
+		return nil, errors.New("genai.WithTLSConfig requires option.WithAPIKey")
+	}
+	for _, opt := range opts {
+		if reflect.ValueOf(opt).Type().String() == "option.withHTTPClient" {
+			return nil, errors.New("genai.WithTLSConfig cannot be used with option.WithHTTPClient")
+		}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	hc := &http.Client{Transport: &APIKeyTransport{APIKey: key, Transport: t}}
+	return append(opts, option.WithHTTPClient(hc)), nil
+}
+
+// grpcTLSOption returns an option that makes a gRPC client use cfg for its connections.
+func grpcTLSOption(cfg *tls.Config) option.ClientOption {
+	return option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+}
+
+// APIKeyTransport is an [http.RoundTripper] that adds an API key to each request.
+// Use it to authenticate a custom HTTP client passed to [option.WithHTTPClient],
+// since the client ignores [option.WithAPIKey] in that case:
+//
+//	hc := &http.Client{Transport: &genai.APIKeyTransport{APIKey: key, Transport: myTransport}}
+//	client, err := genai.NewClient(ctx, option.WithHTTPClient(hc))
+type APIKeyTransport struct {
+	// The API key to add to each request.
+	APIKey string
+	// The transport that sends the requests. If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+// RoundTrip implements [http.RoundTripper].
+func (t *APIKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	// A RoundTripper must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set("x-goog-api-key", t.APIKey)
+	return rt.RoundTrip(req)
+}
+
 // optionOfType returns the first value of opts that has type T,
 // along with true. If there is no option of that type, it returns
 // the zero value for T and false.
@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+)
+
+// WithRateLimit returns an option that throttles the client's calls to
+// generate content and compute embeddings so that they stay within the given
+// quotas.
+//
+// requestsPerMinute limits the number of requests sent per minute.
+// tokensPerMinute limits the number of tokens consumed per minute, as reported
+// by the UsageMetadata of each response. Since the number of tokens a request
+// uses is not known until it completes, a request is allowed to proceed as
+// long as some tokens remain; the tokens it uses are deducted afterwards.
+//
+// A value of zero or less disables the corresponding limit.
+func WithRateLimit(requestsPerMinute, tokensPerMinute int) option.ClientOption {
+	return &rateLimit{rpm: requestsPerMinute, tpm: tokensPerMinute}
+}
+
+type rateLimit struct {
+	internaloption.EmbeddableAdapter
+	rpm, tpm int
+}
+
+// A rateLimiter enforces request and token quotas.
+// A nil *rateLimiter imposes no limits.
+type rateLimiter struct {
+	mu       sync.Mutex
+	requests *tokenBucket // nil if requests are unlimited
+	tokens   *tokenBucket // nil if tokens are unlimited
+
+	// For testing.
+	now   func() time.Time
+	sleep func(context.Context, time.Duration) error
+}
+
+// newRateLimiter returns a rateLimiter for the given per-minute quotas,
+// or nil if neither quota is positive.
+func newRateLimiter(rpm, tpm int) *rateLimiter {
+	if rpm <= 0 && tpm <= 0 {
+		return nil
+	}
+	rl := &rateLimiter{now: time.Now, sleep: sleepContext}
+	t := rl.now()
+	if rpm > 0 {
+		rl.requests = newTokenBucket(rpm, t)
+	}
+	if tpm > 0 {
+		rl.tokens = newTokenBucket(tpm, t)
+	}
+	return rl
+}
+
+// wait blocks until n requests may be sent, or ctx is done.
+func (rl *rateLimiter) wait(ctx context.Context, n int) error {
+	if rl == nil {
+		return nil
+	}
+	for {
+		rl.mu.Lock()
+		now := rl.now()
+		d := rl.reserve(now, float64(n))
+		rl.mu.Unlock()
+		if d <= 0 {
+			return nil
+		}
+		if err := rl.sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// reserve takes n requests from the request bucket if the request and token
+// buckets allow it, and returns zero. Otherwise it takes nothing and returns the
+// time to wait before trying again.
+// rl.mu must be held.
+func (rl *rateLimiter) reserve(now time.Time, n float64) time.Duration {
+	var d time.Duration
+	if rl.tokens != nil {
+		// Only require that the token balance be positive.
+		d = max(d, rl.tokens.delay(now, 1))
+	}
+	if rl.requests != nil {
+		d = max(d, rl.requests.delay(now, n))
+	}
+	if d > 0 {
+		return d
+	}
+	if rl.requests != nil {
+		rl.requests.take(n)
+	}
+	return 0
+}
+
+// record deducts the tokens in um from the token bucket.
+func (rl *rateLimiter) record(um *UsageMetadata) {
+	if rl == nil || rl.tokens == nil || um == nil {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.tokens.refill(rl.now())
+	rl.tokens.take(float64(um.TotalTokenCount))
+}
+
+// A tokenBucket holds up to a minute's worth of capacity, and refills continuously.
+// Its level may go negative, in which case it must refill before anything more
+// can be taken.
+type tokenBucket struct {
+	capacity float64
+	level    float64
+	perSec   float64
+	last     time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(perMinute),
+		level:    float64(perMinute),
+		perSec:   float64(perMinute) / 60,
+		last:     now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.level = min(b.capacity, b.level+now.Sub(b.last).Seconds()*b.perSec)
+		b.last = now
+	}
+}
+
+// delay returns how long to wait until n can be taken from the bucket.
+func (b *tokenBucket) delay(now time.Time, n float64) time.Duration {
+	b.refill(now)
+	// Never ask for more than the bucket can hold.
+	n = min(n, b.capacity)
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration((n - b.level) / b.perSec * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	b.level -= n
+}
+
+// sleepContext sleeps for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that advances only when slept on.
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.t = c.t.Add(d)
+	c.slept += d
+	return nil
+}
+
+func newFakeRateLimiter(rpm, tpm int) (*rateLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rl := newRateLimiter(rpm, tpm)
+	rl.now = clock.now
+	rl.sleep = clock.sleep
+	for _, b := range []*tokenBucket{rl.requests, rl.tokens} {
+		if b != nil {
+			b.last = clock.t
+		}
+	}
+	return rl, clock
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	ctx := context.Background()
+	rl, clock := newFakeRateLimiter(60, 0)
+	// The first 60 requests proceed immediately.
+	for i := 0; i < 60; i++ {
+		if err := rl.wait(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if clock.slept != 0 {
+		t.Fatalf("slept %s, want 0", clock.slept)
+	}
+	// The bucket refills at one request per second.
+	if err := rl.wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clock.slept, time.Second; got != want {
+		t.Errorf("slept %s, want %s", got, want)
+	}
+	if err := rl.wait(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clock.slept, 4*time.Second; got != want {
+		t.Errorf("slept %s, want %s", got, want)
+	}
+}
+
+func TestRateLimitTokens(t *testing.T) {
+	ctx := context.Background()
+	rl, clock := newFakeRateLimiter(0, 600)
+	if err := rl.wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Use more than the quota. The next request must wait until the
+	// balance is positive again.
+	rl.record(&UsageMetadata{TotalTokenCount: 700})
+	if err := rl.wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Tokens refill at 10 per second; we are 100 in debt and need 1.
+	if got, want := clock.slept, 10100*time.Millisecond; got != want {
+		t.Errorf("slept %s, want %s", got, want)
+	}
+	// A nil UsageMetadata is ignored.
+	rl.record(nil)
+	if err := rl.wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clock.slept, 10100*time.Millisecond; got != want {
+		t.Errorf("slept %s, want %s", got, want)
+	}
+}
+
+func TestRateLimitCanceled(t *testing.T) {
+	rl, _ := newFakeRateLimiter(1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := rl.wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := rl.wait(ctx, 1); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestRateLimitNil(t *testing.T) {
+	if rl := newRateLimiter(0, 0); rl != nil {
+		t.Fatal("got non-nil rateLimiter for no limits")
+	}
+	var rl *rateLimiter
+	if err := rl.wait(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+	rl.record(&UsageMetadata{TotalTokenCount: 1})
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+)
+
+// WithResponseCache returns an option that keeps the responses of the client's
+// non-streaming calls to generate content in memory, and returns a cached
+// response instead of calling the service when an identical request is made.
+// Requests are identical when they have the same [GenerativeModel.RequestKey].
+//
+// At most size responses are kept; when the cache is full, the least recently
+// used response is evicted. A response is not returned after ttl has passed
+// since it was cached. A ttl of zero or less means responses do not expire.
+// A size of zero or less disables the cache.
+//
+// Only requests whose Temperature is explicitly set to zero are cached, since
+// the response to any other request is expected to vary. (The version of the
+// API used by this package does not support setting a seed, which would also
+// make responses repeatable.) Streaming requests
+// are never cached. Each call returns a copy of the cached response, which
+// may be modified without affecting the cache.
+func WithResponseCache(size int, ttl time.Duration) option.ClientOption {
+	return &responseCacheOption{size: size, ttl: ttl}
+}
+
+type responseCacheOption struct {
+	internaloption.EmbeddableAdapter
+	size int
+	ttl  time.Duration
+}
+
+// A responseCache is an LRU cache of responses, keyed by request.
+// A nil *responseCache caches nothing.
+type responseCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List               // of *responseCacheEntry, most recently used first
+	items map[string]*list.Element // by key
+
+	// For testing.
+	now func() time.Time
+}
+
+type responseCacheEntry struct {
+	key     string
+	resp    *GenerateContentResponse
+	expires time.Time // zero if the entry does not expire
+}
+
+// newResponseCache returns a responseCache holding up to size responses,
+// or nil if size is not positive.
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	if size <= 0 {
+		return nil
+	}
+	return &responseCache{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: map[string]*list.Element{},
+		now:   time.Now,
+	}
+}
+
+// cacheable reports whether the response to req may be cached.
+func cacheable(req *pb.GenerateContentRequest) bool {
+	t := req.GetGenerationConfig().Temperature
+	return t != nil && *t == 0
+}
+
+// get returns a copy of the unexpired response for key, or nil if there is none.
+func (c *responseCache) get(key string) *GenerateContentResponse {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*responseCacheEntry)
+	if !e.expires.IsZero() && !c.now().Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return copyResponse(e.resp)
+}
+
+// put adds a copy of resp to the cache under key, evicting the least recently
+// used response if the cache is full.
+func (c *responseCache) put(key string, resp *GenerateContentResponse) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &responseCacheEntry{key: key, resp: copyResponse(resp)}
+	if c.ttl > 0 {
+		e.expires = c.now().Add(c.ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(e)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*responseCacheEntry).key)
+	}
+}
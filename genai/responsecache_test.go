@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	var calls int
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		writeJSONResponse(w, fmt.Sprintf("response %d", calls))
+	}), WithResponseCache(10, time.Minute))
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	client.responses.now = clock.now
+	ctx := context.Background()
+
+	model := client.GenerativeModel("m")
+	model.SetTemperature(0)
+	generate := func(m *GenerativeModel, prompt string) string {
+		t.Helper()
+		resp, err := m.GenerateContent(ctx, Text(prompt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return responseString(resp)
+	}
+	check := func(m *GenerativeModel, prompt, want string) {
+		t.Helper()
+		if got := generate(m, prompt); got != want {
+			t.Errorf("%q: got %q, want %q", prompt, got, want)
+		}
+	}
+
+	check(model, "a", "response 1") // miss
+	check(model, "a", "response 1") // hit
+	check(model, "b", "response 2") // miss: different contents
+	model2 := client.GenerativeModel("m")
+	model2.SetTemperature(0)
+	model2.SetTopK(5)
+	check(model2, "a", "response 3") // miss: different configuration
+	check(model2, "a", "response 3") // hit
+
+	// Modifying a returned response does not affect the cache.
+	resp, err := model.GenerateContent(ctx, Text("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Candidates[0].Content.Parts[0] = Text("changed")
+	check(model, "a", "response 1")
+
+	// Responses expire after the TTL.
+	clock.t = clock.t.Add(time.Minute)
+	check(model, "a", "response 4")
+
+	// Requests that don't set the temperature to zero are not cached.
+	warm := client.GenerativeModel("m")
+	check(warm, "a", "response 5")
+	check(warm, "a", "response 6")
+	warm.SetTemperature(0.5)
+	check(warm, "a", "response 7")
+	check(warm, "a", "response 8")
+	if calls != 8 {
+		t.Errorf("got %d calls, want 8", calls)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache(2, 0)
+	resp := func(s string) *GenerateContentResponse {
+		return &GenerateContentResponse{Candidates: []*Candidate{{Content: NewUserContent(Text(s))}}}
+	}
+	c.put("a", resp("a"))
+	c.put("b", resp("b"))
+	c.get("a") // now b is the least recently used
+	c.put("c", resp("c"))
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if got := c.get(key) != nil; got != want {
+			t.Errorf("%s: got present %t, want %t", key, got, want)
+		}
+	}
+	if c.order.Len() != 2 || len(c.items) != 2 {
+		t.Errorf("got %d, %d entries, want 2", c.order.Len(), len(c.items))
+	}
+
+	// A nil cache caches nothing.
+	var nc *responseCache
+	nc.put("a", resp("a"))
+	if nc.get("a") != nil {
+		t.Error("nil cache returned a response")
+	}
+	if newResponseCache(0, time.Minute) != nil {
+		t.Error("got a cache of size zero")
+	}
+}
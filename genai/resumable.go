@@ -0,0 +1,328 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file contains support for resuming interrupted file uploads.
+
+package genai
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	gld "github.com/google/generative-ai-go/genai/internal/generativelanguage/v1beta" // discovery client
+	"github.com/google/generative-ai-go/genai/internal/gensupport"
+	"github.com/googleapis/gax-go/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// An UploadInterruptedError is returned by [Client.UploadFile] when an upload
+// fails after the service has started a resumable upload session, which
+// happens for files larger than the chunk size. The upload can be continued,
+// even by another process, by passing URL and Offset to [Client.ResumeUpload].
+type UploadInterruptedError struct {
+	// The URL of the upload session.
+	URL string
+	// The number of bytes of the file that the service has received.
+	Offset int64
+	// The error that interrupted the upload.
+	Err error
+}
+
+func (e *UploadInterruptedError) Error() string {
+	return fmt.Sprintf("upload interrupted after %d bytes: %v", e.Offset, e.Err)
+}
+
+func (e *UploadInterruptedError) Unwrap() error { return e.Err }
+
+// ResumeUpload continues an upload that was interrupted, as reported by an
+// [UploadInterruptedError]. Pass the URL and Offset fields of the error, and
+// a reader for the contents of the file starting at Offset.
+// The service may have received more of the file than Offset; if so,
+// ResumeUpload skips the bytes that it already has.
+// Only the ChunkSize, MaxChunkRetries and ChunkRetryBackoff fields of opts
+// are used.
+//
+// If the upload is interrupted again, ResumeUpload returns another
+// UploadInterruptedError.
+func (c *Client) ResumeUpload(ctx context.Context, uploadURL string, offset int64, r io.Reader, opts *UploadFileOptions) (*File, error) {
+	chunkSize := googleapi.DefaultUploadChunkSize
+	if opts != nil && opts.ChunkSize > 0 {
+		// Round up, as googleapi.ChunkSize does.
+		chunkSize = (opts.ChunkSize + googleapi.MinUploadChunkSize - 1) / googleapi.MinUploadChunkSize * googleapi.MinUploadChunkSize
+	}
+	sess := &uploadSession{url: uploadURL}
+	if opts != nil {
+		sess.maxChunkRetries = opts.MaxChunkRetries
+		sess.chunkRetryBackoff = opts.ChunkRetryBackoff
+	}
+	ctx = context.WithValue(c.callContext(ctx), uploadSessionKey{}, sess)
+	// pending holds the bytes of the file starting at offset that have been
+	// read from r but not yet received by the service.
+	var pending []byte
+	eof := false
+	// Ask the service how much it has received.
+	res, err := c.sendUploadChunk(ctx, uploadURL, nil, "bytes */*")
+	for {
+		if err != nil {
+			return nil, &UploadInterruptedError{URL: uploadURL, Offset: offset, Err: err}
+		}
+		if !statusResumeIncomplete(res) {
+			return c.finishUpload(ctx, res)
+		}
+		res.Body.Close()
+		received, err := receivedBytes(res)
+		if err != nil {
+			return nil, err
+		}
+		if received < offset {
+			return nil, fmt.Errorf("genai.ResumeUpload: service has received %d bytes, fewer than offset %d", received, offset)
+		}
+		// Skip what the service already has.
+		skip := received - offset
+		if n := min(skip, int64(len(pending))); n > 0 {
+			pending = pending[n:]
+			skip -= n
+		}
+		if skip > 0 {
+			if _, err := io.CopyN(io.Discard, r, skip); err != nil {
+				return nil, fmt.Errorf("genai.ResumeUpload: skipping received bytes: %w", err)
+			}
+		}
+		offset = received
+
+		// Fill and send the next chunk.
+		if !eof && len(pending) < chunkSize {
+			n := len(pending)
+			pending = slices.Grow(pending, chunkSize-n)[:chunkSize]
+			m, err := io.ReadFull(r, pending[n:])
+			pending = pending[:n+m]
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return nil, fmt.Errorf("genai.ResumeUpload: %w", err)
+			}
+		}
+		var contentRange string
+		end := offset + int64(len(pending))
+		switch {
+		case !eof:
+			contentRange = fmt.Sprintf("bytes %d-%d/*", offset, end-1)
+		case len(pending) == 0:
+			contentRange = fmt.Sprintf("bytes */%d", end)
+		default:
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, end-1, end)
+		}
+		res, err = c.sendUploadChunk(ctx, uploadURL, pending, contentRange)
+	}
+}
+
+// sendUploadChunk sends data to a resumable upload session.
+// It returns an error if the response is neither a success nor an
+// indication that the upload is incomplete.
+func (c *Client) sendUploadChunk(ctx context.Context, uploadURL string, data []byte, contentRange string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Range", contentRange)
+	// Report an incomplete upload with a status of 200 instead of 308,
+	// which the HTTP client would treat as a redirect.
+	req.Header.Set("X-GUploader-No-308", "yes")
+	res, err := gensupport.SendRequest(ctx, c.hc, req)
+	if err != nil {
+		return nil, err
+	}
+	if statusResumeIncomplete(res) {
+		return res, nil
+	}
+	if err := googleapi.CheckResponse(res); err != nil {
+		res.Body.Close()
+		return nil, wrapError(err)
+	}
+	return res, nil
+}
+
+// finishUpload returns the File from the final response of an upload session.
+func (c *Client) finishUpload(ctx context.Context, res *http.Response) (*File, error) {
+	defer res.Body.Close()
+	var cfr gld.CreateFileResponse
+	if err := gensupport.DecodeResponse(&cfr, res); err != nil {
+		return nil, err
+	}
+	if cfr.File == nil {
+		return nil, errors.New("genai.ResumeUpload: no file in response")
+	}
+	return c.GetFile(ctx, cfr.File.Name)
+}
+
+// statusResumeIncomplete reports whether res indicates that the upload
+// session needs more data.
+func statusResumeIncomplete(res *http.Response) bool {
+	return res.Header.Get("X-Http-Status-Code-Override") == "308"
+}
+
+// receivedBytes returns the number of bytes the service has received,
+// from the Range header of res.
+func receivedBytes(res *http.Response) (int64, error) {
+	rng := res.Header.Get("Range")
+	if rng == "" {
+		return 0, nil
+	}
+	_, last, ok := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+	if !ok {
+		return 0, fmt.Errorf("genai: bad Range header %q in upload response", rng)
+	}
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("genai: bad Range header %q in upload response", rng)
+	}
+	return n + 1, nil
+}
+
+// An uploadSession records the progress of a resumable upload,
+// and holds its retry options.
+type uploadSession struct {
+	url    string
+	offset int64
+
+	maxChunkRetries   int
+	chunkRetryBackoff *gax.Backoff
+}
+
+type uploadSessionKey struct{}
+
+// uploadSessionTransport records the URL of a resumable upload session in
+// the uploadSession of the request's context, if there is one, and retries
+// the chunks of the upload as configured by the uploadSession.
+type uploadSessionTransport struct {
+	base http.RoundTripper
+}
+
+func (t *uploadSessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s, _ := req.Context().Value(uploadSessionKey{}).(*uploadSession)
+	if s != nil && s.maxChunkRetries > 0 && req.Header.Get("Content-Range") != "" &&
+		(req.Body == nil || req.GetBody != nil) {
+		return t.roundTripChunk(req, s)
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		if loc := res.Header.Get("Location"); loc != "" && req.URL.Query().Get("uploadType") == "resumable" {
+			s.url = loc
+		}
+	}
+	return res, nil
+}
+
+// roundTripChunk sends a chunk of an upload, retrying transient failures up
+// to s.maxChunkRetries times.
+func (t *uploadSessionTransport) roundTripChunk(req *http.Request, s *uploadSession) (*http.Response, error) {
+	bo := &gax.Backoff{Initial: 100 * time.Millisecond}
+	if b := s.chunkRetryBackoff; b != nil {
+		// Copy the backoff, so each chunk starts from the initial pause.
+		bo = &gax.Backoff{Initial: b.Initial, Max: b.Max, Multiplier: b.Multiplier}
+	}
+	ctx := req.Context()
+	r := req
+	for attempt := 1; ; attempt++ {
+		res, err := t.base.RoundTrip(r)
+		if !retryableChunkFailure(ctx, res, err) {
+			return res, err
+		}
+		if err == nil {
+			err = fmt.Errorf("HTTP status %s", res.Status)
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		if attempt > s.maxChunkRetries {
+			return nil, &chunkRetriesError{attempts: attempt, err: err}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(bo.Pause()):
+		}
+		r = req.Clone(ctx)
+		if req.GetBody != nil {
+			if r.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retryableChunkFailure reports whether sending a chunk failed in a way that
+// may succeed if retried.
+func retryableChunkFailure(ctx context.Context, res *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout
+}
+
+// A chunkRetriesError is returned when a chunk could not be sent after the
+// configured number of retries. It deliberately does not wrap the last error,
+// so that the upload code, which retries wrapped transient errors, gives up.
+type chunkRetriesError struct {
+	attempts int
+	err      error
+}
+
+func (e *chunkRetriesError) Error() string {
+	return fmt.Sprintf("sending upload chunk failed after %d attempts: %v", e.attempts, e.err)
+}
+
+// newDiscoveryService creates the discovery client, which is used for uploads.
+// It creates the HTTP client itself, with the same endpoints as gld.NewService,
+// so that it can record the URLs of upload sessions.
+func newDiscoveryService(ctx context.Context, opts []option.ClientOption) (*gld.Service, *http.Client, error) {
+	opts = append(slices.Clip(opts),
+		internaloption.WithDefaultEndpoint("https://generativelanguage.googleapis.com/"),
+		internaloption.WithDefaultEndpointTemplate("https://generativelanguage.UNIVERSE_DOMAIN/"),
+		internaloption.WithDefaultMTLSEndpoint("https://generativelanguage.mtls.googleapis.com/"),
+		internaloption.EnableNewAuthLibrary())
+	hc, endpoint, err := htransport.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Copy the client, which may have been provided by the user.
+	hc2 := *hc
+	base := hc.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	hc2.Transport = &uploadSessionTransport{base: base}
+	dsOpts := []option.ClientOption{option.WithHTTPClient(&hc2)}
+	if endpoint != "" {
+		dsOpts = append(dsOpts, option.WithEndpoint(endpoint))
+	}
+	ds, err := gld.NewService(ctx, dsOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ds, &hc2, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUploadServer implements the resumable upload protocol for a single file.
+// If interruptAt is positive, it rejects the first chunk that starts at that offset.
+type fakeUploadServer struct {
+	mu          sync.Mutex
+	received    []byte
+	interruptAt int
+}
+
+func (s *fakeUploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/upload/v1beta/files":
+		w.Header().Set("Location", "http://"+r.Host+"/session")
+	case "/session":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Content-Range is "bytes FIRST-LAST/TOTAL" or "bytes */TOTAL", where TOTAL may be "*".
+		rng, total, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "), "/")
+		if rng != "*" {
+			first, _, _ := strings.Cut(rng, "-")
+			off, _ := strconv.Atoi(first)
+			if off != len(s.received) {
+				http.Error(w, fmt.Sprintf("got offset %d, want %d", off, len(s.received)), http.StatusBadRequest)
+				return
+			}
+			if s.interruptAt > 0 && off == s.interruptAt {
+				s.interruptAt = 0
+				http.Error(w, "interrupted", http.StatusForbidden)
+				return
+			}
+			s.received = append(s.received, body...)
+		}
+		if total == "*" || total != strconv.Itoa(len(s.received)) {
+			if len(s.received) > 0 {
+				w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.received)-1))
+			}
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			return
+		}
+		fmt.Fprint(w, `{"file": {"name": "files/f"}}`)
+	case "/v1beta/files/f":
+		fmt.Fprint(w, `{"name": "files/f"}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	const chunkSize = 256 * 1024
+	data := make([]byte, 3*chunkSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	opts := &UploadFileOptions{ChunkSize: chunkSize}
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name   string
+		offset func(*UploadInterruptedError) int64
+	}{
+		{"from offset", func(e *UploadInterruptedError) int64 { return e.Offset }},
+		// The service has more data than the caller knows about.
+		{"from start", func(*UploadInterruptedError) int64 { return 0 }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := &fakeUploadServer{interruptAt: 2 * chunkSize}
+			client := newFakeClient(t, srv)
+			_, err := client.UploadFile(ctx, "", bytes.NewReader(data), opts)
+			var uerr *UploadInterruptedError
+			if !errors.As(err, &uerr) {
+				t.Fatalf("got %v, want UploadInterruptedError", err)
+			}
+			if !errors.Is(err, ErrPermissionDenied) {
+				t.Errorf("got %v, want match with ErrPermissionDenied", err)
+			}
+			if !strings.HasSuffix(uerr.URL, "/session") || uerr.Offset != 2*chunkSize {
+				t.Fatalf("got URL %q, offset %d; want .../session, %d", uerr.URL, uerr.Offset, 2*chunkSize)
+			}
+
+			off := test.offset(uerr)
+			f, err := client.ResumeUpload(ctx, uerr.URL, off, bytes.NewReader(data[off:]), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Name != "files/f" {
+				t.Errorf("got name %q, want %q", f.Name, "files/f")
+			}
+			if !bytes.Equal(srv.received, data) {
+				t.Errorf("service received %d bytes, not the %d bytes of the file", len(srv.received), len(data))
+			}
+		})
+	}
+}
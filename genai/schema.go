@@ -0,0 +1,475 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// openAPISchema is the YAML or JSON form of a Schema, using the field names
+// and type names of the OpenAPI 3.0 schema object.
+type openAPISchema struct {
+	Type        string                    `yaml:"type" json:"type"`
+	Format      string                    `yaml:"format,omitempty" json:"format,omitempty"`
+	Description string                    `yaml:"description,omitempty" json:"description,omitempty"`
+	Nullable    bool                      `yaml:"nullable,omitempty" json:"nullable,omitempty"`
+	Enum        []string                  `yaml:"enum,omitempty" json:"enum,omitempty"`
+	Items       *openAPISchema            `yaml:"items,omitempty" json:"items,omitempty"`
+	Properties  map[string]*openAPISchema `yaml:"properties,omitempty" json:"properties,omitempty"`
+	Required    []string                  `yaml:"required,omitempty" json:"required,omitempty"`
+}
+
+var typeToOpenAPI = map[Type]string{
+	TypeString:  "string",
+	TypeNumber:  "number",
+	TypeInteger: "integer",
+	TypeBoolean: "boolean",
+	TypeArray:   "array",
+	TypeObject:  "object",
+}
+
+var openAPIToType = map[string]Type{}
+
+func init() {
+	for t, s := range typeToOpenAPI {
+		openAPIToType[s] = t
+	}
+}
+
+// formatsForType are the formats the service supports for each type.
+// Types not in the map accept any format.
+var formatsForType = map[Type][]string{
+	TypeNumber:  {"float", "double"},
+	TypeInteger: {"int32", "int64"},
+}
+
+// SchemaFromYAML parses an OpenAPI 3.0 schema object written in YAML, such as
+//
+//	type: object
+//	properties:
+//	  name:
+//	    type: string
+//	  age:
+//	    type: integer
+//	    format: int32
+//	required: [name]
+//
+// Only the subset of OpenAPI supported by [Schema] is accepted: the keys type,
+// format, description, nullable, enum, items, properties and required.
+// It is an error to use any other key, like $ref or oneOf, or to use a key
+// with a type that does not support it.
+func SchemaFromYAML(data []byte) (*Schema, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var ys openAPISchema
+	if err := dec.Decode(&ys); err != nil {
+		return nil, fmt.Errorf("genai.SchemaFromYAML: %w", err)
+	}
+	s, err := ys.toSchema("schema")
+	if err != nil {
+		return nil, fmt.Errorf("genai.SchemaFromYAML: %w", err)
+	}
+	return s, nil
+}
+
+// SchemaToYAML returns the YAML form of s, in the format accepted by [SchemaFromYAML].
+func SchemaToYAML(s *Schema) ([]byte, error) {
+	ys, err := schemaToOpenAPI(s, "schema")
+	if err != nil {
+		return nil, fmt.Errorf("genai.SchemaToYAML: %w", err)
+	}
+	return yaml.Marshal(ys)
+}
+
+// MarshalOpenAPI returns s as an indented OpenAPI 3.0 schema object in JSON,
+// for debugging and documentation. Properties are sorted by name; Enum and
+// Required keep their order. Use [SchemaToYAML] for YAML.
+func (s *Schema) MarshalOpenAPI() ([]byte, error) {
+	as, err := schemaToOpenAPI(s, "schema")
+	if err != nil {
+		return nil, fmt.Errorf("genai.Schema.MarshalOpenAPI: %w", err)
+	}
+	return json.MarshalIndent(as, "", "  ")
+}
+
+// toSchema converts ys to a Schema, validating it.
+// The path describes the location of ys in the top-level schema, for errors.
+func (ys *openAPISchema) toSchema(path string) (*Schema, error) {
+	t, ok := openAPIToType[ys.Type]
+	if !ok {
+		if ys.Type == "" {
+			return nil, fmt.Errorf("%s: missing type", path)
+		}
+		return nil, fmt.Errorf("%s: unsupported type %q", path, ys.Type)
+	}
+	if fs, ok := formatsForType[t]; ok && ys.Format != "" && !slices.Contains(fs, ys.Format) {
+		return nil, fmt.Errorf("%s: unsupported format %q for type %s", path, ys.Format, ys.Type)
+	}
+	if len(ys.Enum) > 0 && t != TypeString {
+		return nil, fmt.Errorf("%s: enum is only supported for type string", path)
+	}
+	if ys.Items != nil && t != TypeArray {
+		return nil, fmt.Errorf("%s: items is only supported for type array", path)
+	}
+	if t == TypeArray && ys.Items == nil {
+		return nil, fmt.Errorf("%s: missing items for type array", path)
+	}
+	if (len(ys.Properties) > 0 || len(ys.Required) > 0) && t != TypeObject {
+		return nil, fmt.Errorf("%s: properties and required are only supported for type object", path)
+	}
+	for _, r := range ys.Required {
+		if _, ok := ys.Properties[r]; !ok {
+			return nil, fmt.Errorf("%s: required property %q is not in properties", path, r)
+		}
+	}
+	s := &Schema{
+		Type:        t,
+		Format:      ys.Format,
+		Description: ys.Description,
+		Nullable:    ys.Nullable,
+		Enum:        ys.Enum,
+		Required:    ys.Required,
+	}
+	if ys.Items != nil {
+		items, err := ys.Items.toSchema(path + ".items")
+		if err != nil {
+			return nil, err
+		}
+		s.Items = items
+	}
+	if len(ys.Properties) > 0 {
+		s.Properties = map[string]*Schema{}
+		for name, p := range ys.Properties {
+			if p == nil {
+				return nil, fmt.Errorf("%s.properties.%s: empty schema", path, name)
+			}
+			ps, err := p.toSchema(path + ".properties." + name)
+			if err != nil {
+				return nil, err
+			}
+			s.Properties[name] = ps
+		}
+	}
+	return s, nil
+}
+
+func schemaToOpenAPI(s *Schema, path string) (*openAPISchema, error) {
+	if s == nil {
+		return nil, fmt.Errorf("%s: nil schema", path)
+	}
+	t, ok := typeToOpenAPI[s.Type]
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported type %s", path, s.Type)
+	}
+	ys := &openAPISchema{
+		Type:        t,
+		Format:      s.Format,
+		Description: s.Description,
+		Nullable:    s.Nullable,
+		Enum:        s.Enum,
+		Required:    s.Required,
+	}
+	if s.Items != nil {
+		items, err := schemaToOpenAPI(s.Items, path+".items")
+		if err != nil {
+			return nil, err
+		}
+		ys.Items = items
+	}
+	if len(s.Properties) > 0 {
+		ys.Properties = map[string]*openAPISchema{}
+		for name, p := range s.Properties {
+			yp, err := schemaToOpenAPI(p, path+".properties."+name)
+			if err != nil {
+				return nil, err
+			}
+			ys.Properties[name] = yp
+		}
+	}
+	return ys, nil
+}
+
+// A SchemaBuilder constructs a [Schema] with a fluent API:
+//
+//	schema := genai.Object().
+//		Prop("name", genai.String().Desc("The color's name")).
+//		Prop("rgb", genai.String().Desc("The RGB hex code, like #ff0000")).
+//		Required("name", "rgb").
+//		Build()
+//
+// Start with one of [String], [Number], [Integer], [Boolean], [Array] or
+// [Object]. Each method modifies the builder and returns it.
+//
+// Methods that do not apply to the builder's type, like Prop on a string,
+// panic, as does Build if a required property has not been added, since
+// these are programming errors.
+type SchemaBuilder struct {
+	s Schema
+}
+
+// String starts building a schema for a string.
+func String() *SchemaBuilder { return &SchemaBuilder{Schema{Type: TypeString}} }
+
+// Number starts building a schema for a floating-point number.
+func Number() *SchemaBuilder { return &SchemaBuilder{Schema{Type: TypeNumber}} }
+
+// Integer starts building a schema for an integer.
+func Integer() *SchemaBuilder { return &SchemaBuilder{Schema{Type: TypeInteger}} }
+
+// Boolean starts building a schema for a boolean.
+func Boolean() *SchemaBuilder { return &SchemaBuilder{Schema{Type: TypeBoolean}} }
+
+// Array starts building a schema for an array whose elements are described
+// by items.
+func Array(items *SchemaBuilder) *SchemaBuilder {
+	return &SchemaBuilder{Schema{Type: TypeArray, Items: items.Build()}}
+}
+
+// Object starts building a schema for an object. Add its properties with
+// [SchemaBuilder.Prop].
+func Object() *SchemaBuilder { return &SchemaBuilder{Schema{Type: TypeObject}} }
+
+// Desc sets the schema's description.
+func (b *SchemaBuilder) Desc(description string) *SchemaBuilder {
+	b.s.Description = description
+	return b
+}
+
+// Format sets the schema's format, like "int32" or "double". Only numbers
+// and integers support formats.
+func (b *SchemaBuilder) Format(format string) *SchemaBuilder {
+	fs, ok := formatsForType[b.s.Type]
+	if !ok || !slices.Contains(fs, format) {
+		panic(fmt.Sprintf("genai.SchemaBuilder.Format: unsupported format %q for type %s", format, b.s.Type))
+	}
+	b.s.Format = format
+	return b
+}
+
+// Nullable marks the schema's value as possibly null.
+func (b *SchemaBuilder) Nullable() *SchemaBuilder {
+	b.s.Nullable = true
+	return b
+}
+
+// Enum sets the possible values of a string schema.
+func (b *SchemaBuilder) Enum(values ...string) *SchemaBuilder {
+	b.mustBe(TypeString, "Enum")
+	b.s.Enum = append(b.s.Enum, values...)
+	return b
+}
+
+// Prop adds a property to an object schema. The property is built when it
+// is added, so later changes to p do not affect b.
+func (b *SchemaBuilder) Prop(name string, p *SchemaBuilder) *SchemaBuilder {
+	b.mustBe(TypeObject, "Prop")
+	if b.s.Properties == nil {
+		b.s.Properties = map[string]*Schema{}
+	}
+	b.s.Properties[name] = p.Build()
+	return b
+}
+
+// Required marks properties of an object schema as required.
+func (b *SchemaBuilder) Required(names ...string) *SchemaBuilder {
+	b.mustBe(TypeObject, "Required")
+	b.s.Required = append(b.s.Required, names...)
+	return b
+}
+
+// Build returns the schema. Each call returns a new Schema, which does not
+// share memory with b or with the results of other calls.
+func (b *SchemaBuilder) Build() *Schema {
+	for _, r := range b.s.Required {
+		if _, ok := b.s.Properties[r]; !ok {
+			panic(fmt.Sprintf("genai.SchemaBuilder.Build: required property %q has not been added", r))
+		}
+	}
+	return cloneSchema(&b.s)
+}
+
+// cloneSchema returns a deep copy of s.
+func cloneSchema(s *Schema) *Schema {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.Enum = slices.Clone(s.Enum)
+	c.Required = slices.Clone(s.Required)
+	c.Items = cloneSchema(s.Items)
+	if s.Properties != nil {
+		c.Properties = make(map[string]*Schema, len(s.Properties))
+		for name, p := range s.Properties {
+			c.Properties[name] = cloneSchema(p)
+		}
+	}
+	return &c
+}
+
+func (b *SchemaBuilder) mustBe(t Type, method string) {
+	if b.s.Type != t {
+		panic(fmt.Sprintf("genai.SchemaBuilder.%s: not supported for type %s", method, b.s.Type))
+	}
+}
+
+// ValidateArgs reports whether args, the arguments of a [FunctionCall] for the
+// function that fd declares, satisfy fd's Parameters: that the required
+// properties are present, that no undeclared properties are present, and that
+// every value has the declared type, and is one of the declared Enum values,
+// if any. Use it to catch a model's mistakes before calling a function that
+// has side effects. If fd has no Parameters, args must be empty.
+//
+// The error describes every problem found, with its location in args.
+func (fd *FunctionDeclaration) ValidateArgs(args map[string]any) error {
+	var errs []error
+	if fd.Parameters == nil {
+		for _, k := range sortedKeys(args) {
+			errs = append(errs, fmt.Errorf("args.%s: function takes no arguments", k))
+		}
+	} else {
+		errs = fd.Parameters.validateValue(args, "args", errs)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("genai.FunctionDeclaration.ValidateArgs: function %s: %w", fd.Name, errors.Join(errs...))
+	}
+	return nil
+}
+
+// validateValue appends to errs the ways in which v, a value decoded from
+// JSON or built from the equivalent Go types, does not satisfy s. The path describes the location of v, for errors.
+func (s *Schema) validateValue(v any, path string, errs []error) []error {
+	if v == nil {
+		if !s.Nullable {
+			errs = append(errs, fmt.Errorf("%s: null is not allowed", path))
+		}
+		return errs
+	}
+	mismatch := func() []error {
+		return append(errs, fmt.Errorf("%s: got %s, want %s", path, jsonKind(v), typeToOpenAPI[s.Type]))
+	}
+	switch s.Type {
+	case TypeString:
+		str, ok := v.(string)
+		if !ok {
+			return mismatch()
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			errs = append(errs, fmt.Errorf("%s: %q is not one of %q", path, str, s.Enum))
+		}
+	case TypeNumber:
+		if _, ok := jsonNumber(v); !ok {
+			return mismatch()
+		}
+	case TypeInteger:
+		f, ok := jsonNumber(v)
+		if !ok {
+			return mismatch()
+		}
+		if f != math.Trunc(f) {
+			errs = append(errs, fmt.Errorf("%s: %v is not an integer", path, v))
+		}
+	case TypeBoolean:
+		if _, ok := v.(bool); !ok {
+			return mismatch()
+		}
+	case TypeArray:
+		a, ok := v.([]any)
+		if !ok {
+			return mismatch()
+		}
+		if s.Items != nil {
+			for i, e := range a {
+				errs = s.Items.validateValue(e, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case TypeObject:
+		o, ok := v.(map[string]any)
+		if !ok {
+			return mismatch()
+		}
+		for _, r := range s.Required {
+			if _, ok := o[r]; !ok {
+				errs = append(errs, fmt.Errorf("%s: missing required property %q", path, r))
+			}
+		}
+		for _, k := range sortedKeys(o) {
+			ps, ok := s.Properties[k]
+			if !ok {
+				// An object without declared properties may hold anything.
+				if len(s.Properties) > 0 {
+					errs = append(errs, fmt.Errorf("%s: unknown property %q", path, k))
+				}
+				continue
+			}
+			errs = ps.validateValue(o[k], path+"."+k, errs)
+		}
+	}
+	return errs
+}
+
+// jsonNumber returns the value of v as a float64, if v is a number: a
+// float64 or json.Number decoded from JSON, or any Go integer or float, as in
+// args built by a program.
+func jsonNumber(v any) (float64, bool) {
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// jsonKind returns the JSON name of the kind of v, for errors.
+func jsonKind(v any) string {
+	if _, ok := jsonNumber(v); ok {
+		return "number"
+	}
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,318 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSchemaYAML(t *testing.T) {
+	const in = `
+type: object
+description: A recipe.
+properties:
+  name:
+    type: string
+  servings:
+    type: integer
+    format: int32
+    nullable: true
+  difficulty:
+    type: string
+    enum: [easy, medium, hard]
+  ingredients:
+    type: array
+    items:
+      type: object
+      properties:
+        item:
+          type: string
+        grams:
+          type: number
+          format: float
+      required: [item]
+required: [name, ingredients]
+`
+	want := &Schema{
+		Type:        TypeObject,
+		Description: "A recipe.",
+		Properties: map[string]*Schema{
+			"name":       {Type: TypeString},
+			"servings":   {Type: TypeInteger, Format: "int32", Nullable: true},
+			"difficulty": {Type: TypeString, Enum: []string{"easy", "medium", "hard"}},
+			"ingredients": {
+				Type: TypeArray,
+				Items: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"item":  {Type: TypeString},
+						"grams": {Type: TypeNumber, Format: "float"},
+					},
+					Required: []string{"item"},
+				},
+			},
+		},
+		Required: []string{"name", "ingredients"},
+	}
+	got, err := SchemaFromYAML([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Round trip.
+	out, err := SchemaToYAML(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got2, err := SchemaFromYAML(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got2); diff != "" {
+		t.Errorf("round trip mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestSchemaFromYAMLErrors(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want string // substring of error message
+	}{
+		{"description: x", "missing type"},
+		{"type: date", `unsupported type "date"`},
+		{"type: string\nminLength: 1", "minLength"},
+		{"type: object\nproperties:\n  a:\n    $ref: '#/b'", "$ref"},
+		{"type: integer\nformat: float", `unsupported format "float"`},
+		{"type: integer\nenum: [a]", "enum"},
+		{"type: array", "missing items"},
+		{"type: string\nitems:\n  type: string", "items"},
+		{"type: string\nrequired: [a]", "properties"},
+		{"type: object\nproperties:\n  a:\n    type: string\nrequired: [b]", `"b"`},
+		{"type: object\nproperties:\n  a:\n    type: bad", "schema.properties.a"},
+	} {
+		_, err := SchemaFromYAML([]byte(test.in))
+		if err == nil {
+			t.Errorf("%q: got nil, want error", test.in)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got %q, want it to contain %q", test.in, err, test.want)
+		}
+	}
+}
+
+func TestSchemaToYAMLError(t *testing.T) {
+	s := &Schema{Type: TypeArray, Items: &Schema{}}
+	if _, err := SchemaToYAML(s); err == nil {
+		t.Error("got nil, want error")
+	}
+}
+
+func TestMarshalOpenAPI(t *testing.T) {
+	s := &Schema{
+		Type:        TypeObject,
+		Description: "A recipe.",
+		Properties: map[string]*Schema{
+			"name":       {Type: TypeString},
+			"difficulty": {Type: TypeString, Enum: []string{"hard", "easy"}, Nullable: true},
+			"steps":      {Type: TypeArray, Items: &Schema{Type: TypeInteger, Format: "int32"}},
+		},
+		Required: []string{"steps", "name"},
+	}
+	got, err := s.MarshalOpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "type": "object",
+  "description": "A recipe.",
+  "properties": {
+    "difficulty": {
+      "type": "string",
+      "nullable": true,
+      "enum": [
+        "hard",
+        "easy"
+      ]
+    },
+    "name": {
+      "type": "string"
+    },
+    "steps": {
+      "type": "array",
+      "items": {
+        "type": "integer",
+        "format": "int32"
+      }
+    }
+  },
+  "required": [
+    "steps",
+    "name"
+  ]
+}`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("(-want, +got)\n%s", diff)
+	}
+
+	if _, err := (&Schema{Type: TypeArray, Items: &Schema{}}).MarshalOpenAPI(); err == nil {
+		t.Error("unspecified type: got nil, want error")
+	}
+}
+
+func TestSchemaBuilder(t *testing.T) {
+	got := Object().
+		Prop("name", String().Desc("The color's name")).
+		Prop("rgb", String()).
+		Prop("shade", String().Enum("light", "dark").Nullable()).
+		Prop("samples", Array(Object().
+			Prop("x", Number().Format("float")).
+			Prop("n", Integer().Format("int32")).
+			Prop("ok", Boolean()).
+			Required("x"))).
+		Required("name", "rgb").
+		Build()
+	want := &Schema{
+		Type: TypeObject,
+		Properties: map[string]*Schema{
+			"name":  {Type: TypeString, Description: "The color's name"},
+			"rgb":   {Type: TypeString},
+			"shade": {Type: TypeString, Enum: []string{"light", "dark"}, Nullable: true},
+			"samples": {
+				Type: TypeArray,
+				Items: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"x":  {Type: TypeNumber, Format: "float"},
+						"n":  {Type: TypeInteger, Format: "int32"},
+						"ok": {Type: TypeBoolean},
+					},
+					Required: []string{"x"},
+				},
+			},
+		},
+		Required: []string{"name", "rgb"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Built schemas do not share memory with the builder.
+	b := Object().Prop("a", String()).Required("a")
+	s1 := b.Build()
+	s1.Properties["a"].Description = "changed"
+	s1.Required[0] = "changed"
+	if s2 := b.Build(); s2.Properties["a"].Description != "" || s2.Required[0] != "a" {
+		t.Errorf("Build results share memory: %+v", s2)
+	}
+}
+
+func TestSchemaBuilderPanics(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		f    func()
+	}{
+		{"Prop on string", func() { String().Prop("a", String()) }},
+		{"Required on array", func() { Array(String()).Required("a") }},
+		{"Enum on integer", func() { Integer().Enum("a") }},
+		{"bad format", func() { Number().Format("int32") }},
+		{"format on string", func() { String().Format("float") }},
+		{"missing required", func() { Object().Prop("a", String()).Required("b").Build() }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("did not panic")
+				}
+			}()
+			test.f()
+		})
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	fd := &FunctionDeclaration{
+		Name: "book",
+		Parameters: Object().
+			Prop("city", String()).
+			Prop("nights", Integer()).
+			Prop("budget", Number().Nullable()).
+			Prop("room", String().Enum("single", "double")).
+			Prop("guests", Array(Object().Prop("name", String()).Required("name"))).
+			Prop("breakfast", Boolean()).
+			Required("city", "nights").
+			Build(),
+	}
+	for _, args := range []map[string]any{
+		{"city": "Paris", "nights": 2.0},
+		{"city": "Paris", "nights": json.Number("2"), "budget": nil, "room": "double",
+			"guests": []any{map[string]any{"name": "Ann"}}, "breakfast": true},
+		// Args built in Go may hold any integer or float type.
+		{"city": "Paris", "nights": 2, "budget": float32(99.5)},
+		{"city": "Paris", "nights": int64(2), "budget": uint8(100)},
+	} {
+		if err := fd.ValidateArgs(args); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+
+	for _, test := range []struct {
+		args map[string]any
+		want []string // substrings of the error
+	}{
+		{map[string]any{"nights": 2.0}, []string{`args: missing required property "city"`}},
+		{map[string]any{"city": 3.0, "nights": "two"}, []string{
+			"args.city: got number, want string",
+			"args.nights: got string, want integer",
+		}},
+		{map[string]any{"city": "Paris", "nights": 2.5}, []string{"args.nights: 2.5 is not an integer"}},
+		{map[string]any{"city": 3, "nights": float32(2.5)}, []string{
+			"args.city: got number, want string",
+			"args.nights: 2.5 is not an integer",
+		}},
+		{map[string]any{"city": nil, "nights": 1.0}, []string{"args.city: null is not allowed"}},
+		{map[string]any{"city": "Paris", "nights": 1.0, "room": "suite"}, []string{`args.room: "suite" is not one of`}},
+		{map[string]any{"city": "Paris", "nights": 1.0, "pets": true}, []string{`args: unknown property "pets"`}},
+		{map[string]any{"city": "Paris", "nights": 1.0, "guests": []any{map[string]any{}, "Bob"}}, []string{
+			`args.guests[0]: missing required property "name"`,
+			"args.guests[1]: got string, want object",
+		}},
+		{map[string]any{"city": "Paris", "nights": 1.0, "breakfast": "yes"}, []string{"args.breakfast: got string, want boolean"}},
+	} {
+		err := fd.ValidateArgs(test.args)
+		if err == nil {
+			t.Errorf("%v: got nil, want error", test.args)
+			continue
+		}
+		for _, w := range test.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%v: error %q does not contain %q", test.args, err, w)
+			}
+		}
+	}
+
+	noParams := &FunctionDeclaration{Name: "now"}
+	if err := noParams.ValidateArgs(nil); err != nil {
+		t.Errorf("no parameters: %v", err)
+	}
+	if err := noParams.ValidateArgs(map[string]any{"tz": "UTC"}); err == nil {
+		t.Error("no parameters, with args: got nil, want error")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file contains helpers for structured (JSON) output.
+
+package genai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/iterator"
+)
+
+// GenerateStructuredStream is like [GenerativeModel.GenerateContentStream],
+// for a JSON response. It returns a channel of the pieces of the response's
+// text as they arrive, for display, and a function that waits for the response
+// to complete and then unmarshals its text into v, as with [json.Unmarshal].
+// The function returns any error from the stream or from unmarshaling.
+// Before unmarshaling, surrounding whitespace, a surrounding Markdown code
+// fence, and quotes around the JSON value, which models sometimes add, are
+// removed.
+//
+// If the model's ResponseMIMEType is empty, "application/json" is used.
+// Only the first candidate is used.
+//
+//	texts, finish := model.GenerateStructuredStream(ctx, &recipe, genai.Text("..."))
+//	for t := range texts {
+//		fmt.Print(t)
+//	}
+//	if err := finish(); err != nil {
+//		// handle err
+//	}
+//	// use recipe
+//
+// The channel is closed when the response is complete or fails. The function
+// discards any text that has not been received from the channel, so it is
+// safe to call it without reading the channel. If ctx is done before the
+// response is complete, the function returns ctx.Err().
+func (m *GenerativeModel) GenerateStructuredStream(ctx context.Context, v any, parts ...Part) (<-chan string, func() error) {
+	m2 := *m
+	if m2.ResponseMIMEType == "" {
+		m2.ResponseMIMEType = "application/json"
+	}
+	return structuredStream(ctx, m2.GenerateContentStream(ctx, parts...), v)
+}
+
+// structuredStream implements GenerateStructuredStream for the responses of iter.
+func structuredStream(ctx context.Context, iter *GenerateContentResponseIterator, v any) (<-chan string, func() error) {
+	texts := make(chan string)
+	done := make(chan struct{})
+	var err error // set before done is closed
+	go func() {
+		defer close(done)
+		defer close(texts)
+		var all strings.Builder
+		for {
+			resp, ierr := iter.Next()
+			if ierr == iterator.Done {
+				break
+			}
+			if ierr != nil {
+				err = ierr
+				return
+			}
+			if len(resp.Candidates) == 0 {
+				continue
+			}
+			t, _, _ := resp.Candidates[0].Split()
+			if t == "" {
+				continue
+			}
+			all.WriteString(t)
+			select {
+			case texts <- t:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+		if uerr := json.Unmarshal([]byte(normalizeJSON(all.String())), v); uerr != nil {
+			err = fmt.Errorf("genai.GenerateStructuredStream: %w", uerr)
+		}
+	}()
+	finish := func() error {
+		for range texts {
+		}
+		<-done
+		return err
+	}
+	return texts, finish
+}
+
+// ParseEnum returns the one of values that matches text, the response of a
+// model whose ResponseMIMEType is "text/x.enum" and whose ResponseSchema
+// has values as its Enum. Models sometimes add noise to the value, so before
+// matching, ParseEnum removes surrounding whitespace, a surrounding Markdown
+// code fence, and surrounding quotes. If there is no exact match, a unique
+// case-insensitive match is accepted. Otherwise, ParseEnum returns an error.
+func ParseEnum(text string, values []string) (string, error) {
+	t := trimQuotes(trimCodeFence(strings.TrimSpace(text)))
+	var folded []string
+	for _, v := range values {
+		if v == t {
+			return v, nil
+		}
+		if strings.EqualFold(v, t) {
+			folded = append(folded, v)
+		}
+	}
+	if len(folded) == 1 {
+		return folded[0], nil
+	}
+	return "", fmt.Errorf("genai.ParseEnum: %q is not one of %q", text, values)
+}
+
+// normalizeJSON removes noise that models sometimes add around a JSON value.
+func normalizeJSON(s string) string {
+	s = trimCodeFence(strings.TrimSpace(s))
+	if !json.Valid([]byte(s)) {
+		if t := trimQuotes(s); t != s && json.Valid([]byte(t)) {
+			return t
+		}
+	}
+	return s
+}
+
+// trimCodeFence removes a Markdown code fence, with an optional language
+// name, that surrounds s, along with the whitespace inside it.
+func trimCodeFence(s string) string {
+	if !strings.HasPrefix(s, "```") || !strings.HasSuffix(s, "```") || len(s) < 6 {
+		return s
+	}
+	s = s[3 : len(s)-3]
+	// Remove the language name, if any, on the first line.
+	if i := strings.IndexByte(s, '\n'); i >= 0 && !strings.ContainsAny(s[:i], " {[\"") {
+		s = s[i+1:]
+	}
+	return strings.TrimSpace(s)
+}
+
+// trimQuotes removes one pair of matching quotes, and the whitespace inside
+// them, from around s.
+func trimQuotes(s string) string {
+	if len(s) >= 2 {
+		if q := s[0]; (q == '"' || q == '\'' || q == '`') && s[len(s)-1] == q {
+			return strings.TrimSpace(s[1 : len(s)-1])
+		}
+	}
+	return s
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+)
+
+// textStreamIterator returns an iterator over responses with the given texts,
+// followed by err.
+func textStreamIterator(err error, texts ...string) *GenerateContentResponseIterator {
+	var responses []*pb.GenerateContentResponse
+	for _, text := range texts {
+		responses = append(responses, &pb.GenerateContentResponse{
+			Candidates: []*pb.Candidate{{Content: (&Content{Role: roleModel, Parts: []Part{Text(text)}}).toProto()}},
+		})
+	}
+	return &GenerateContentResponseIterator{sc: &fakeStreamClient{responses: responses, err: err}}
+}
+
+func TestStructuredStream(t *testing.T) {
+	type recipe struct {
+		Name        string
+		Ingredients []string
+	}
+	ctx := context.Background()
+	chunks := []string{`{"Name": "Pan`, `cakes", "Ingredients": ["flour",`, ` "milk"]}`}
+	var r recipe
+	texts, finish := structuredStream(ctx, textStreamIterator(io.EOF, chunks...), &r)
+	var got []string
+	for t := range texts {
+		got = append(got, t)
+	}
+	if err := finish(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "|") != strings.Join(chunks, "|") {
+		t.Errorf("got texts %q, want %q", got, chunks)
+	}
+	if r.Name != "Pancakes" || len(r.Ingredients) != 2 {
+		t.Errorf("got %+v", r)
+	}
+
+	// finish can be called without reading the channel.
+	r = recipe{}
+	_, finish = structuredStream(ctx, textStreamIterator(io.EOF, chunks...), &r)
+	if err := finish(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "Pancakes" {
+		t.Errorf("without reading: got %+v", r)
+	}
+
+	// Invalid JSON.
+	_, finish = structuredStream(ctx, textStreamIterator(io.EOF, `{"Name": `), &r)
+	if err := finish(); err == nil {
+		t.Error("invalid JSON: got nil, want error")
+	}
+
+	// A stream error.
+	streamErr := errors.New("stream failed")
+	_, finish = structuredStream(ctx, textStreamIterator(streamErr, chunks[0]), &r)
+	if err := finish(); !errors.Is(err, streamErr) {
+		t.Errorf("stream error: got %v, want %v", err, streamErr)
+	}
+
+	// A canceled context.
+	cctx, cancel := context.WithCancel(ctx)
+	texts, finish = structuredStream(cctx, textStreamIterator(io.EOF, chunks...), &r)
+	<-texts
+	cancel()
+	if err := finish(); err != nil && !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled: got %v, want nil or context.Canceled", err)
+	}
+}
+
+func TestParseEnum(t *testing.T) {
+	values := []string{"positive", "negative", "Neutral", "neutral"}
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"positive", "positive"},
+		{" negative\n", "negative"},
+		{`"positive"`, "positive"},
+		{"'negative'", "negative"},
+		{"`positive`", "positive"},
+		{"\"  positive \"\n", "positive"},
+		{"```\npositive\n```", "positive"},
+		{"```text\n\"negative\"\n```", "negative"},
+		{"POSITIVE", "positive"}, // a unique case-insensitive match
+		{"neutral", "neutral"},   // an exact match wins
+		{"NEUTRAL", ""},          // ambiguous
+		{"positive!", ""},
+		{`"positive`, ""},
+		{"", ""},
+	} {
+		got, err := ParseEnum(test.in, values)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: got %q, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+		} else if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeJSON(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{`{"a": 1}`, `{"a": 1}`},
+		{"\n  {\"a\": 1}  \n", `{"a": 1}`},
+		{`"{"a": 1}"`, `{"a": 1}`},
+		{`'[1, 2]'`, `[1, 2]`},
+		{"```json\n{\"a\": 1}\n```", `{"a": 1}`},
+		{"```\n\"{\"a\": 1}\"\n```", `{"a": 1}`},
+		{"```{\"a\": 1}```", `{"a": 1}`},
+		// A JSON string is left alone.
+		{`"text"`, `"text"`},
+		// Invalid JSON is left alone, apart from whitespace.
+		{` "{"a": `, `"{"a":`},
+	} {
+		if got := normalizeJSON(test.in); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+
+	// GenerateStructuredStream normalizes.
+	var m map[string]int
+	_, finish := structuredStream(context.Background(), textStreamIterator(io.EOF, "```json\n", `{"a": 1}`, "\n```"), &m)
+	if err := finish(); err != nil {
+		t.Fatal(err)
+	}
+	if m["a"] != 1 {
+		t.Errorf("got %v, want a=1", m)
+	}
+}
@@ -0,0 +1,454 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// ToolFromMethods returns a Tool that declares a function for each exported
+// method of obj. Use [CallMethod] to call the method named by a [FunctionCall]
+// that the model returns.
+//
+// Each method must have one of the forms
+//
+//	func (T) Name([ctx context.Context,] [args A]) [R | error | (R, error)]
+//
+// where A is a struct or a pointer to a struct. The exported fields of A
+// become the parameters of the function, named as they would be by
+// [encoding/json]. A field is required unless its json tag has the omitempty
+// option, and the value of its "description" tag, if any, is used as the
+// parameter's description. Fields may be strings, booleans, numbers, structs,
+// or slices or pointers to those. A [time.Time] is described as a string in
+// RFC 3339 format. Maps are not supported, because a [Schema] cannot describe
+// an object with arbitrary keys. A method with any other form is an error.
+//
+// The declarations have no descriptions. Models call functions more reliably
+// when they know what they do, so consider setting the Description field of
+// each of the returned Tool's FunctionDeclarations.
+func ToolFromMethods(obj any) (*Tool, error) {
+	t := reflect.TypeOf(obj)
+	if t == nil || t.NumMethod() == 0 {
+		return nil, fmt.Errorf("genai.ToolFromMethods: %T has no exported methods", obj)
+	}
+	tool := &Tool{}
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		fd, err := functionDeclarationForMethod(m.Name, m.Type)
+		if err != nil {
+			return nil, fmt.Errorf("genai.ToolFromMethods: method %s: %w", m.Name, err)
+		}
+		tool.FunctionDeclarations = append(tool.FunctionDeclarations, fd)
+	}
+	return tool, nil
+}
+
+// CallMethod calls the method of obj named by call, as declared by
+// [ToolFromMethods]. It decodes the arguments of call into the method's
+// argument struct, passes ctx if the method takes a context, and returns the
+// method's result as a FunctionResponse to send back to the model.
+// A result that does not encode to a JSON object is returned under the key
+// "result".
+//
+// If the method returns a non-nil error, CallMethod returns it, wrapped.
+// If the method panics, CallMethod recovers and returns a [*MethodPanicError],
+// so that a misbehaving function does not crash a program that calls
+// functions on behalf of a model. The program can then report the failure
+// to the model in a FunctionResponse, or stop.
+func CallMethod(ctx context.Context, obj any, call FunctionCall) (*FunctionResponse, error) {
+	v := reflect.ValueOf(obj)
+	if !v.IsValid() {
+		return nil, errors.New("genai.CallMethod: nil object")
+	}
+	m := v.MethodByName(call.Name)
+	if !m.IsValid() {
+		return nil, fmt.Errorf("genai.CallMethod: %T has no exported method %q", obj, call.Name)
+	}
+	sig, err := methodSignature(m.Type(), 0)
+	if err != nil {
+		return nil, fmt.Errorf("genai.CallMethod: method %s: %w", call.Name, err)
+	}
+	var in []reflect.Value
+	if sig.hasContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	if sig.arg != nil {
+		arg, err := decodeArgs(call.Args, sig.arg)
+		if err != nil {
+			return nil, fmt.Errorf("genai.CallMethod: method %s: %w", call.Name, err)
+		}
+		in = append(in, arg)
+	}
+	out, perr := callRecover(call.Name, m, in)
+	if perr != nil {
+		return nil, perr
+	}
+	if sig.hasError {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return nil, fmt.Errorf("genai.CallMethod: method %s: %w", call.Name, err)
+		}
+		out = out[:len(out)-1]
+	}
+	res := map[string]any{}
+	if len(out) > 0 {
+		data, err := json.Marshal(out[0].Interface())
+		if err != nil {
+			return nil, fmt.Errorf("genai.CallMethod: method %s: encoding result: %w", call.Name, err)
+		}
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("genai.CallMethod: method %s: decoding result: %w", call.Name, err)
+		}
+		if o, ok := v.(map[string]any); ok {
+			res = o
+		} else {
+			res["result"] = v
+		}
+	}
+	return &FunctionResponse{Name: call.Name, Response: res}, nil
+}
+
+// CallMethod is like the package-level [CallMethod], but if the session's
+// MemoizeToolResults field is true, a call with the same function name and
+// arguments as an earlier successful one returns the earlier response without
+// calling the method. Memoize only methods whose results do not change during
+// the conversation; use [ChatSession.ClearToolResults] to forget the responses
+// when they may have. Failed calls are not remembered.
+func (cs *ChatSession) CallMethod(ctx context.Context, obj any, call FunctionCall) (*FunctionResponse, error) {
+	if !cs.MemoizeToolResults {
+		return CallMethod(ctx, obj, call)
+	}
+	key, err := toolResultKey(call)
+	if err != nil {
+		// The arguments can't be used as a key, so don't memoize.
+		return CallMethod(ctx, obj, call)
+	}
+	if fr, ok := cs.toolResults[key]; ok {
+		return copyFunctionResponse(fr), nil
+	}
+	fr, err := CallMethod(ctx, obj, call)
+	if err != nil {
+		return nil, err
+	}
+	if cs.toolResults == nil {
+		cs.toolResults = map[string]*FunctionResponse{}
+	}
+	cs.toolResults[key] = copyFunctionResponse(fr)
+	return fr, nil
+}
+
+// ClearToolResults forgets the function responses remembered by
+// [ChatSession.CallMethod].
+func (cs *ChatSession) ClearToolResults() {
+	cs.toolResults = nil
+}
+
+// toolResultKey returns a key identifying the function and arguments of call.
+// Encoding the arguments as JSON sorts their keys, so equal arguments have
+// equal keys.
+func toolResultKey(call FunctionCall) (string, error) {
+	args, err := json.Marshal(call.Args)
+	if err != nil {
+		return "", err
+	}
+	return call.Name + "\x00" + string(args), nil
+}
+
+// copyFunctionResponse returns a copy of fr whose Response map can be
+// modified without affecting fr. The values in the map are not copied.
+func copyFunctionResponse(fr *FunctionResponse) *FunctionResponse {
+	fr2 := *fr
+	fr2.Response = maps.Clone(fr.Response)
+	return &fr2
+}
+
+// SendMessageWithMethods sends a message like [ChatSession.SendMessage], then
+// calls functions for the model automatically: while the first candidate of
+// the response has function calls, it calls the methods of obj that they name,
+// using [ChatSession.CallMethod], and sends the function responses back to the
+// model. It returns the first response without function calls. obj should be
+// the argument of the [ToolFromMethods] call that created one of the model's
+// Tools.
+//
+// Methods that take a context are passed ctx, so they can stop early when it
+// is canceled. If a method fails, or ctx is done before all the calls of a
+// response have been made, SendMessageWithMethods returns the response with
+// the calls and the error, without calling the remaining methods.
+//
+// If the session's MaxToolRounds, MaxToolTokens or MaxToolDuration is
+// exceeded before the model stops calling functions, SendMessageWithMethods
+// stops without calling the methods, and returns the last response, whose
+// function calls are still unanswered, along with a [*ToolBudgetError]. The
+// budget is checked between round trips, so a request in progress is not
+// interrupted. To continue, call the methods and send their responses, or
+// send a new message.
+func (cs *ChatSession) SendMessageWithMethods(ctx context.Context, obj any, parts ...Part) (*GenerateContentResponse, error) {
+	maxRounds := cs.MaxToolRounds
+	if maxRounds <= 0 {
+		maxRounds = defaultMaxToolRounds
+	}
+	start := time.Now()
+	var tokens int32
+	resp, err := cs.SendMessage(ctx, parts...)
+	for rounds := 1; ; rounds++ {
+		if err != nil {
+			return nil, err
+		}
+		if resp.UsageMetadata != nil {
+			tokens += resp.UsageMetadata.TotalTokenCount
+		}
+		if len(resp.Candidates) == 0 {
+			return resp, nil
+		}
+		calls := resp.Candidates[0].FunctionCalls()
+		if len(calls) == 0 {
+			return resp, nil
+		}
+		elapsed := time.Since(start)
+		if rounds >= maxRounds ||
+			(cs.MaxToolTokens > 0 && tokens >= cs.MaxToolTokens) ||
+			(cs.MaxToolDuration > 0 && elapsed >= cs.MaxToolDuration) {
+			return resp, &ToolBudgetError{Rounds: rounds, Tokens: tokens, Elapsed: elapsed}
+		}
+		var responses []Part
+		for _, call := range calls {
+			if err := ctx.Err(); err != nil {
+				return resp, err
+			}
+			fr, err := cs.CallMethod(ctx, obj, call)
+			if err != nil {
+				return resp, err
+			}
+			responses = append(responses, *fr)
+		}
+		resp, err = cs.SendMessage(ctx, responses...)
+	}
+}
+
+// defaultMaxToolRounds is the limit on the requests of
+// [ChatSession.SendMessageWithMethods] when MaxToolRounds is zero.
+const defaultMaxToolRounds = 10
+
+// A ToolBudgetError is returned by [ChatSession.SendMessageWithMethods] when
+// the session's MaxToolRounds, MaxToolTokens or MaxToolDuration is exceeded.
+type ToolBudgetError struct {
+	// The number of requests sent to the model.
+	Rounds int
+	// The total number of tokens used by the requests.
+	Tokens int32
+	// The time since the message was sent.
+	Elapsed time.Duration
+}
+
+func (e *ToolBudgetError) Error() string {
+	return fmt.Sprintf("genai: automatic function calling stopped after %d requests, %d tokens and %s",
+		e.Rounds, e.Tokens, e.Elapsed.Round(time.Millisecond))
+}
+
+// A MethodPanicError is returned by [CallMethod] when the called method panics.
+type MethodPanicError struct {
+	// The name of the method.
+	Method string
+	// The value passed to panic.
+	Value any
+	// The stack trace of the goroutine at the time of the panic.
+	Stack []byte
+}
+
+func (e *MethodPanicError) Error() string {
+	return fmt.Sprintf("genai.CallMethod: method %s panicked: %v", e.Method, e.Value)
+}
+
+// callRecover calls m with in, returning a MethodPanicError if m panics.
+func callRecover(name string, m reflect.Value, in []reflect.Value) (out []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &MethodPanicError{Method: name, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return m.Call(in), nil
+}
+
+// A signature describes a method that can be used as a function.
+type signature struct {
+	hasContext bool         // takes a context.Context
+	arg        reflect.Type // struct or pointer to struct; nil if none
+	hasError   bool         // last result is an error
+}
+
+// methodSignature checks that the method type mt has one of the forms
+// described in ToolFromMethods. Parameters before index first, such as
+// the receiver, are ignored.
+func methodSignature(mt reflect.Type, first int) (signature, error) {
+	var sig signature
+	in := first
+	if in < mt.NumIn() && mt.In(in) == contextType {
+		sig.hasContext = true
+		in++
+	}
+	switch mt.NumIn() - in {
+	case 0:
+	case 1:
+		sig.arg = mt.In(in)
+		st := sig.arg
+		if st.Kind() == reflect.Pointer {
+			st = st.Elem()
+		}
+		if st.Kind() != reflect.Struct || st == timeType {
+			return sig, fmt.Errorf("argument type %s is not a struct", sig.arg)
+		}
+	default:
+		return sig, errors.New("too many arguments")
+	}
+	switch n := mt.NumOut(); {
+	case n == 0:
+	case n == 1:
+		sig.hasError = mt.Out(0) == errorType
+	case n == 2 && mt.Out(1) == errorType:
+		sig.hasError = true
+	default:
+		return sig, errors.New("results must be a value, an error, or a value and an error")
+	}
+	return sig, nil
+}
+
+func functionDeclarationForMethod(name string, mt reflect.Type) (*FunctionDeclaration, error) {
+	sig, err := methodSignature(mt, 1)
+	if err != nil {
+		return nil, err
+	}
+	fd := &FunctionDeclaration{Name: name}
+	if sig.arg != nil {
+		s, err := schemaForType(sig.arg, map[reflect.Type]bool{})
+		if err != nil {
+			return nil, err
+		}
+		// The parameters themselves are never null.
+		s.Nullable = false
+		fd.Parameters = s
+	}
+	return fd, nil
+}
+
+// schemaForType returns a Schema describing the JSON encoding of t.
+// The types being visited are recorded in visiting, to detect recursive types.
+func schemaForType(t reflect.Type, visiting map[reflect.Type]bool) (*Schema, error) {
+	nullable := false
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+		nullable = true
+	}
+	if t == timeType {
+		// encoding/json encodes times as RFC 3339 strings.
+		return &Schema{Type: TypeString, Format: "date-time", Nullable: nullable}, nil
+	}
+	var s *Schema
+	switch t.Kind() {
+	case reflect.String:
+		s = &Schema{Type: TypeString}
+	case reflect.Bool:
+		s = &Schema{Type: TypeBoolean}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		s = &Schema{Type: TypeInteger, Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		s = &Schema{Type: TypeInteger, Format: "int64"}
+	case reflect.Float32:
+		s = &Schema{Type: TypeNumber, Format: "float"}
+	case reflect.Float64:
+		s = &Schema{Type: TypeNumber, Format: "double"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json encodes byte slices as base64 strings.
+			s = &Schema{Type: TypeString}
+			break
+		}
+		items, err := schemaForType(t.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		s = &Schema{Type: TypeArray, Items: items}
+	case reflect.Struct:
+		if visiting[t] {
+			return nil, fmt.Errorf("recursive type %s", t)
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		s = &Schema{Type: TypeObject, Properties: map[string]*Schema{}}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			if f.Anonymous {
+				return nil, fmt.Errorf("embedded field %s of %s is not supported", f.Name, t)
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" && opts == "" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			ps, err := schemaForType(f.Type, visiting)
+			if err != nil {
+				return nil, err
+			}
+			ps.Description = f.Tag.Get("description")
+			s.Properties[name] = ps
+			if !strings.Contains(","+opts+",", ",omitempty,") {
+				s.Required = append(s.Required, name)
+			}
+		}
+	case reflect.Map:
+		// An object with arbitrary keys needs additionalProperties,
+		// which the service's Schema does not support.
+		return nil, fmt.Errorf("unsupported type %s: maps cannot be described by a Schema", t)
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+	s.Nullable = nullable
+	return s, nil
+}
+
+// decodeArgs decodes args into a new value of t, which is a struct
+// or a pointer to a struct.
+func decodeArgs(args map[string]any, t reflect.Type) (reflect.Value, error) {
+	st := t
+	if t.Kind() == reflect.Pointer {
+		st = t.Elem()
+	}
+	p := reflect.New(st)
+	if err := decodeJSONArgs(args, p.Interface(), true); err != nil {
+		return reflect.Value{}, fmt.Errorf("decoding arguments: %w", err)
+	}
+	if t.Kind() == reflect.Pointer {
+		return p, nil
+	}
+	return p.Elem(), nil
+}
@@ -0,0 +1,487 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/ai/generativelanguage/apiv1beta/generativelanguagepb"
+	"github.com/google/go-cmp/cmp"
+)
+
+type weatherAgent struct {
+	unit string
+}
+
+type forecastArgs struct {
+	City string `json:"city" description:"The name of the city."`
+	Days int    `json:"days,omitempty"`
+}
+
+type forecast struct {
+	City  string    `json:"city"`
+	Temps []float64 `json:"temps"`
+	Unit  string    `json:"unit"`
+}
+
+func (a *weatherAgent) Forecast(ctx context.Context, args forecastArgs) (*forecast, error) {
+	if args.City == "Atlantis" {
+		return nil, errors.New("no such city")
+	}
+	f := &forecast{City: args.City, Unit: a.unit}
+	for i := 0; i < max(args.Days, 1); i++ {
+		f.Temps = append(f.Temps, float64(20+i))
+	}
+	return f, nil
+}
+
+func (a *weatherAgent) SetUnit(args *struct {
+	Unit string   `json:"unit"`
+	Tags []string `json:"tags,omitempty"`
+	Note *string  `json:"note,omitempty"`
+	Skip string   `json:"-"`
+}) error {
+	a.unit = args.Unit
+	return nil
+}
+
+func (a *weatherAgent) Unit() string { return a.unit }
+
+func (a *weatherAgent) unexported() {}
+
+type alertAgent struct {
+	alerts map[string][]string
+}
+
+func (a *alertAgent) Alerts(args struct{ Region string }) []string {
+	a.alerts[args.Region] = append(a.alerts[args.Region], "storm") // panics if alerts is nil
+	return a.alerts[args.Region]
+}
+
+func TestToolFromMethods(t *testing.T) {
+	tool, err := ToolFromMethods(&weatherAgent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Tool{
+		FunctionDeclarations: []*FunctionDeclaration{
+			{
+				Name: "Forecast",
+				Parameters: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"city": {Type: TypeString, Description: "The name of the city."},
+						"days": {Type: TypeInteger, Format: "int64"},
+					},
+					Required: []string{"city"},
+				},
+			},
+			{
+				Name: "SetUnit",
+				Parameters: &Schema{
+					Type: TypeObject,
+					Properties: map[string]*Schema{
+						"unit": {Type: TypeString},
+						"tags": {Type: TypeArray, Items: &Schema{Type: TypeString}},
+						"note": {Type: TypeString, Nullable: true},
+					},
+					Required: []string{"unit"},
+				},
+			},
+			{Name: "Unit"},
+		},
+	}
+	if diff := cmp.Diff(want, tool); diff != "" {
+		t.Errorf("(-want, +got)\n%s", diff)
+	}
+}
+
+func TestToolFromMethodsErrors(t *testing.T) {
+	for _, test := range []struct {
+		obj  any
+		want string
+	}{
+		{nil, "no exported methods"},
+		{weatherAgent{}, "no exported methods"}, // methods have pointer receivers
+		{badArgs{}, "not a struct"},
+		{timeArgs{}, "not a struct"},
+		{badResults{}, "results"},
+		{badField{}, "maps cannot be described"},
+		{recursive{}, "recursive type"},
+	} {
+		_, err := ToolFromMethods(test.obj)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%T: got %v, want error containing %q", test.obj, err, test.want)
+		}
+	}
+}
+
+type badArgs struct{}
+
+type timeArgs struct{}
+
+func (timeArgs) F(t time.Time) {}
+
+type calendarAgent struct {
+	start time.Time
+}
+
+func (a *calendarAgent) Schedule(args struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+}) {
+	a.start = args.Start
+}
+
+func TestToolFromMethodsTime(t *testing.T) {
+	tool, err := ToolFromMethods(&calendarAgent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Schema{
+		Type: TypeObject,
+		Properties: map[string]*Schema{
+			"start": {Type: TypeString, Format: "date-time"},
+			"end":   {Type: TypeString, Format: "date-time", Nullable: true},
+		},
+		Required: []string{"start"},
+	}
+	if diff := cmp.Diff(want, tool.FunctionDeclarations[0].Parameters); diff != "" {
+		t.Errorf("(-want, +got)\n%s", diff)
+	}
+
+	a := &calendarAgent{}
+	call := FunctionCall{Name: "Schedule", Args: map[string]any{"start": "2024-06-01T09:30:00Z"}}
+	if _, err := CallMethod(context.Background(), a, call); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 6, 1, 9, 30, 0, 0, time.UTC); !a.start.Equal(want) {
+		t.Errorf("got %v, want %v", a.start, want)
+	}
+}
+
+func (badArgs) F(x int) {}
+
+type badResults struct{}
+
+func (badResults) F() (int, int) { return 0, 0 }
+
+type badField struct{}
+
+func (badField) F(struct{ M map[string]int }) {}
+
+type recursive struct{}
+
+type node struct{ Children []node }
+
+func (recursive) F(node) {}
+
+func TestCallMethod(t *testing.T) {
+	ctx := context.Background()
+	a := &weatherAgent{}
+
+	res, err := CallMethod(ctx, a, FunctionCall{Name: "SetUnit", Args: map[string]any{"unit": "C"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&FunctionResponse{Name: "SetUnit", Response: map[string]any{}}, res); diff != "" {
+		t.Errorf("SetUnit: (-want, +got)\n%s", diff)
+	}
+
+	res, err = CallMethod(ctx, a, FunctionCall{Name: "Forecast", Args: map[string]any{"city": "Paris", "days": 2.0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &FunctionResponse{
+		Name: "Forecast",
+		Response: map[string]any{
+			"city":  "Paris",
+			"temps": []any{20.0, 21.0},
+			"unit":  "C",
+		},
+	}
+	if diff := cmp.Diff(want, res); diff != "" {
+		t.Errorf("Forecast: (-want, +got)\n%s", diff)
+	}
+
+	// A result that is not an object.
+	res, err = CallMethod(ctx, a, FunctionCall{Name: "Unit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]any{"result": "C"}, res.Response); diff != "" {
+		t.Errorf("Unit: (-want, +got)\n%s", diff)
+	}
+
+	for _, call := range []FunctionCall{
+		{Name: "Forecast", Args: map[string]any{"city": "Atlantis"}}, // method error
+		{Name: "Forecast", Args: map[string]any{"town": "Paris"}},    // unknown argument
+		{Name: "Forecast", Args: map[string]any{"city": 1}},          // wrong type
+		{Name: "unexported"}, // not exported
+		{Name: "Missing"},    // no such method
+	} {
+		if _, err := CallMethod(ctx, a, call); err == nil {
+			t.Errorf("%v: got nil, want error", call)
+		}
+	}
+}
+
+func TestCallMethodPanic(t *testing.T) {
+	a := &alertAgent{}
+	res, err := CallMethod(context.Background(), a, FunctionCall{Name: "Alerts", Args: map[string]any{"Region": "north"}})
+	if res != nil {
+		t.Errorf("got response %v, want nil", res)
+	}
+	var perr *MethodPanicError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got %v, want MethodPanicError", err)
+	}
+	if perr.Method != "Alerts" {
+		t.Errorf("got method %q, want Alerts", perr.Method)
+	}
+	if !strings.Contains(fmt.Sprint(perr.Value), "nil map") {
+		t.Errorf("got value %v, want a nil map panic", perr.Value)
+	}
+	if !strings.Contains(string(perr.Stack), "alertAgent).Alerts") {
+		t.Errorf("stack does not include the method:\n%s", perr.Stack)
+	}
+
+	// The agent still works after a panic.
+	a.alerts = map[string][]string{}
+	if _, err := CallMethod(context.Background(), a, FunctionCall{Name: "Alerts", Args: map[string]any{"Region": "north"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChatSessionCallMethodMemoized(t *testing.T) {
+	ctx := context.Background()
+	a := &alertAgent{alerts: map[string][]string{}}
+	cs := (&GenerativeModel{}).StartChat()
+	call := func(region string) []any {
+		t.Helper()
+		res, err := cs.CallMethod(ctx, a, FunctionCall{Name: "Alerts", Args: map[string]any{"Region": region}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := res.Response["result"].([]any)
+		// Modifying the response does not affect the remembered one.
+		res.Response["result"] = "changed"
+		return got
+	}
+	one, two := []any{"storm"}, []any{"storm", "storm"}
+
+	// Without memoization, every call calls the method.
+	call("north")
+	if diff := cmp.Diff(two, call("north")); diff != "" {
+		t.Errorf("not memoized: mismatch (-want, +got):\n%s", diff)
+	}
+
+	cs.MemoizeToolResults = true
+	a.alerts = map[string][]string{}
+	for i := 0; i < 3; i++ {
+		if diff := cmp.Diff(one, call("north")); diff != "" {
+			t.Errorf("call %d: mismatch (-want, +got):\n%s", i, diff)
+		}
+	}
+	// Different arguments are a different call.
+	if diff := cmp.Diff(one, call("south")); diff != "" {
+		t.Errorf("south: mismatch (-want, +got):\n%s", diff)
+	}
+	if got := len(a.alerts["north"]); got != 1 {
+		t.Errorf("method called %d times for north, want 1", got)
+	}
+
+	cs.ClearToolResults()
+	if diff := cmp.Diff(two, call("north")); diff != "" {
+		t.Errorf("after ClearToolResults: mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Failed calls are not remembered.
+	a.alerts = nil
+	for i := 0; i < 2; i++ {
+		if _, err := cs.CallMethod(ctx, a, FunctionCall{Name: "Alerts", Args: map[string]any{"Region": "east"}}); err == nil {
+			t.Fatalf("call %d: got nil, want error", i)
+		}
+	}
+}
+
+// toolServer is a fake generative service whose model calls the Forecast
+// function twice, or forever if endless is true, before answering.
+type toolServer struct {
+	pb.UnimplementedGenerativeServiceServer
+	requests int
+	endless  bool
+}
+
+func (s *toolServer) StreamGenerateContent(req *pb.GenerateContentRequest, stream pb.GenerativeService_StreamGenerateContentServer) error {
+	s.requests++
+	var part *pb.Part
+	if s.requests <= 2 || s.endless {
+		part = FunctionCall{Name: "Forecast", Args: map[string]any{"city": "Paris"}}.toPart()
+	} else {
+		part = Text("It will be warm.").toPart()
+	}
+	return stream.Send(&pb.GenerateContentResponse{
+		Candidates:    []*pb.Candidate{{Content: &pb.Content{Role: roleModel, Parts: []*pb.Part{part}}}},
+		UsageMetadata: &pb.GenerateContentResponse_UsageMetadata{TotalTokenCount: 10},
+	})
+}
+
+func TestSendMessageWithMethods(t *testing.T) {
+	srv := &toolServer{}
+	client := newFakeClient(t, http.NotFoundHandler())
+	useGRPCServer(t, client, srv)
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name       string
+		endless    bool
+		maxRounds  int
+		maxTokens  int32
+		maxTime    time.Duration
+		wantRounds int // the number of requests; 0 for no ToolBudgetError
+	}{
+		{name: "default limits"},
+		{name: "enough tokens", maxTokens: 100},
+		{name: "rounds", maxRounds: 2, wantRounds: 2},
+		{name: "default rounds", endless: true, wantRounds: defaultMaxToolRounds},
+		{name: "tokens", maxTokens: 15, wantRounds: 2},
+		{name: "duration", maxTime: time.Nanosecond, wantRounds: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv.requests, srv.endless = 0, test.endless
+			cs := client.GenerativeModel("m").StartChat()
+			cs.MaxToolRounds = test.maxRounds
+			cs.MaxToolTokens = test.maxTokens
+			cs.MaxToolDuration = test.maxTime
+			resp, err := cs.SendMessageWithMethods(ctx, &weatherAgent{unit: "C"}, Text("Weather in Paris?"))
+			if test.wantRounds == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := responseString(resp), "It will be warm."; got != want {
+					t.Errorf("got %q, want %q", got, want)
+				}
+				// Each function call and response is in the history.
+				if got, want := len(cs.History), 6; got != want {
+					t.Errorf("got %d turns in history, want %d", got, want)
+				}
+				return
+			}
+			var berr *ToolBudgetError
+			if !errors.As(err, &berr) {
+				t.Fatalf("got %v, want a ToolBudgetError", err)
+			}
+			if berr.Rounds != test.wantRounds || srv.requests != test.wantRounds || berr.Tokens != int32(10*test.wantRounds) {
+				t.Errorf("got %+v after %d requests, want %d rounds", berr, srv.requests, test.wantRounds)
+			}
+			// The partial result holds the unanswered call.
+			if resp == nil || len(resp.Candidates[0].FunctionCalls()) != 1 {
+				t.Errorf("got response %+v, want one with a function call", resp)
+			}
+		})
+	}
+}
+
+// cancelAgent has methods that cancel or wait for the context of the call.
+type cancelAgent struct {
+	cancel  context.CancelFunc
+	started chan struct{} // closed when Wait starts
+	called  []string
+}
+
+func (a *cancelAgent) Cancel() {
+	a.called = append(a.called, "Cancel")
+	a.cancel()
+}
+
+func (a *cancelAgent) Wait(ctx context.Context) error {
+	a.called = append(a.called, "Wait")
+	close(a.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (a *cancelAgent) Never() {
+	a.called = append(a.called, "Never")
+}
+
+// callServer is a fake generative service whose model always calls the named
+// functions.
+type callServer struct {
+	pb.UnimplementedGenerativeServiceServer
+	names    []string
+	requests int
+}
+
+func (s *callServer) StreamGenerateContent(req *pb.GenerateContentRequest, stream pb.GenerativeService_StreamGenerateContentServer) error {
+	s.requests++
+	var parts []*pb.Part
+	for _, name := range s.names {
+		parts = append(parts, FunctionCall{Name: name}.toPart())
+	}
+	return stream.Send(&pb.GenerateContentResponse{
+		Candidates: []*pb.Candidate{{Content: &pb.Content{Role: roleModel, Parts: parts}}},
+	})
+}
+
+func TestSendMessageWithMethodsCanceled(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		calls []string
+		want  []string // the methods called
+	}{
+		// The context is canceled between calls: the remaining ones are not made.
+		{"between calls", []string{"Cancel", "Never"}, []string{"Cancel"}},
+		// The context is canceled while a method waits on it.
+		{"during a call", []string{"Wait", "Never"}, []string{"Wait"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := &callServer{names: test.calls}
+			client := newFakeClient(t, http.NotFoundHandler())
+			useGRPCServer(t, client, srv)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			a := &cancelAgent{cancel: cancel, started: make(chan struct{})}
+			if test.calls[0] == "Wait" {
+				go func() {
+					<-a.started
+					cancel()
+				}()
+			}
+
+			cs := client.GenerativeModel("m").StartChat()
+			resp, err := cs.SendMessageWithMethods(ctx, a, Text("go"))
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v, want context.Canceled", err)
+			}
+			if resp == nil || len(resp.Candidates[0].FunctionCalls()) != len(test.calls) {
+				t.Errorf("got response %+v, want the one with the calls", resp)
+			}
+			if diff := cmp.Diff(test.want, a.called); diff != "" {
+				t.Errorf("methods called mismatch (-want, +got):\n%s", diff)
+			}
+			if srv.requests != 1 {
+				t.Errorf("got %d requests, want 1", srv.requests)
+			}
+		})
+	}
+}
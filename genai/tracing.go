@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+)
+
+// tracerName is the name of the OpenTelemetry tracer that creates the client's spans.
+const tracerName = "github.com/google/generative-ai-go/genai"
+
+// WithTracerProvider returns an option that makes the client create an
+// OpenTelemetry span, using a tracer from tp, for each call to generate
+// content, count tokens, compute embeddings, and upload, get or delete a file.
+// The spans are named like "genai.GenerateContent", and have attributes for
+// the model and, where the service reports them, the token counts and the
+// finish reason. A failed call's span records its error.
+//
+// Without this option, the client creates no spans.
+func WithTracerProvider(tp trace.TracerProvider) option.ClientOption {
+	return &tracerProviderOption{tp: tp}
+}
+
+type tracerProviderOption struct {
+	internaloption.EmbeddableAdapter
+	tp trace.TracerProvider
+}
+
+// Span attribute keys, following the OpenTelemetry semantic conventions
+// for generative AI.
+const (
+	attrModel        = attribute.Key("gen_ai.request.model")
+	attrInputTokens  = attribute.Key("gen_ai.usage.input_tokens")
+	attrOutputTokens = attribute.Key("gen_ai.usage.output_tokens")
+	attrFinishReason = attribute.Key("gen_ai.response.finish_reasons")
+	attrFileName     = attribute.Key("genai.file.name")
+)
+
+// startSpan starts a span for the named call, if the client has a tracer.
+// Otherwise it returns ctx and a nil span. Pass the span to endSpan.
+func (c *Client) startSpan(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if c.tracer == nil {
+		return ctx, nil
+	}
+	return c.tracer.Start(ctx, "genai."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, which may be nil, recording the usage and finish reason
+// of the call if known, and its error if it failed.
+func endSpan(span trace.Span, usage *UsageMetadata, fr FinishReason, err error) {
+	if span == nil {
+		return
+	}
+	if usage != nil {
+		span.SetAttributes(
+			attrInputTokens.Int(int(usage.PromptTokenCount)),
+			attrOutputTokens.Int(int(usage.CandidatesTokenCount)))
+	}
+	if fr != FinishReasonUnspecified {
+		span.SetAttributes(attrFinishReason.StringSlice([]string{fr.String()}))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// spanRecorder is a trace.TracerProvider that records the spans its tracers create.
+type spanRecorder struct {
+	noop.TracerProvider
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *spanRecorder) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return &recordingTracer{r: r}
+}
+
+type recordingTracer struct {
+	noop.Tracer
+	r *spanRecorder
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	s := &recordedSpan{name: name, attrs: map[attribute.Key]attribute.Value{}}
+	s.SetAttributes(cfg.Attributes()...)
+	t.r.mu.Lock()
+	t.r.spans = append(t.r.spans, s)
+	t.r.mu.Unlock()
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+type recordedSpan struct {
+	noop.Span
+	name   string
+	attrs  map[attribute.Key]attribute.Value
+	status codes.Code
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttributes(kvs ...attribute.KeyValue) {
+	for _, kv := range kvs {
+		s.attrs[kv.Key] = kv.Value
+	}
+}
+
+func (s *recordedSpan) SetStatus(c codes.Code, _ string) { s.status = c }
+func (s *recordedSpan) End(...trace.SpanEndOption)       { s.ended = true }
+
+// attr returns the value of the attribute with key k, or nil if there is none.
+func (s *recordedSpan) attr(k attribute.Key) any {
+	v, ok := s.attrs[k]
+	if !ok {
+		return nil
+	}
+	return v.AsInterface()
+}
+
+func TestTracing(t *testing.T) {
+	tp := &spanRecorder{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "missing"):
+			http.Error(w, "no such model", http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, ":countTokens"):
+			fmt.Fprint(w, `{"totalTokens": 7}`)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"candidates": [{"content": {"role": "model", "parts": [{"text": "hi"}]}, "finishReason": "STOP"}],
+				"usageMetadata": {"promptTokenCount": 2, "candidatesTokenCount": 1, "totalTokenCount": 3}}`)
+		}
+	})
+	client := newFakeClient(t, handler, WithTracerProvider(tp))
+	ctx := context.Background()
+
+	if _, err := client.GenerativeModel("m").GenerateContent(ctx, Text("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GenerativeModel("missing").GenerateContent(ctx, Text("hi")); err == nil {
+		t.Fatal("got nil, want error")
+	}
+	if _, err := client.GenerativeModel("m").CountTokens(ctx, Text("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	type span struct {
+		Name                   string
+		Model, In, Out, Finish any
+		Error, Ended           bool
+	}
+	var got []span
+	for _, s := range tp.spans {
+		got = append(got, span{
+			Name:   s.name,
+			Model:  s.attr(attrModel),
+			In:     s.attr(attrInputTokens),
+			Out:    s.attr(attrOutputTokens),
+			Finish: s.attr(attrFinishReason),
+			Error:  s.status == codes.Error,
+			Ended:  s.ended,
+		})
+	}
+	want := []span{
+		{Name: "genai.GenerateContent", Model: "models/m", In: int64(2), Out: int64(1), Finish: []string{"FinishReasonStop"}, Ended: true},
+		{Name: "genai.GenerateContent", Model: "models/missing", Error: true, Ended: true},
+		{Name: "genai.CountTokens", Model: "models/m", In: int64(7), Ended: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("spans mismatch (-want +got):\n%s", diff)
+	}
+
+	// Without the option, there is no tracer.
+	if c := newFakeClient(t, handler); c.tracer != nil {
+		t.Error("got a tracer, want none")
+	}
+}
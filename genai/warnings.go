@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"slices"
+
+	gl "cloud.google.com/go/ai/generativelanguage/apiv1beta"
+	"google.golang.org/api/option"
+	"google.golang.org/api/option/internaloption"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// WithWarningHandler returns an option that calls f with each warning that the
+// service attaches to a response, such as a notice that a model is deprecated.
+// path is the URL path of the request, like
+// "/v1beta/models/gemini-1.0-pro:generateContent", which identifies the model
+// or other resource that the warning is about. Use it to log warnings and plan
+// migrations.
+//
+// The service reports warnings in the HTTP Warning header, which the generated
+// response types do not include. Warnings about calls that manage cached
+// contents, which use gRPC, are not reported. f may be called concurrently.
+func WithWarningHandler(f func(path, warning string)) option.ClientOption {
+	return &warningHandler{f: f}
+}
+
+type warningHandler struct {
+	internaloption.EmbeddableAdapter
+	f func(path, warning string)
+}
+
+// applyWarningHandler returns opts with an option added that makes the
+// HTTP-based clients use an HTTP client that reports warnings to f.
+// If opts include an HTTP client, that client's transport is wrapped.
+func applyWarningHandler(ctx context.Context, opts []option.ClientOption, f func(path, warning string)) ([]option.ClientOption, error) {
+	// Use the same defaults as the generated REST clients.
+	hopts := append([]option.ClientOption{
+		internaloption.WithDefaultEndpoint("https://generativelanguage.googleapis.com"),
+		internaloption.WithDefaultEndpointTemplate("https://generativelanguage.UNIVERSE_DOMAIN"),
+		internaloption.WithDefaultMTLSEndpoint("https://generativelanguage.mtls.googleapis.com"),
+		internaloption.WithDefaultUniverseDomain("googleapis.com"),
+		internaloption.WithDefaultAudience("https://generativelanguage.googleapis.com/"),
+		internaloption.WithDefaultScopes(gl.DefaultAuthScopes()...),
+	}, opts...)
+	hc, _, err := htransport.NewClient(ctx, hopts...)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the client, which may have been provided by the user.
+	hc2 := *hc
+	base := hc.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	hc2.Transport = &warningTransport{base: base, handle: f}
+	return append(slices.Clip(opts), option.WithHTTPClient(&hc2)), nil
+}
+
+// warningTransport is an http.RoundTripper that reports the warnings in
+// responses.
+type warningTransport struct {
+	base   http.RoundTripper
+	handle func(path, warning string)
+}
+
+func (t *warningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range res.Header.Values("Warning") {
+		t.handle(req.URL.Path, warningText(v))
+	}
+	return res, nil
+}
+
+// warningHeaderRE matches the value of a Warning header, like
+//
+//	299 - "Model is deprecated" "Wed, 21 Oct 2015 07:28:00 GMT"
+//
+// capturing the text without quotes.
+var warningHeaderRE = regexp.MustCompile(`^\s*\d{3}\s+\S+\s+"((?:[^"\\]|\\.)*)"`)
+
+// quotedPairRE matches an escaped character in a quoted string.
+var quotedPairRE = regexp.MustCompile(`\\(.)`)
+
+// warningText returns the text of the Warning header value v, or v itself if
+// it is not in the standard form.
+func warningText(v string) string {
+	m := warningHeaderRE.FindStringSubmatch(v)
+	if m == nil {
+		return v
+	}
+	return quotedPairRE.ReplaceAllString(m[1], "$1")
+}
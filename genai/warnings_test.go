@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genai
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWarningHandler(t *testing.T) {
+	const deprecated = `299 - "Model gemini-1.0-pro is deprecated and will be removed on 2025-02-15." "Wed, 21 Oct 2015 07:28:00 GMT"`
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	client := newFakeClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1beta/models/old:generateContent" {
+			w.Header().Add("Warning", deprecated)
+			w.Header().Add("Warning", "some other warning")
+		}
+		writeJSONResponse(w, "hello")
+	}), WithWarningHandler(func(path, warning string) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, path+": "+warning)
+	}))
+	ctx := context.Background()
+	for _, name := range []string{"old", "new"} {
+		resp, err := client.GenerativeModel(name).GenerateContent(ctx, Text("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g := responseString(resp); g != "hello" {
+			t.Errorf("got %q, want %q", g, "hello")
+		}
+	}
+	want := []string{
+		"/v1beta/models/old:generateContent: Model gemini-1.0-pro is deprecated and will be removed on 2025-02-15.",
+		"/v1beta/models/old:generateContent: some other warning",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
+
+func TestWarningText(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{`299 - "deprecated"`, "deprecated"},
+		{`299 generativelanguage.googleapis.com "a \"quoted\" word" "Wed, 21 Oct 2015 07:28:00 GMT"`, `a "quoted" word`},
+		{`199 - ""`, ""},
+		{"not standard", "not standard"},
+	} {
+		if got := warningText(test.in); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+}